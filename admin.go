@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+var adminKey = flag.String("admin-key", "", "Key required by the admin endpoints, which are disabled when empty")
+var readOnlyOnStart = flag.Bool("read-only", false, "Start in read-only mode, rejecting tunnel creation and sends")
+
+// readOnly is set during maintenance. Reads and streams keep working while
+// anything that changes tunnel content is rejected with 503.
+var readOnly atomic.Bool
+
+// rejectIfReadOnly writes a 503 response and returns true while the server
+// is in read-only mode.
+func rejectIfReadOnly(w http.ResponseWriter) bool {
+	if !readOnly.Load() {
+		return false
+	}
+	slog.Warn("Rejected write while in read-only mode", "status", http.StatusServiceUnavailable)
+	writeJSONError(w, http.StatusServiceUnavailable, "The server is in read-only mode. Please try again later.")
+	return true
+}
+
+// withAdmin only lets requests through that present the admin key, either as
+// an `Authorization: Bearer` token or in the `X-Admin-Key` header.
+func withAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *adminKey == "" {
+			slog.WarnContext(r.Context(), "Admin endpoints are disabled, no admin key is configured", "status", http.StatusForbidden)
+			writeJSONError(w, http.StatusForbidden, "Admin endpoints are disabled.")
+			return
+		}
+
+		key := firstNonEmpty(bearerToken(r), r.Header.Get("X-Admin-Key"))
+		if subtle.ConstantTimeCompare([]byte(key), []byte(*adminKey)) != 1 {
+			slog.WarnContext(r.Context(), "Rejected admin request", "status", http.StatusUnauthorized)
+			writeJSONError(w, http.StatusUnauthorized, "A valid admin key is required.")
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// countSubscribers returns the number of stream subscriptions across all
+// tunnels. Multiplexed streams count once per subscription.
+func countSubscribers() int {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	subscribers := 0
+	for _, subChannels := range clients {
+		for _, subChannelClients := range subChannels {
+			subscribers += len(subChannelClients)
+		}
+	}
+	return subscribers
+}
+
+// countWildcardSubscribers returns how many of the subscriptions counted by
+// countSubscribers are to all subchannels of a tunnel.
+func countWildcardSubscribers() int {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	return wildcardSubscribers()
+}
+
+func adminRuntime(w http.ResponseWriter, r *http.Request) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	tunnelsMutex.Lock()
+	tunnelCount := len(tunnels)
+	tunnelsMutex.Unlock()
+
+	muxSessionsMutex.Lock()
+	muxSessionCount := len(muxSessions)
+	muxSessionsMutex.Unlock()
+
+	writeJSON(w, r, map[string]interface{}{
+		"goroutines": runtime.NumGoroutine(),
+		"memory": map[string]uint64{
+			"alloc":       memStats.Alloc,
+			"totalAlloc":  memStats.TotalAlloc,
+			"sys":         memStats.Sys,
+			"heapAlloc":   memStats.HeapAlloc,
+			"heapInuse":   memStats.HeapInuse,
+			"heapObjects": memStats.HeapObjects,
+			"numGC":       uint64(memStats.NumGC),
+		},
+		"tunnels":             tunnelCount,
+		"subscribers":         countSubscribers(),
+		"wildcardSubscribers": countWildcardSubscribers(),
+		"dropped":             droppedMessages.Load(),
+		"muxSessions":         muxSessionCount,
+	})
+	slog.InfoContext(r.Context(), "Served runtime stats")
+}
+
+// adminReadOnly reports the read-only mode and, given an `enabled` parameter,
+// switches it.
+func adminReadOnly(w http.ResponseWriter, r *http.Request) {
+	params, ok := parseTunnelParams(w, r)
+	if !ok {
+		return
+	}
+
+	if enabled := params.Get("enabled"); enabled != "" {
+		value, err := strconv.ParseBool(enabled)
+		if err != nil {
+			slog.WarnContext(r.Context(), "Invalid 'enabled' value", "value", enabled, "status", http.StatusBadRequest)
+			writeJSONError(w, http.StatusBadRequest, "The 'enabled' value must be true or false")
+			return
+		}
+		if readOnly.Swap(value) != value {
+			slog.InfoContext(r.Context(), "Read-only mode toggled by admin", "enabled", value)
+		}
+	}
+
+	writeJSON(w, r, map[string]bool{"readOnly": readOnly.Load()})
+}
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// adminListTunnels lists tunnels sorted by id, each with its subchannels and
+// the number of streams subscribed to each of them. Paginated with `offset`
+// and `limit`.
+func adminListTunnels(w http.ResponseWriter, r *http.Request) {
+	offset, err := listParam(r, "offset", 0)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Invalid 'offset' value", "value", r.URL.Query().Get("offset"), "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "The 'offset' value must be a non-negative integer")
+		return
+	}
+	limit, err := listParam(r, "limit", defaultListLimit)
+	if err != nil || limit == 0 {
+		slog.WarnContext(r.Context(), "Invalid 'limit' value", "value", r.URL.Query().Get("limit"), "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "The 'limit' value must be a positive integer")
+		return
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	subChannels := make(map[string]map[string]int)
+	tunnelsMutex.Lock()
+	for id, tunnel := range tunnels {
+		names := make(map[string]int)
+		for subChannel := range tunnel.SubChannels {
+			names[subChannel] = 0
+		}
+		for subChannel := range tunnel.Sequences {
+			names[subChannel] = 0
+		}
+		subChannels[id] = names
+	}
+	tunnelsMutex.Unlock()
+
+	clientsMutex.Lock()
+	for id, names := range subChannels {
+		for subChannel, subChannelClients := range clients[id] {
+			if len(subChannelClients) > 0 {
+				names[subChannel] = len(subChannelClients)
+			}
+		}
+	}
+	clientsMutex.Unlock()
+
+	ids := make([]string, 0, len(subChannels))
+	for id := range subChannels {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	total := len(ids)
+	if offset > len(ids) {
+		offset = len(ids)
+	}
+	ids = ids[offset:]
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	list := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		list = append(list, map[string]interface{}{"id": id, "subChannels": subChannels[id]})
+	}
+
+	writeJSON(w, r, map[string]interface{}{"total": total, "offset": offset, "limit": limit, "tunnels": list})
+	slog.InfoContext(r.Context(), "Listed tunnels")
+}
+
+func listParam(r *http.Request, name string, fallback int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err == nil && number < 0 {
+		err = strconv.ErrRange
+	}
+	return number, err
+}
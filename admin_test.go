@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// setReadOnly switches read-only mode for a test.
+func setReadOnly(t *testing.T, enabled bool) {
+	t.Helper()
+	previous := readOnly.Swap(enabled)
+	t.Cleanup(func() { readOnly.Store(previous) })
+}
+
+// writeRequests are the requests read-only mode rejects.
+func writeRequests() map[string]func(http.ResponseWriter) {
+	serve := func(handler http.HandlerFunc, method string, target string, body string) func(http.ResponseWriter) {
+		return func(w http.ResponseWriter) {
+			handler(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		}
+	}
+	return map[string]func(http.ResponseWriter){
+		"create":  serve(createTunnel, http.MethodGet, "/api/v3/tunnel/create?id=created", ""),
+		"send":    serve(sendToTunnel, http.MethodGet, "/api/v3/tunnel/send?id=ro&content=hi", ""),
+		"batch":   serve(sendBatch, http.MethodPost, "/api/v3/tunnel/batch", `[{"id": "ro", "subChannel": "batch", "content": "hi"}]`),
+		"consume": serve(getTunnelContent, http.MethodGet, "/api/v3/tunnel/get?id=ro&subChannel=held&consume=true", ""),
+		"delete":  serve(deleteTunnel, http.MethodDelete, "/api/v3/tunnel/delete?id=ro&subChannel=gone", ""),
+	}
+}
+
+func TestReadOnlyModeRejectsWritesButServesReads(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, &tunnelLimiters, NewRateLimiterStore(0, 0))
+	setReadOnly(t, true)
+	tunnel := addTestTunnel("ro")
+	tunnel.setContent("held", "kept", false)
+	tunnel.setContent("gone", "deleted", false)
+
+	for name, write := range writeRequests() {
+		w := httptest.NewRecorder()
+		write(w)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s answered %d in read-only mode, want %d", name, w.Code, http.StatusServiceUnavailable)
+		}
+	}
+	if len(tunnels) != 1 || string(tunnel.SubChannels["held"].Data) != "kept" || len(tunnel.SubChannels) != 2 || len(tunnel.Sequences) != 0 {
+		t.Fatal("a write went through in read-only mode")
+	}
+
+	w := httptest.NewRecorder()
+	getTunnelContent(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/get?id=ro&subChannel=held&raw=true", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "kept" {
+		t.Errorf("get answered %d %q in read-only mode, want the content", w.Code, w.Body)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(streamTunnelContent))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "?id=ro&subChannel=held")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("stream answered %d in read-only mode", resp.StatusCode)
+	}
+	waitForSubscribers(t, "ro", 1)
+}
+
+func TestWritableModeAcceptsWrites(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, &tunnelLimiters, NewRateLimiterStore(0, 0))
+	setReadOnly(t, false)
+	tunnel := addTestTunnel("ro")
+	tunnel.setContent("held", "kept", false)
+	tunnel.setContent("gone", "deleted", false)
+
+	for name, write := range writeRequests() {
+		w := httptest.NewRecorder()
+		write(w)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s answered %d, want %d: %s", name, w.Code, http.StatusOK, w.Body)
+		}
+	}
+}
+
+func TestAdminTogglesReadOnlyMode(t *testing.T) {
+	resetTunnels(t)
+	setReadOnly(t, false)
+	addTestTunnel("ro")
+
+	toggle := func(enabled string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		adminReadOnly(w, httptest.NewRequest(http.MethodPost, "/api/v3/admin/read-only", strings.NewReader(`{"enabled": `+enabled+`}`)))
+		return w
+	}
+	send := func() int {
+		w := httptest.NewRecorder()
+		sendToTunnel(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/send?id=ro&content=hi", nil))
+		return w.Code
+	}
+
+	if w := toggle("true"); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"readOnly":true}` {
+		t.Fatalf("enabling answered %d %s", w.Code, w.Body)
+	}
+	if status := send(); status != http.StatusServiceUnavailable {
+		t.Errorf("send answered %d once enabled, want %d", status, http.StatusServiceUnavailable)
+	}
+
+	if w := toggle("false"); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"readOnly":false}` {
+		t.Fatalf("disabling answered %d %s", w.Code, w.Body)
+	}
+	if status := send(); status != http.StatusOK {
+		t.Errorf("send answered %d once disabled, want %d", status, http.StatusOK)
+	}
+
+	if w := toggle(`"maybe"`); w.Code != http.StatusBadRequest || readOnly.Load() {
+		t.Errorf("an invalid toggle answered %d and left read-only %t", w.Code, readOnly.Load())
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var authTokens = flag.String("auth-tokens", "", "Require one of these bearer tokens on the tunnel endpoints, as comma separated name=token pairs")
+var authURL = flag.String("auth-url", "", "Require a bearer token on the tunnel endpoints that this token introspection URL accepts")
+var authCacheTTL = flag.Duration("auth-cache-ttl", time.Minute, "How long results from -auth-url are cached")
+
+// Authenticator decides whether a request may use the tunnel endpoints and
+// who it belongs to.
+type Authenticator interface {
+	Authenticate(r *http.Request) (identity string, ok bool)
+}
+
+// authenticator protects the tunnel endpoints. They are open when it is nil.
+var authenticator Authenticator
+
+// newAuthenticator builds the Authenticator configured with -auth-tokens or
+// -auth-url, or returns nil if neither is set.
+func newAuthenticator() (Authenticator, error) {
+	if *authTokens != "" && *authURL != "" {
+		return nil, fmt.Errorf("-auth-tokens and -auth-url cannot be combined")
+	}
+	if *authTokens != "" {
+		return newStaticTokenAuthenticator(*authTokens)
+	}
+	if *authURL != "" {
+		if _, err := url.ParseRequestURI(*authURL); err != nil {
+			return nil, fmt.Errorf("invalid -auth-url: %w", err)
+		}
+		return newHTTPAuthenticator(*authURL, *authCacheTTL), nil
+	}
+	return nil, nil
+}
+
+// withAuth rejects requests the configured Authenticator does not accept.
+func withAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authenticator == nil {
+			handler(w, r)
+			return
+		}
+
+		identity, ok := authenticator.Authenticate(r)
+		if !ok {
+			slog.WarnContext(r.Context(), "Rejected unauthenticated request", "status", http.StatusUnauthorized)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, "A valid bearer token is required.")
+			return
+		}
+
+		slog.DebugContext(r.Context(), "Authenticated request", "identity", identity)
+		handler(w, r)
+	}
+}
+
+// bearerToken returns the token of an `Authorization: Bearer` header.
+func bearerToken(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+}
+
+// staticTokenAuthenticator accepts a fixed set of tokens, each standing for
+// a named identity.
+type staticTokenAuthenticator struct {
+	identities map[string]string
+}
+
+// newStaticTokenAuthenticator parses comma separated name=token pairs. Tokens
+// without a name are identified as "token", so they never end up in logs.
+func newStaticTokenAuthenticator(value string) (*staticTokenAuthenticator, error) {
+	identities := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, token, found := strings.Cut(pair, "=")
+		if !found {
+			name, token = "token", pair
+		}
+		name = strings.TrimSpace(name)
+		token = strings.TrimSpace(token)
+		if name == "" || token == "" {
+			return nil, fmt.Errorf("invalid auth token %q, expected name=token", pair)
+		}
+		identities[token] = name
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no auth tokens given")
+	}
+	return &staticTokenAuthenticator{identities: identities}, nil
+}
+
+func (a *staticTokenAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		return "", false
+	}
+	// Compare against every token so the time taken doesn't reveal which
+	// one came close.
+	identity := ""
+	for candidate, name := range a.identities {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+			identity = name
+		}
+	}
+	return identity, identity != ""
+}
+
+type authCacheEntry struct {
+	identity string
+	ok       bool
+	expires  time.Time
+}
+
+// httpAuthenticator validates bearer tokens against an OAuth 2.0 token
+// introspection endpoint (RFC 7662) and caches the answers.
+type httpAuthenticator struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+	mutex  sync.Mutex
+	cache  map[string]authCacheEntry
+}
+
+// maxAuthCacheEntries is the cache size above which expired entries are
+// swept on insert.
+const maxAuthCacheEntries = 10000
+
+func newHTTPAuthenticator(introspectionURL string, ttl time.Duration) *httpAuthenticator {
+	return &httpAuthenticator{
+		url:    introspectionURL,
+		ttl:    ttl,
+		client: &http.Client{Timeout: 5 * time.Second},
+		cache:  make(map[string]authCacheEntry),
+	}
+}
+
+func (a *httpAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		return "", false
+	}
+
+	a.mutex.Lock()
+	entry, cached := a.cache[token]
+	a.mutex.Unlock()
+	if cached && time.Now().Before(entry.expires) {
+		return entry.identity, entry.ok
+	}
+
+	identity, ok, err := a.introspect(token)
+	if err != nil {
+		// Failures of the auth service are not cached, so the next request
+		// tries again.
+		slog.ErrorContext(r.Context(), "Failed to validate token", "error", err)
+		return "", false
+	}
+
+	a.mutex.Lock()
+	if len(a.cache) >= maxAuthCacheEntries {
+		now := time.Now()
+		for cachedToken, entry := range a.cache {
+			if now.After(entry.expires) {
+				delete(a.cache, cachedToken)
+			}
+		}
+	}
+	a.cache[token] = authCacheEntry{identity: identity, ok: ok, expires: time.Now().Add(a.ttl)}
+	a.mutex.Unlock()
+	return identity, ok
+}
+
+// introspect asks the introspection endpoint whether a token is active. The
+// identity is the token's `sub`, or its `username` when there is none.
+func (a *httpAuthenticator) introspect(token string) (string, bool, error) {
+	response, err := a.client.PostForm(a.url, url.Values{"token": {token}})
+	if err != nil {
+		return "", false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("introspection returned %s", response.Status)
+	}
+
+	var introspection struct {
+		Active   bool   `json:"active"`
+		Subject  string `json:"sub"`
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&introspection); err != nil {
+		return "", false, err
+	}
+	if !introspection.Active {
+		return "", false, nil
+	}
+	return firstNonEmpty(introspection.Subject, introspection.Username, "token"), true, nil
+}
+
+// hashSecret hashes a tunnel secret so the secret itself is never kept.
+func hashSecret(secret string) []byte {
+	hash := sha256.Sum256([]byte(secret))
+	return hash[:]
+}
+
+// secretStatus checks a request against the tunnel's secret, given as a
+// `secret` parameter or field or, unless -auth-tokens or -auth-url already
+// claim it, as an `Authorization: Bearer` token. It returns 200 if the
+// tunnel has no secret or it matches, 403 if none was given and 401 if it
+// doesn't match.
+func (t *Tunnel) secretStatus(r *http.Request, params TunnelParams) int {
+	if t.SecretHash == nil {
+		return http.StatusOK
+	}
+	secret := params.Get("secret")
+	if secret == "" && authenticator == nil {
+		secret = bearerToken(r)
+	}
+	if secret == "" {
+		return http.StatusForbidden
+	}
+	if subtle.ConstantTimeCompare(hashSecret(secret), t.SecretHash) != 1 {
+		return http.StatusUnauthorized
+	}
+	return http.StatusOK
+}
+
+// rejectSecret writes the response for a failed secretStatus.
+func rejectSecret(w http.ResponseWriter, r *http.Request, status int, tunnelId string) {
+	if status == http.StatusForbidden {
+		slog.WarnContext(r.Context(), "Missing secret", "tunnel_id", tunnelId, "status", http.StatusForbidden)
+		writeJSONError(w, http.StatusForbidden, "This tunnel requires a secret.")
+		return
+	}
+	slog.WarnContext(r.Context(), "Wrong secret", "tunnel_id", tunnelId, "status", http.StatusUnauthorized)
+	writeJSONError(w, http.StatusUnauthorized, "The secret does not match this tunnel.")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"time"
+)
+
+// Backend shares tunnels between server instances, so any of them can serve
+// any tunnel. Each instance keeps the tunnels it uses in the tunnels map; the
+// backend stores them for the other instances and carries the events that
+// keep those copies and their streams up to date.
+type Backend interface {
+	// LoadTunnel returns a tunnel stored by any instance, or nil if there is
+	// none.
+	LoadTunnel(id string) (*persistedTunnel, error)
+	// SaveTunnel stores a new tunnel, replacing any tunnel with its id.
+	SaveTunnel(tunnel persistedTunnel) error
+	// DeleteTunnel removes a tunnel and its content.
+	DeleteTunnel(id string) error
+	// SetContent stores the content of msg as the content of its subchannel,
+	// along with its sequence and how it is typed.
+	SetContent(id string, msg StreamMessage) error
+	// DeleteSubChannel removes the content and sequence of a subchannel.
+	DeleteSubChannel(id string, subChannel string) error
+	// Publish hands an event to the other instances, which pass it to
+	// applyEvent.
+	Publish(event backendEvent) error
+}
+
+// backend is where tunnels are shared. The default keeps every instance on
+// its own.
+var backend Backend = memoryBackend{}
+
+// memoryBackend shares nothing: the tunnels map is all there is.
+type memoryBackend struct{}
+
+func (memoryBackend) LoadTunnel(id string) (*persistedTunnel, error)      { return nil, nil }
+func (memoryBackend) SaveTunnel(tunnel persistedTunnel) error             { return nil }
+func (memoryBackend) DeleteTunnel(id string) error                        { return nil }
+func (memoryBackend) SetContent(id string, msg StreamMessage) error       { return nil }
+func (memoryBackend) DeleteSubChannel(id string, subChannel string) error { return nil }
+func (memoryBackend) Publish(event backendEvent) error                    { return nil }
+
+// Types of backendEvent.
+const (
+	eventSent              = "sent"
+	eventCleared           = "cleared"
+	eventSubChannelRemoved = "subChannelRemoved"
+	eventTunnelRemoved     = "tunnelRemoved"
+)
+
+// backendEvent tells the other instances about a change to a tunnel.
+type backendEvent struct {
+	// Instance is the instance the event came from, so it can skip its own.
+	Instance   string `json:"instance"`
+	Type       string `json:"type"`
+	TunnelID   string `json:"tunnelId"`
+	SubChannel string `json:"subChannel,omitempty"`
+	// Content, Binary, ContentType, Comment, Sequence and SentAt describe a
+	// sent message.
+	Content     []byte    `json:"content,omitempty"`
+	Binary      bool      `json:"binary,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	Comment     bool      `json:"comment,omitempty"`
+	Sequence    uint64    `json:"sequence,omitempty"`
+	SentAt      time.Time `json:"sentAt"`
+	// Stored is what the subchannel holds after an appended message, as
+	// Content is only the appended part.
+	Stored []byte `json:"stored,omitempty"`
+	// Reason is the close reason of a removal.
+	Reason string `json:"reason,omitempty"`
+}
+
+// backendInstance identifies this instance in the events it publishes.
+var backendInstance = newBackendInstance()
+
+func newBackendInstance() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		fatal("Failed to generate an instance id", "error", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// publish hands an event to the other instances. A failure only affects
+// them, so it is logged rather than failing the request.
+func publish(event backendEvent) {
+	event.Instance = backendInstance
+	if err := backend.Publish(event); err != nil {
+		slog.Error("Failed to publish", "event", event.Type, "tunnel_id", event.TunnelID, "error", err)
+	}
+}
+
+// loadTunnel looks up a tunnel in the tunnels map, loading it from the
+// backend when another instance created it. It must be called with
+// tunnelsMutex held, which it releases while it waits on the backend, so a
+// slow backend doesn't hold up other tunnels. If the tunnel was loaded or
+// created meanwhile, that one wins.
+func loadTunnel(tunnelId string) (*Tunnel, bool) {
+	if tunnel, exists := tunnels[tunnelId]; exists {
+		return tunnel, true
+	}
+	tunnelsMutex.Unlock()
+	loaded := fetchTunnel(tunnelId)
+	tunnelsMutex.Lock()
+	if tunnel, exists := tunnels[tunnelId]; exists {
+		if loaded != nil {
+			loaded.clearAll()
+		}
+		return tunnel, true
+	}
+	if loaded == nil {
+		return nil, false
+	}
+	tunnels[tunnelId] = loaded
+	slog.Info("Loaded tunnel from the backend", "tunnel_id", tunnelId)
+	return loaded, true
+}
+
+// fetchTunnel loads a tunnel from the backend, or returns nil if it holds
+// none or it can't be loaded. It must be called without tunnelsMutex held.
+func fetchTunnel(tunnelId string) *Tunnel {
+	saved, err := backend.LoadTunnel(tunnelId)
+	if err != nil {
+		slog.Error("Failed to load tunnel", "tunnel_id", tunnelId, "error", err)
+		return nil
+	}
+	if saved == nil {
+		return nil
+	}
+	tunnel, err := restoreTunnel(*saved)
+	if err != nil {
+		slog.Error("Failed to restore tunnel", "tunnel_id", tunnelId, "error", err)
+		return nil
+	}
+	return tunnel
+}
+
+// applyEvent brings this instance in line with a change made on another
+// one. Only tunnels this instance already holds are updated; others are
+// loaded with their latest content when they are first used.
+func applyEvent(event backendEvent) {
+	tunnelsMutex.Lock()
+	tunnel, cached := tunnels[event.TunnelID]
+	if !cached {
+		tunnelsMutex.Unlock()
+		return
+	}
+
+	switch event.Type {
+	case eventSent:
+		msg := StreamMessage{SubChannel: event.SubChannel, Content: string(event.Content), Binary: event.Binary, ContentType: event.ContentType, Comment: event.Comment, Sequence: event.Sequence, SentAt: event.SentAt}
+		tunnel.recordMessage(time.Now(), len(msg.Content))
+		tunnel.touch()
+		// Content that is slow to store is prepared with tunnelsMutex
+		// released, as in sendContent.
+		var prepared preparedContent
+		var err error
+		if !msg.Comment {
+			stored := msg.Content
+			if event.Stored != nil {
+				stored = string(event.Stored)
+			}
+			if slowToStore(len(stored)) {
+				tunnelsMutex.Unlock()
+				prepared, err = prepareContent(stored)
+				tunnelsMutex.Lock()
+				if current, cached := tunnels[event.TunnelID]; !cached || current != tunnel {
+					tunnelsMutex.Unlock()
+					prepared.discard()
+					return
+				}
+			} else {
+				prepared = preparedContent{stored: StoredContent{Data: []byte(stored)}}
+			}
+			if err != nil {
+				slog.Error("Failed to store content from another instance", "error", err)
+			} else {
+				tunnel.storeContent(msg.SubChannel, prepared, msg.Binary)
+			}
+			tunnel.setContentType(msg.SubChannel, msg.ContentType)
+			tunnel.Sequences[msg.SubChannel] = msg.Sequence
+			tunnel.recordHistory(msg, event.Stored != nil)
+		}
+		tunnelsMutex.Unlock()
+		broadcast(event.TunnelID, event.SubChannel, msg)
+	case eventCleared:
+		tunnel.clearContent(event.SubChannel)
+		tunnelsMutex.Unlock()
+	case eventSubChannelRemoved:
+		tunnelsMutex.Unlock()
+		dropSubChannel(tunnel, event.SubChannel, event.Reason)
+	case eventTunnelRemoved:
+		tunnelsMutex.Unlock()
+		dropTunnel(tunnel, event.Reason)
+	default:
+		tunnelsMutex.Unlock()
+		slog.Info("Ignoring unknown event from another instance", "event", event.Type)
+	}
+}
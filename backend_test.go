@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// blockingBackend holds every tunnel load until release is closed, and
+// tells loading when one has started.
+type blockingBackend struct {
+	memoryBackend
+	loading chan string
+	release chan struct{}
+	saved   *persistedTunnel
+}
+
+func (b blockingBackend) LoadTunnel(id string) (*persistedTunnel, error) {
+	b.loading <- id
+	<-b.release
+	return b.saved, nil
+}
+
+func setBlockingBackend(t *testing.T, saved *persistedTunnel) blockingBackend {
+	t.Helper()
+	blocking := blockingBackend{loading: make(chan string, 1), release: make(chan struct{}), saved: saved}
+	setFlag[Backend](t, &backend, blocking)
+	return blocking
+}
+
+// loadInBackground starts loading a tunnel that is not in the tunnels map,
+// and returns once the backend is waited on.
+func loadInBackground(t *testing.T, blocking blockingBackend, id string) <-chan *Tunnel {
+	t.Helper()
+	loaded := make(chan *Tunnel, 1)
+	go func() {
+		tunnelsMutex.Lock()
+		tunnel, _ := loadTunnel(id)
+		tunnelsMutex.Unlock()
+		loaded <- tunnel
+	}()
+	select {
+	case <-blocking.loading:
+	case <-time.After(time.Second):
+		t.Fatal("the tunnel was never loaded from the backend")
+	}
+	return loaded
+}
+
+func TestSlowBackendDoesNotHoldUpOtherTunnels(t *testing.T) {
+	resetTunnels(t)
+	addTestTunnel("local")
+	blocking := setBlockingBackend(t, &persistedTunnel{ID: "remote"})
+	loaded := loadInBackground(t, blocking, "remote")
+
+	done := make(chan int, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		sendToTunnel(w, httptest.NewRequest(http.MethodPost, "/api/v3/tunnel/send?id=local&content=hi", nil))
+		done <- w.Code
+	}()
+	select {
+	case status := <-done:
+		if status != http.StatusOK {
+			t.Errorf("send to another tunnel answered %d, want %d", status, http.StatusOK)
+		}
+	case <-time.After(time.Second):
+		t.Error("send to another tunnel waited on the backend")
+	}
+
+	close(blocking.release)
+	if tunnel := <-loaded; tunnel == nil || tunnel.ID != "remote" {
+		t.Fatalf("loaded %+v, want the tunnel from the backend", tunnel)
+	}
+	tunnelsMutex.Lock()
+	_, stored := tunnels["remote"]
+	tunnelsMutex.Unlock()
+	if !stored {
+		t.Error("the loaded tunnel was not kept")
+	}
+}
+
+func TestTunnelCreatedDuringALoadWins(t *testing.T) {
+	resetTunnels(t)
+	blocking := setBlockingBackend(t, &persistedTunnel{ID: "raced"})
+	loaded := loadInBackground(t, blocking, "raced")
+
+	created := addTestTunnel("raced")
+	close(blocking.release)
+	if tunnel := <-loaded; tunnel != created {
+		t.Errorf("loaded %p, want the tunnel created meanwhile %p", tunnel, created)
+	}
+	tunnelsMutex.Lock()
+	current := tunnels["raced"]
+	tunnelsMutex.Unlock()
+	if current != created {
+		t.Error("the tunnel created meanwhile was replaced by the loaded one")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+var maxBatchSize = flag.Int("max-batch-size", 100, "Maximum number of messages in a single batch send")
+var batchDuplicatePolicy = flag.String("batch-duplicates", batchDuplicatesReject, "What to do when a batch sends to the same subchannel of a tunnel twice: reject the batch, or last-wins to only send the last message")
+
+// The -batch-duplicates policies.
+const (
+	batchDuplicatesReject   = "reject"
+	batchDuplicatesLastWins = "last-wins"
+)
+
+func validBatchDuplicatePolicy(policy string) error {
+	switch policy {
+	case batchDuplicatesReject, batchDuplicatesLastWins:
+		return nil
+	}
+	return fmt.Errorf("unknown policy %q, expected reject or last-wins", policy)
+}
+
+// batchResult is the outcome of one message of a batch send.
+type batchResult struct {
+	ID         string `json:"id"`
+	SubChannel string `json:"subChannel"`
+	Status     int    `json:"status"`
+	Error      string `json:"error,omitempty"`
+	Sequence   uint64 `json:"sequence,omitempty"`
+	// Superseded is set on messages that were not sent because a later one
+	// of the batch goes to the same subchannel, with -batch-duplicates
+	// last-wins.
+	Superseded bool `json:"superseded,omitempty"`
+}
+
+// sendBatch sends a JSON array of messages, each with the fields of the send
+// endpoint, in one request. The whole batch is rejected if any message is
+// invalid; otherwise every message is delivered on its own and the response
+// lists the result of each, in order. Query parameters apply to every message.
+func sendBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		slog.WarnContext(r.Context(), "Method not allowed. Only POST requests are allowed.", "status", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed. Only POST requests are allowed.")
+		return
+	}
+
+	if rejectIfReadOnly(w) {
+		return
+	}
+
+	requestBody, ok := readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	var items []map[string]interface{}
+	if err := json.Unmarshal(requestBody, &items); err != nil {
+		slog.WarnContext(r.Context(), "Failed to parse the batch", "error", err, "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "The request body must be a JSON array of messages")
+		return
+	}
+
+	if len(items) == 0 || len(items) > *maxBatchSize {
+		slog.WarnContext(r.Context(), "Invalid batch size", "size", len(items), "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("A batch must contain between 1 and %d messages", *maxBatchSize))
+		return
+	}
+
+	allParams := make([]TunnelParams, len(items))
+	messages := make([]StreamMessage, len(items))
+	for i, item := range items {
+		fields := queryFields(r)
+		for name, value := range item {
+			fields[name] = fieldString(value)
+		}
+		resolveFieldAliases(fields)
+		allParams[i] = newTunnelParams(r, fields, false)
+
+		msg, rejection := newSendMessage(allParams[i])
+		if rejection != nil {
+			slog.WarnContext(r.Context(), rejection.log, "index", i, "status", http.StatusBadRequest)
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Message %d: %s", i, rejection.message))
+			return
+		}
+		messages[i] = msg
+	}
+
+	supersededBy := batchDuplicates(allParams, messages)
+	if len(supersededBy) > 0 && *batchDuplicatePolicy == batchDuplicatesReject {
+		first := len(items)
+		for i := range supersededBy {
+			first = min(first, i)
+		}
+		later := supersededBy[first]
+		slog.WarnContext(r.Context(), "Batch sends to a subchannel twice", "tunnel_id", allParams[first].ID, "subchannel", messages[first].SubChannel, "index", later, "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Message %d: Sends to the same subchannel as message %d", later, first))
+		return
+	}
+
+	results := make([]batchResult, len(items))
+	failed := 0
+	for i, params := range allParams {
+		if _, superseded := supersededBy[i]; superseded {
+			results[i] = batchResult{ID: params.ID, SubChannel: messages[i].SubChannel, Status: http.StatusOK, Superseded: true}
+			continue
+		}
+		results[i] = sendBatchMessage(r, params, messages[i])
+		if results[i].Status != http.StatusOK {
+			failed++
+		}
+	}
+
+	writeJSON(w, r, results)
+	slog.InfoContext(r.Context(), "Sent batch", "messages", len(items), "failed", failed)
+}
+
+// batchDuplicates finds the messages of a batch that send to the same
+// subchannel of a tunnel as a later one, and returns the index of the next
+// such message for each of them. Comments are not stored and queue tunnels
+// keep every message, so neither counts.
+func batchDuplicates(allParams []TunnelParams, messages []StreamMessage) map[int]int {
+	type target struct{ id, subChannel string }
+	supersededBy := make(map[int]int)
+	last := make(map[target]int)
+	tunnelsMutex.Lock()
+	defer tunnelsMutex.Unlock()
+	for i, msg := range messages {
+		if msg.Comment {
+			continue
+		}
+		if tunnel, exists := liveTunnel(allParams[i].ID); exists && tunnel.Queue {
+			continue
+		}
+		key := target{allParams[i].ID, msg.SubChannel}
+		if previous, seen := last[key]; seen {
+			supersededBy[previous] = i
+		}
+		last[key] = i
+	}
+	return supersededBy
+}
+
+// sendBatchMessage delivers one message of a batch, applying the checks the
+// send endpoint would, including the per-tunnel rate limit.
+func sendBatchMessage(r *http.Request, params TunnelParams, msg StreamMessage) batchResult {
+	id := params.ID
+	result := batchResult{ID: id, SubChannel: msg.SubChannel}
+	fail := func(status int, message string) batchResult {
+		result.Status = status
+		result.Error = message
+		return result
+	}
+
+	if allowed, _, _ := tunnelLimiters.allow(id); !allowed {
+		rateLimitRejections.WithLabelValues("tunnel").Inc()
+		slog.WarnContext(r.Context(), "Rate limit exceeded", "limiter", "tunnel", "tunnel_id", id, "status", http.StatusTooManyRequests)
+		return fail(http.StatusTooManyRequests, "Too many requests for this tunnel. Please slow down.")
+	}
+
+	tunnelsMutex.Lock()
+	tunnel, exists := liveTunnel(id)
+	if !exists {
+		tunnelsMutex.Unlock()
+		slog.WarnContext(r.Context(), "No tunnel with this id exists", "tunnel_id", id, "status", http.StatusNotFound)
+		return fail(http.StatusNotFound, "No tunnel with this id exists.")
+	}
+	status := tunnel.secretStatus(r, params)
+	tunnelsMutex.Unlock()
+	switch status {
+	case http.StatusForbidden:
+		slog.WarnContext(r.Context(), "Missing secret", "tunnel_id", id, "status", status)
+		return fail(status, "This tunnel requires a secret.")
+	case http.StatusUnauthorized:
+		slog.WarnContext(r.Context(), "Wrong secret", "tunnel_id", id, "status", status)
+		return fail(status, "The secret does not match this tunnel.")
+	}
+
+	sequence, err := sendContent(tunnel, msg)
+	if err != nil {
+		if errors.Is(err, errTunnelGone) {
+			slog.WarnContext(r.Context(), "No tunnel with this id exists", "tunnel_id", id, "status", http.StatusNotFound)
+			return fail(http.StatusNotFound, "No tunnel with this id exists.")
+		}
+		if status, message, ok := queueSendError(err); ok {
+			slog.WarnContext(r.Context(), "Failed to queue content", "tunnel_id", id, "error", err, "status", status)
+			return fail(status, message)
+		}
+		slog.ErrorContext(r.Context(), "Failed to store content", "tunnel_id", id, "error", err, "status", http.StatusInternalServerError)
+		return fail(http.StatusInternalServerError, "Failed to store content")
+	}
+
+	result.Status = http.StatusOK
+	result.Sequence = sequence
+	slog.DebugContext(r.Context(), "Sent content", "tunnel_id", id, "subchannel", msg.SubChannel)
+	return result
+}
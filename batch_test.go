@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postBatch sends a batch and returns the response.
+func postBatch(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	sendBatch(w, httptest.NewRequest(http.MethodPost, "/api/v3/tunnel/batch", strings.NewReader(body)))
+	return w
+}
+
+const duplicateBatch = `[
+	{"id": "batch", "subChannel": "temp", "content": "20"},
+	{"id": "batch", "subChannel": "other", "content": "x"},
+	{"id": "batch", "subChannel": "temp", "content": "21"},
+	{"id": "batch", "subChannel": "temp", "content": "22"}
+]`
+
+func TestBatchWithDuplicateSubChannelIsRejected(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, &tunnelLimiters, NewRateLimiterStore(0, 0))
+	setFlag(t, batchDuplicatePolicy, batchDuplicatesReject)
+	tunnel := addTestTunnel("batch")
+
+	w := postBatch(t, duplicateBatch)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if !strings.Contains(w.Body.String(), "Message 2: Sends to the same subchannel as message 0") {
+		t.Errorf("error = %s, want it to name messages 2 and 0", w.Body)
+	}
+	if len(tunnel.Sequences) != 0 {
+		t.Errorf("sequences = %v, want nothing sent", tunnel.Sequences)
+	}
+}
+
+func TestBatchWithDuplicateSubChannelSendsTheLastMessage(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, &tunnelLimiters, NewRateLimiterStore(0, 0))
+	setFlag(t, batchDuplicatePolicy, batchDuplicatesLastWins)
+	addTestTunnel("batch")
+
+	w := postBatch(t, duplicateBatch)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var results []batchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	want := []batchResult{
+		{ID: "batch", SubChannel: "temp", Status: http.StatusOK, Superseded: true},
+		{ID: "batch", SubChannel: "other", Status: http.StatusOK, Sequence: 1},
+		{ID: "batch", SubChannel: "temp", Status: http.StatusOK, Superseded: true},
+		{ID: "batch", SubChannel: "temp", Status: http.StatusOK, Sequence: 1},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("results = %+v, want %+v", results, want)
+	}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Errorf("result %d = %+v, want %+v", i, results[i], want[i])
+		}
+	}
+	if got := strings.Join(historyOf(t, "batch", "temp"), ","); got != "22" {
+		t.Errorf("history of temp = %q, want only the last message", got)
+	}
+}
+
+func TestBatchDuplicatesIgnoreCommentsAndQueues(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, &tunnelLimiters, NewRateLimiterStore(0, 0))
+	setFlag(t, batchDuplicatePolicy, batchDuplicatesReject)
+	addTestTunnel("batch")
+	addTestTunnel("queue").Queue = true
+
+	w := postBatch(t, `[
+		{"id": "batch", "content": "working", "asComment": true},
+		{"id": "batch", "content": "done"},
+		{"id": "queue", "content": "job 1"},
+		{"id": "queue", "content": "job 2"}
+	]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var results []batchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Status != http.StatusOK || result.Superseded {
+			t.Errorf("result %d = %+v, want it sent", i, result)
+		}
+	}
+}
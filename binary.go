@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// octetStream is the media type of raw binary request and response bodies.
+const octetStream = "application/octet-stream"
+
+// base64Encoding marks content that is carried base64-encoded, in the
+// `encoding` field of requests, responses and stream events.
+const base64Encoding = "base64"
+
+// isOctetStream reports whether the request body is raw binary content.
+func isOctetStream(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == octetStream
+}
+
+// acceptsOctetStream reports whether the client asked for raw binary content
+// with an `Accept: application/octet-stream` header.
+func acceptsOctetStream(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && mediaType == octetStream {
+			return true
+		}
+	}
+	return false
+}
+
+// sentContent returns the content of a send request and whether it is
+// binary: either the raw body of an application/octet-stream request, or a
+// `content` field with `encoding` set to `base64`.
+func sentContent(params TunnelParams) (string, bool, error) {
+	if params.RawContent {
+		return params.Content, true, nil
+	}
+	switch encoding := params.Get("encoding"); encoding {
+	case "":
+		return params.Content, false, nil
+	case base64Encoding:
+		decoded, err := base64.StdEncoding.DecodeString(params.Content)
+		if err != nil {
+			return "", false, fmt.Errorf("invalid base64 content: %w", err)
+		}
+		return string(decoded), true, nil
+	default:
+		return "", false, fmt.Errorf("unknown encoding %q", encoding)
+	}
+}
+
+// streamContent prepares content for a stream event. Binary content is cut
+// to -stream-max-content bytes and base64-encoded, with the truncation
+// marker appended after the encoded data, where it can't be mistaken for it.
+func streamContent(content string, binary bool) string {
+	if !binary {
+		return truncateForStream(content)
+	}
+	if *streamMaxContent <= 0 || len(content) <= *streamMaxContent {
+		return base64.StdEncoding.EncodeToString([]byte(content))
+	}
+	return base64.StdEncoding.EncodeToString([]byte(content[:*streamMaxContent])) + truncatedMarker
+}
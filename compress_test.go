@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// sampleContent is JSON-like content of about the given size, as tunnels
+// usually carry.
+func sampleContent(size int) string {
+	var builder strings.Builder
+	for i := 0; builder.Len() < size; i++ {
+		fmt.Fprintf(&builder, `{"sensor": "temperature-%d", "value": %d.5, "unit": "celsius"}`+"\n", i%50, i%40)
+	}
+	return builder.String()[:size]
+}
+
+func TestCompressedContentReadsBackUnchanged(t *testing.T) {
+	setFlag(t, compressContent, true)
+	setFlag(t, compressThreshold, 1024)
+	tunnel := newTunnel("gzip")
+
+	for _, size := range []int{1024, 1025, 64 << 10} {
+		content := sampleContent(size)
+		if err := tunnel.setContent("main", content, false); err != nil {
+			t.Fatal(err)
+		}
+		stored := tunnel.SubChannels["main"]
+		if compressed := size > 1024; stored.Compressed != compressed {
+			t.Errorf("content of %d bytes compressed = %t, want %t", size, stored.Compressed, compressed)
+		}
+		read, err := tunnel.contentRef("main").read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read != content {
+			t.Errorf("content of %d bytes read back differently", size)
+		}
+	}
+}
+
+// BenchmarkContentAtRest stores and reads back content with and without
+// -compress-content, reporting the bytes held in memory.
+func BenchmarkContentAtRest(b *testing.B) {
+	for _, size := range []int{4 << 10, 64 << 10, 1 << 20} {
+		content := sampleContent(size)
+		for _, compressed := range []bool{false, true} {
+			b.Run(fmt.Sprintf("size=%d/compressed=%t", size, compressed), func(b *testing.B) {
+				setFlag(b, compressContent, compressed)
+				tunnel := newTunnel("gzip")
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if err := tunnel.setContent("main", content, false); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := tunnel.contentRef("main").read(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(tunnel.SubChannels["main"].Data)), "stored-bytes")
+			})
+		}
+	}
+}
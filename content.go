@@ -0,0 +1,321 @@
+package main
+
+import (
+	"flag"
+	"time"
+	"unicode/utf8"
+)
+
+var appendMaxSize = flag.Int("append-max-size", 1<<20, "Bytes a subchannel holds when sent to with append; the oldest content is cut off beyond that")
+
+// StoredContent is a subchannel's content as held in memory. Large content
+// may be kept gzip-compressed, see -compress-content.
+type StoredContent struct {
+	Data       []byte
+	Compressed bool
+}
+
+// The accessors below hide how a subchannel's content is stored: in memory,
+// compressed in memory or spilled to disk. They must be called with
+// tunnelsMutex held.
+
+// preparedContent is content ready to be stored in a subchannel: compressed
+// or spilled to disk if it is large enough to be. Compressing and writing
+// are the slow part of storing content, so they are done by prepareContent
+// without holding tunnelsMutex, and storeContent only puts the result in
+// place.
+type preparedContent struct {
+	stored    StoredContent
+	spillPath string
+}
+
+// slowToStore reports whether content of the given size is compressed or
+// spilled to disk when it is stored.
+func slowToStore(size int) bool {
+	return (*spillThreshold > 0 && size > *spillThreshold) || (*compressContent && size > *compressThreshold)
+}
+
+// prepareContent compresses or spills content as configured. It must be
+// called without tunnelsMutex held. Content that ends up not being stored
+// must be discarded.
+func prepareContent(content string) (preparedContent, error) {
+	if *spillThreshold > 0 && len(content) > *spillThreshold {
+		path, err := spillContent(content)
+		return preparedContent{spillPath: path}, err
+	}
+	if *compressContent && len(content) > *compressThreshold {
+		compressed, err := compress(content)
+		return preparedContent{stored: StoredContent{Data: compressed, Compressed: true}}, err
+	}
+	return preparedContent{stored: StoredContent{Data: []byte(content)}}, nil
+}
+
+// discard removes the spill file of content that was not stored.
+func (content preparedContent) discard() {
+	if content.spillPath != "" {
+		discardSpill(content.spillPath)
+	}
+}
+
+// storeContent makes prepared content a subchannel's content.
+func (t *Tunnel) storeContent(subChannel string, content preparedContent, binary bool) {
+	t.removeSpill(subChannel)
+	t.contentWrites++
+	if binary {
+		t.Binary[subChannel] = true
+	} else {
+		delete(t.Binary, subChannel)
+	}
+
+	if content.spillPath != "" {
+		delete(t.SubChannels, subChannel)
+		t.Spilled[subChannel] = content.spillPath
+		retainSpill(content.spillPath)
+		return
+	}
+	t.SubChannels[subChannel] = content.stored
+}
+
+// setContent prepares and stores content at once. It is only for tunnels no
+// other goroutine can reach yet, such as those being restored, as it doesn't
+// need tunnelsMutex but compresses or writes while it would be held.
+func (t *Tunnel) setContent(subChannel string, content string, binary bool) error {
+	prepared, err := prepareContent(content)
+	if err != nil {
+		return err
+	}
+	t.storeContent(subChannel, prepared, binary)
+	return nil
+}
+
+// sentContent returns what a subchannel holds once msg is sent to it, and
+// that content prepared to be stored. Content that is slow to store is
+// prepared with tunnelsMutex released, which is held again on return; if
+// the tunnel's content was written to meanwhile, an appended message is
+// appended again.
+func (t *Tunnel) sentContent(msg StreamMessage) (string, preparedContent, error) {
+	for {
+		stored := msg.Content
+		if msg.Append {
+			var err error
+			if stored, err = t.appendedContent(msg); err != nil {
+				return "", preparedContent{}, err
+			}
+		}
+		if !slowToStore(len(stored)) {
+			return stored, preparedContent{stored: StoredContent{Data: []byte(stored)}}, nil
+		}
+		writes := t.contentWrites
+		tunnelsMutex.Unlock()
+		prepared, err := prepareContent(stored)
+		tunnelsMutex.Lock()
+		if err != nil {
+			return "", preparedContent{}, err
+		}
+		if !msg.Append || t.contentWrites == writes {
+			return stored, prepared, nil
+		}
+		prepared.discard()
+	}
+}
+
+// contentRef points at a subchannel's content, so it can be read once
+// tunnelsMutex is released: reading spilled content waits on the disk, and
+// decompressing on the CPU, neither of which should hold up other tunnels.
+type contentRef struct {
+	stored    StoredContent
+	spillPath string
+}
+
+// contentRef returns where a subchannel's content is. A spill file is
+// retained until the ref is read, which must happen exactly once.
+func (t *Tunnel) contentRef(subChannel string) contentRef {
+	if path, spilled := t.Spilled[subChannel]; spilled {
+		retainSpill(path)
+		return contentRef{spillPath: path}
+	}
+	return contentRef{stored: t.SubChannels[subChannel]}
+}
+
+// empty reports whether there is no content, without reading it.
+func (ref contentRef) empty() bool {
+	return ref.spillPath == "" && len(ref.stored.Data) == 0
+}
+
+// read returns the content, releasing the spill file it was read from. It
+// must be called without tunnelsMutex held.
+func (ref contentRef) read() (string, error) {
+	if ref.spillPath != "" {
+		content, err := readSpill(ref.spillPath)
+		releaseSpill(ref.spillPath)
+		return content, err
+	}
+	if ref.stored.Compressed {
+		return decompress(ref.stored.Data)
+	}
+	return string(ref.stored.Data), nil
+}
+
+// size returns the length in bytes of the content, without reading spilled
+// content back from disk. Like read, it releases the spill file and must be
+// called without tunnelsMutex held, and a ref is either read or sized.
+func (ref contentRef) size() (int, error) {
+	if ref.spillPath != "" {
+		size, err := spillSize(ref.spillPath)
+		releaseSpill(ref.spillPath)
+		return size, err
+	}
+	if ref.stored.Compressed {
+		content, err := decompress(ref.stored.Data)
+		return len(content), err
+	}
+	return len(ref.stored.Data), nil
+}
+
+// appendedContent returns what a subchannel holds once msg is appended to
+// it. Spilled or compressed content is read with tunnelsMutex released,
+// which is held again on return; if the tunnel's content was written to
+// meanwhile, it is read again.
+func (t *Tunnel) appendedContent(msg StreamMessage) (string, error) {
+	for {
+		ref := t.contentRef(msg.SubChannel)
+		if ref.spillPath == "" && !ref.stored.Compressed {
+			previous, _ := ref.read()
+			return appendContent(previous, msg.Separator, msg.Content), nil
+		}
+		writes := t.contentWrites
+		tunnelsMutex.Unlock()
+		previous, err := ref.read()
+		tunnelsMutex.Lock()
+		if err != nil {
+			return "", err
+		}
+		if t.contentWrites == writes {
+			return appendContent(previous, msg.Separator, msg.Content), nil
+		}
+	}
+}
+
+// retrievedContent is a subchannel's content as returned by the get
+// endpoint. The content itself is read from ref once tunnelsMutex is
+// released.
+type retrievedContent struct {
+	ref         contentRef
+	binary      bool
+	contentType string
+	sequence    uint64
+}
+
+// takeContent reads a subchannel's content, falling back to DefaultContent
+// for subchannels that were never written to, and clears it if consume is
+// set. Queue tunnels return their oldest pending message instead, which is
+// always consumed. Reading and clearing under the same lock guarantees that
+// concurrent consumers each see a given value at most once.
+func (t *Tunnel) takeContent(subChannel string, consume bool) retrievedContent {
+	sequence := t.Sequences[subChannel]
+	if t.Queue {
+		msg, _ := t.dequeue(subChannel, time.Now())
+		return retrievedContent{ref: contentRef{stored: StoredContent{Data: []byte(msg.Content)}}, binary: msg.Binary, contentType: msg.ContentType, sequence: sequence}
+	}
+	ref := t.contentRef(subChannel)
+	if ref.empty() && sequence == 0 {
+		ref = contentRef{stored: StoredContent{Data: []byte(t.DefaultContent)}}
+	}
+	retrieved := retrievedContent{ref: ref, binary: t.isBinary(subChannel), contentType: t.ContentTypes[subChannel], sequence: sequence}
+	if consume {
+		t.clearContent(subChannel)
+	}
+	return retrieved
+}
+
+// appendContent adds content to previous, after separator unless previous is
+// empty. The result is cut from the front to -append-max-size bytes, on a
+// character boundary.
+func appendContent(previous string, separator string, content string) string {
+	combined := content
+	if previous != "" {
+		combined = previous + separator + content
+	}
+	if *appendMaxSize <= 0 || len(combined) <= *appendMaxSize {
+		return combined
+	}
+	cut := len(combined) - *appendMaxSize
+	for cut < len(combined) && !utf8.RuneStart(combined[cut]) {
+		cut++
+	}
+	return combined[cut:]
+}
+
+// isBinary reports whether a subchannel holds binary content, which is
+// base64-encoded wherever it is returned as text.
+func (t *Tunnel) isBinary(subChannel string) bool {
+	return t.Binary[subChannel]
+}
+
+// setContentType records the media type a subchannel's content was sent
+// with. An empty type forgets the previous one, as it described the content
+// that was just replaced.
+func (t *Tunnel) setContentType(subChannel string, contentType string) {
+	if contentType == "" {
+		delete(t.ContentTypes, subChannel)
+		return
+	}
+	t.ContentTypes[subChannel] = contentType
+}
+
+// contentRefs returns a contentRef for every subchannel, see readContents.
+func (t *Tunnel) contentRefs() map[string]contentRef {
+	refs := make(map[string]contentRef, len(t.SubChannels)+len(t.Spilled))
+	for subChannel := range t.SubChannels {
+		refs[subChannel] = t.contentRef(subChannel)
+	}
+	for subChannel := range t.Spilled {
+		refs[subChannel] = t.contentRef(subChannel)
+	}
+	return refs
+}
+
+// readContents reads the content of every subchannel from refs returned by
+// contentRefs. All of them are read, even after an error, so none of their
+// spill files is left retained.
+func readContents(refs map[string]contentRef) (map[string]string, error) {
+	contents := make(map[string]string, len(refs))
+	var firstErr error
+	for subChannel, ref := range refs {
+		content, err := ref.read()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		contents[subChannel] = content
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return contents, nil
+}
+
+func (t *Tunnel) clearContent(subChannel string) {
+	t.removeSpill(subChannel)
+	t.contentWrites++
+	delete(t.SubChannels, subChannel)
+	delete(t.Binary, subChannel)
+	delete(t.ContentTypes, subChannel)
+	delete(t.Queues, subChannel)
+}
+
+// clearAll drops every subchannel, removing any spilled files. It is called
+// whenever a tunnel goes away.
+func (t *Tunnel) clearAll() {
+	for subChannel := range t.Spilled {
+		t.removeSpill(subChannel)
+	}
+	t.contentWrites++
+	t.SubChannels = make(map[string]StoredContent)
+	t.Binary = make(map[string]bool)
+	t.ContentTypes = make(map[string]string)
+	for subChannel := range t.History {
+		t.clearHistory(subChannel)
+	}
+	t.HistoryBytes = 0
+	t.Queues = make(map[string][]StreamMessage)
+}
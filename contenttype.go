@@ -0,0 +1,44 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+)
+
+// parseContentType validates the optional `contentType` content is sent
+// with, such as `application/json` or `text/html; charset=utf-8`, and
+// returns it normalized. The content itself is not checked against it: the
+// type only tells consumers how the producer meant the content to be read.
+func parseContentType(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	mediaType, mediaParams, err := mime.ParseMediaType(value)
+	if err != nil {
+		return "", err
+	}
+	return mime.FormatMediaType(mediaType, mediaParams), nil
+}
+
+// rawContentType is the Content-Type of content returned as is by the get
+// endpoint: the type it was sent with, or a generic one.
+func rawContentType(contentType string, binary bool) string {
+	switch {
+	case contentType != "":
+		return contentType
+	case binary:
+		return octetStream
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// writeRaw writes content as the whole response body, typed with the
+// stored content type. Anyone who can send to a tunnel picks that type, so
+// the response is sandboxed to keep HTML content from running scripts on
+// this server's origin.
+func writeRaw(w http.ResponseWriter, content string, contentType string, binary bool) {
+	w.Header().Set("Content-Type", rawContentType(contentType, binary))
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Write([]byte(content))
+}
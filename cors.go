@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var corsOriginList = flag.String("cors-origins", envOr("CORS_ORIGINS", ""), "Comma separated origins browsers may call the API from, instead of any (env CORS_ORIGINS)")
+var corsMaxAge = flag.Duration("cors-max-age", envDuration("CORS_MAX_AGE", 10*time.Minute), "How long browsers may cache preflight responses, 0 leaves it to the browser (env CORS_MAX_AGE)")
+
+// corsOrigins is the parsed -cors-origins. Any origin is allowed when it is
+// empty.
+var corsOrigins []string
+
+// serverAllowedOrigin returns the Access-Control-Allow-Origin for a request
+// under -cors-origins: `*` without a list, otherwise the request's origin if
+// it is listed.
+func serverAllowedOrigin(r *http.Request) string {
+	if len(corsOrigins) == 0 {
+		return "*"
+	}
+	origin := r.Header.Get("Origin")
+	if originAllowed(corsOrigins, origin) {
+		return origin
+	}
+	return ""
+}
+
+func withCORS(handler http.HandlerFunc) http.HandlerFunc {
+	return withAllowedOrigin(handler, serverAllowedOrigin)
+}
+
+// withTunnelCORS is withCORS for the endpoints acting on a single tunnel,
+// see tunnelAllowedOrigin.
+func withTunnelCORS(handler http.HandlerFunc) http.HandlerFunc {
+	return withAllowedOrigin(handler, tunnelAllowedOrigin)
+}
+
+// tunnelAllowedOrigin is serverAllowedOrigin for requests acting on a single
+// tunnel. If the tunnel was created with allowedOrigins, only those origins
+// are allowed, and of those only the ones -cors-origins allows.
+func tunnelAllowedOrigin(r *http.Request) string {
+	tunnelId := requestTunnelID(r)
+	if tunnelId == "" {
+		return serverAllowedOrigin(r)
+	}
+
+	tunnelsMutex.Lock()
+	tunnel, exists := liveTunnel(tunnelId)
+	var allowedOrigins []string
+	if exists {
+		allowedOrigins = tunnel.AllowedOrigins
+	}
+	tunnelsMutex.Unlock()
+
+	if len(allowedOrigins) == 0 {
+		return serverAllowedOrigin(r)
+	}
+	origin := r.Header.Get("Origin")
+	if originAllowed(allowedOrigins, origin) && serverAllowedOrigin(r) != "" {
+		return origin
+	}
+	return ""
+}
+
+// withAllowedOrigin sets the CORS headers and answers preflight requests.
+// allowedOrigin returns the value of Access-Control-Allow-Origin for the
+// request, or an empty string to leave it out so browsers block the response.
+// Any other value depends on the request's Origin, hence `Vary: Origin`.
+// Credentials are only allowed for origins the operator listed in
+// -cors-origins, never for `*` or origins only a tunnel allows. Preflight
+// responses may be cached for -cors-max-age, which spares browsers a
+// preflight before each request.
+func withAllowedOrigin(handler http.HandlerFunc, allowedOrigin func(r *http.Request) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := allowedOrigin(r)
+		if origin != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
+		if origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if origin != "*" && originAllowed(corsOrigins, origin) {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Subchannel, X-Request-ID")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
+		if r.Method == "OPTIONS" {
+			if seconds := int(corsMaxAge.Seconds()); seconds > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(seconds))
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// originAllowed reports whether origin is in the list. Origins are compared
+// case-insensitively, as scheme and host are.
+func originAllowed(allowedOrigins []string, origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, allowed := range allowedOrigins {
+		if strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOriginList accepts either a JSON array of origins, as sent in a request
+// body, or a comma separated list, as sent in a query string.
+func parseOriginList(value string) ([]string, error) {
+	var origins []string
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		if err := json.Unmarshal([]byte(value), &origins); err != nil {
+			return nil, err
+		}
+	} else {
+		origins = strings.Split(value, ",")
+	}
+
+	allowedOrigins := make([]string, 0, len(origins))
+	for _, origin := range origins {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			allowedOrigins = append(allowedOrigins, origin)
+		}
+	}
+	return allowedOrigins, nil
+}
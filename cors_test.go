@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	allowed := []string{"https://app.example", "http://localhost:3000"}
+	tests := map[string]bool{
+		"https://app.example":      true,
+		"HTTPS://APP.EXAMPLE":      true,
+		"http://localhost:3000":    true,
+		"http://app.example":       false,
+		"https://app.example:8443": false,
+		"https://evil.app.example": false,
+		"https://app.example.evil": false,
+		"http://localhost:3001":    false,
+		"":                         false,
+		"null":                     false,
+	}
+	for origin, want := range tests {
+		if got := originAllowed(allowed, origin); got != want {
+			t.Errorf("originAllowed(%q) = %t, want %t", origin, got, want)
+		}
+	}
+}
+
+func TestParseOriginList(t *testing.T) {
+	tests := map[string][]string{
+		"":                  {},
+		"https://a.example": {"https://a.example"},
+		" https://a.example/ , https://b.example,":    {"https://a.example", "https://b.example"},
+		`["https://a.example", "https://b.example/"]`: {"https://a.example", "https://b.example"},
+	}
+	for value, want := range tests {
+		origins, err := parseOriginList(value)
+		if err != nil || !slices.Equal(origins, want) {
+			t.Errorf("parseOriginList(%q) = %q, %v, want %q", value, origins, err, want)
+		}
+	}
+	if _, err := parseOriginList(`["https://a.example"`); err == nil {
+		t.Error("parseOriginList accepted a malformed JSON array")
+	}
+}
+
+// corsHeaders calls a tunnel endpoint from an origin and returns the CORS
+// headers of the response.
+func corsHeaders(method string, target string, origin string) http.Header {
+	r := httptest.NewRequest(method, target, nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	w := httptest.NewRecorder()
+	withTunnelCORS(getTunnelContent)(w, r)
+	return w.Header()
+}
+
+func TestTunnelAllowedOriginsOverrideTheServerDefault(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, &corsOrigins, nil)
+	addTestTunnel("open")
+	addTestTunnel("locked").AllowedOrigins = []string{"https://owner.example"}
+
+	tests := []struct {
+		target      string
+		origin      string
+		allowOrigin string
+	}{
+		{"/api/v3/tunnel/get?id=open", "https://any.example", "*"},
+		{"/api/v3/tunnel/get?id=missing", "https://any.example", "*"},
+		{"/api/v3/tunnel/get?id=locked", "https://owner.example", "https://owner.example"},
+		{"/api/v3/tunnel/get?id=locked", "HTTPS://OWNER.EXAMPLE", "HTTPS://OWNER.EXAMPLE"},
+		{"/api/v3/tunnel/get?id=locked", "https://any.example", ""},
+		{"/api/v3/tunnel/get?id=locked", "", ""},
+	}
+	for _, test := range tests {
+		for _, method := range []string{http.MethodGet, http.MethodOptions} {
+			header := corsHeaders(method, test.target, test.origin)
+			if got := header.Get("Access-Control-Allow-Origin"); got != test.allowOrigin {
+				t.Errorf("%s %s from %q allowed %q, want %q", method, test.target, test.origin, got, test.allowOrigin)
+			}
+			if header.Get("Access-Control-Allow-Credentials") != "" {
+				t.Errorf("%s %s from %q allowed credentials without -cors-origins", method, test.target, test.origin)
+			}
+			if varies := slices.Contains(header.Values("Vary"), "Origin"); varies != (test.allowOrigin != "*") {
+				t.Errorf("%s %s from %q has Vary %q", method, test.target, test.origin, header.Values("Vary"))
+			}
+		}
+	}
+}
+
+func TestTunnelAllowedOriginsMustAlsoBeAllowedByTheServer(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, &corsOrigins, []string{"https://owner.example", "https://other.example"})
+	addTestTunnel("open")
+	addTestTunnel("locked").AllowedOrigins = []string{"https://owner.example", "https://tunnel-only.example"}
+
+	tests := []struct {
+		target      string
+		origin      string
+		allowOrigin string
+		credentials bool
+	}{
+		{"/api/v3/tunnel/get?id=open", "https://other.example", "https://other.example", true},
+		{"/api/v3/tunnel/get?id=open", "https://any.example", "", false},
+		{"/api/v3/tunnel/get?id=locked", "https://owner.example", "https://owner.example", true},
+		{"/api/v3/tunnel/get?id=locked", "https://other.example", "", false},
+		{"/api/v3/tunnel/get?id=locked", "https://tunnel-only.example", "", false},
+	}
+	for _, test := range tests {
+		header := corsHeaders(http.MethodGet, test.target, test.origin)
+		if got := header.Get("Access-Control-Allow-Origin"); got != test.allowOrigin {
+			t.Errorf("%s from %q allowed %q, want %q", test.target, test.origin, got, test.allowOrigin)
+		}
+		if credentials := header.Get("Access-Control-Allow-Credentials") == "true"; credentials != test.credentials {
+			t.Errorf("%s from %q allowed credentials %t, want %t", test.target, test.origin, credentials, test.credentials)
+		}
+	}
+}
+
+func TestCreateTunnelStoresAllowedOrigins(t *testing.T) {
+	resetTunnels(t)
+
+	w := httptest.NewRecorder()
+	body := `{"id": "locked", "allowedOrigins": ["https://owner.example/", "https://second.example"]}`
+	createTunnel(w, httptest.NewRequest(http.MethodPost, "/api/v3/tunnel/create", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("create answered %d: %s", w.Code, w.Body)
+	}
+	want := []string{"https://owner.example", "https://second.example"}
+	if got := tunnels["locked"].AllowedOrigins; !slices.Equal(got, want) {
+		t.Errorf("allowed origins = %q, want %q", got, want)
+	}
+}
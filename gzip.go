@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var gzipEnabled = flag.Bool("gzip", true, "Compress get responses, the home page and the license with gzip for clients that accept it")
+
+// gzipMinSize is the smallest response worth compressing. Below it the gzip
+// header and footer eat most of the savings.
+const gzipMinSize = 1024
+
+// withGzip compresses the response with gzip when the client accepts it and
+// the response is at least gzipMinSize bytes. Streams are never wrapped, as
+// compression would hold back events until enough of them pile up.
+func withGzip(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !*gzipEnabled {
+			handler(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			handler(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(gw, r)
+		gw.close()
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			quality := 1.0
+			if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+				quality, _ = strconv.ParseFloat(value, 64)
+			}
+			return quality > 0
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter holds back the start of the response until it knows
+// whether the response is large enough to compress.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	buffer      bytes.Buffer
+	// decided is set once the response is either being compressed, with
+	// gzipWriter, or passed through as is.
+	decided    bool
+	gzipWriter *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	w.wroteHeader = true
+	if !w.decided {
+		w.buffer.Write(data)
+		if w.buffer.Len() < gzipMinSize {
+			return len(data), nil
+		}
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	if w.gzipWriter != nil {
+		return w.gzipWriter.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// start sends the headers and the buffered start of the response, compressed
+// if large is set and nothing rules compression out.
+func (w *gzipResponseWriter) start(large bool) error {
+	w.decided = true
+	header := w.Header()
+	compress := large && w.status == http.StatusOK && header.Get("Content-Encoding") == "" && header.Get("Content-Range") == ""
+	if compress {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		w.gzipWriter = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buffered := w.buffer.Bytes()
+	w.buffer = bytes.Buffer{}
+	if len(buffered) == 0 {
+		return nil
+	}
+	if w.gzipWriter != nil {
+		_, err := w.gzipWriter.Write(buffered)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buffered)
+	return err
+}
+
+// close sends whatever is still held back and finishes the gzip stream.
+func (w *gzipResponseWriter) close() {
+	if !w.decided {
+		if !w.wroteHeader {
+			return
+		}
+		if err := w.start(false); err != nil {
+			slog.Debug("Failed to write response", "error", err)
+		}
+		return
+	}
+	if w.gzipWriter != nil {
+		if err := w.gzipWriter.Close(); err != nil {
+			slog.Debug("Failed to finish gzip response", "error", err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+var startTime = time.Now()
+
+// healthCheck answers liveness and readiness probes. It is not rate limited,
+// so probes are never throttled.
+func healthCheck(w http.ResponseWriter, r *http.Request) {
+	tunnelsMutex.Lock()
+	tunnelCount := len(tunnels)
+	tunnelsMutex.Unlock()
+
+	writeJSON(w, r, map[string]interface{}{
+		"status":      "ok",
+		"tunnels":     tunnelCount,
+		"subscribers": countSubscribers(),
+		"uptime":      time.Since(startTime).Round(time.Second).String(),
+	})
+}
+
+// readyCheck is healthCheck for readiness probes, failing with 503 once the
+// server is shutting down so no new clients are sent its way.
+func readyCheck(w http.ResponseWriter, r *http.Request) {
+	if isShuttingDown() {
+		writeJSONError(w, http.StatusServiceUnavailable, "The server is shutting down.")
+		return
+	}
+	healthCheck(w, r)
+}
+
+// versionInfo reports which build is running, for matching clients to the
+// deployed server.
+func versionInfo(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, buildInfo())
+}
+
+// buildInfo returns the version, commit and build date set with -ldflags.
+// Without a commit, it is taken from the VCS information Go embeds when
+// building from a checkout.
+func buildInfo() map[string]string {
+	info := map[string]string{
+		"version":   version,
+		"commit":    commit,
+		"buildDate": buildDate,
+		"goVersion": runtime.Version(),
+	}
+	if embedded, ok := debug.ReadBuildInfo(); ok && info["commit"] == "" {
+		for _, setting := range embedded.Settings {
+			if setting.Key == "vcs.revision" {
+				info["commit"] = setting.Value
+			}
+		}
+	}
+	return info
+}
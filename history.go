@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var historySize = flag.Int("history-size", 100, "Messages kept per subchannel for the history endpoint and for streams resuming with Last-Event-ID, unless a tunnel sets its own historySize (0 disables)")
+var maxHistorySize = flag.Int("max-history-size", 1000, "Largest historySize a tunnel, or a subchannel through historySizes, may be created with")
+var historyMaxBytes = flag.Int("history-max-bytes", 1<<20, "Bytes of content kept in the history of each tunnel, across its subchannels; the oldest messages go first (0 means unlimited)")
+
+// parseHistorySizes parses the historySizes a tunnel is created with: a JSON
+// object or a comma-separated list of subchannel:size pairs, such as
+// "chat:100,status:1". Each size is at most -max-history-size.
+func parseHistorySizes(value string) (map[string]int, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	sizes := make(map[string]int)
+	if strings.HasPrefix(strings.TrimSpace(value), "{") {
+		if err := json.Unmarshal([]byte(value), &sizes); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, pair := range strings.Split(value, ",") {
+			subChannel, size, found := strings.Cut(pair, ":")
+			if !found {
+				return nil, fmt.Errorf("%q is not a subchannel:size pair", pair)
+			}
+			messages, err := strconv.Atoi(strings.TrimSpace(size))
+			if err != nil {
+				return nil, err
+			}
+			sizes[strings.TrimSpace(subChannel)] = messages
+		}
+	}
+	for subChannel, size := range sizes {
+		if subChannel == "" || subChannel == wildcardSubChannel {
+			return nil, fmt.Errorf("invalid subchannel %q", subChannel)
+		}
+		if size < 0 || size > *maxHistorySize {
+			return nil, fmt.Errorf("size %d of subchannel %q is out of range", size, subChannel)
+		}
+	}
+	return sizes, nil
+}
+
+// historyLimit returns how many messages the history of a subchannel keeps.
+func (t *Tunnel) historyLimit(subChannel string) int {
+	if size, ok := t.HistorySizes[subChannel]; ok {
+		return size
+	}
+	return t.HistorySize
+}
+
+// recordHistory keeps a message for the history endpoint and for streams
+// that reconnect later, dropping the oldest once the subchannel's
+// historyLimit messages are kept, or once the tunnel's history outgrows
+// -history-max-bytes. A message whose content was just spilled to disk only
+// refers to the spill file, unless appended is set, in which case the file
+// holds more than the message. It must be called with tunnelsMutex held,
+// after the content is stored.
+func (t *Tunnel) recordHistory(msg StreamMessage, appended bool) {
+	limit := t.historyLimit(msg.SubChannel)
+	if limit <= 0 {
+		return
+	}
+	if path, spilled := t.Spilled[msg.SubChannel]; spilled && !appended {
+		retainSpill(path)
+		msg.Content = ""
+		msg.SpillPath = path
+	}
+	history := t.History[msg.SubChannel]
+	if len(history) >= limit {
+		dropped := len(history) - limit + 1
+		for _, old := range history[:dropped] {
+			t.forgetHistory(old)
+		}
+		// Shift within the same array so the buffer never grows.
+		copy(history, history[dropped:])
+		history = history[:limit-1]
+	}
+	t.History[msg.SubChannel] = append(history, msg)
+	t.HistoryBytes += len(msg.Content)
+
+	for *historyMaxBytes > 0 && t.HistoryBytes > *historyMaxBytes {
+		t.dropOldestHistory()
+	}
+}
+
+// dropOldestHistory drops the oldest kept message of the tunnel, whichever
+// subchannel it was sent to.
+func (t *Tunnel) dropOldestHistory() {
+	oldest := ""
+	for subChannel, history := range t.History {
+		if len(history) == 0 {
+			continue
+		}
+		if oldest == "" || history[0].SentAt.Before(t.History[oldest][0].SentAt) {
+			oldest = subChannel
+		}
+	}
+	if oldest == "" {
+		t.HistoryBytes = 0
+		return
+	}
+	history := t.History[oldest]
+	t.forgetHistory(history[0])
+	if len(history) == 1 {
+		delete(t.History, oldest)
+		return
+	}
+	t.History[oldest] = history[1:]
+}
+
+// forgetHistory accounts for a message dropped from the history.
+func (t *Tunnel) forgetHistory(msg StreamMessage) {
+	t.HistoryBytes -= len(msg.Content)
+	if msg.SpillPath != "" {
+		releaseSpill(msg.SpillPath)
+	}
+}
+
+// clearHistory forgets the kept messages of a subchannel.
+func (t *Tunnel) clearHistory(subChannel string) {
+	for _, msg := range t.History[subChannel] {
+		t.forgetHistory(msg)
+	}
+	delete(t.History, subChannel)
+}
+
+// historySince returns the kept messages of a subchannel with a sequence
+// after the given one. It must be called with tunnelsMutex held, and the
+// messages passed to loadHistory once it is released.
+func (t *Tunnel) historySince(subChannel string, sequence uint64) []StreamMessage {
+	var messages []StreamMessage
+	for _, msg := range t.History[subChannel] {
+		if msg.Sequence > sequence {
+			if msg.SpillPath != "" {
+				retainSpill(msg.SpillPath)
+			}
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// loadHistory reads the content of the spilled messages historySince
+// returned, and releases their spill files. Messages that can't be read are
+// left out. It must be called without tunnelsMutex held.
+func loadHistory(messages []StreamMessage) []StreamMessage {
+	loaded := messages[:0]
+	for _, msg := range messages {
+		if msg.SpillPath != "" {
+			ref := contentRef{spillPath: msg.SpillPath}
+			content, err := ref.read()
+			if err != nil {
+				slog.Error("Failed to read spilled history", "subchannel", msg.SubChannel, "sequence", msg.Sequence, "error", err)
+				continue
+			}
+			msg.Content = content
+			msg.SpillPath = ""
+		}
+		loaded = append(loaded, msg)
+	}
+	return loaded
+}
+
+// lastEventID parses the Last-Event-ID header EventSource sends when it
+// reconnects, or a `lastEventId` parameter for clients that can't set
+// headers. Event ids are sequence numbers, so anything else is ignored.
+func lastEventID(r *http.Request, params TunnelParams) (uint64, bool) {
+	value := firstNonEmpty(r.Header.Get("Last-Event-ID"), params.Get("lastEventId"))
+	if value == "" {
+		return 0, false
+	}
+	sequence, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return sequence, true
+}
+
+// tunnelHistory returns the last messages kept for a subchannel, oldest
+// first, so clients can catch up on messages they were not streaming for.
+func tunnelHistory(w http.ResponseWriter, r *http.Request) {
+	params, ok := parseTunnelParams(w, r)
+	if !ok {
+		return
+	}
+	tunnelId := params.ID
+	subChannel := params.SubChannel
+
+	if !params.checkID(w, r) {
+		return
+	}
+
+	if !params.checkSubChannel(w, r) {
+		return
+	}
+
+	if subChannel == wildcardSubChannel {
+		slog.WarnContext(r.Context(), "History is kept per subchannel", "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "History is kept per subchannel, name a 'subChannel' other than '*'")
+		return
+	}
+
+	limit := 0
+	if value := params.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			slog.WarnContext(r.Context(), "Invalid 'limit' value", "value", value, "status", http.StatusBadRequest)
+			writeJSONError(w, http.StatusBadRequest, "The 'limit' value must be a positive number of messages")
+			return
+		}
+	}
+
+	tunnelsMutex.Lock()
+	tunnel, exists := liveTunnel(tunnelId)
+	if !exists {
+		tunnelsMutex.Unlock()
+		slog.WarnContext(r.Context(), "No tunnel with this id exists", "tunnel_id", tunnelId, "status", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, "No tunnel with this id exists.")
+		return
+	}
+	if status := tunnel.secretStatus(r, params); status != http.StatusOK {
+		tunnelsMutex.Unlock()
+		rejectSecret(w, r, status, tunnelId)
+		return
+	}
+	var since uint64
+	if history := tunnel.History[subChannel]; limit > 0 && len(history) > limit {
+		since = history[len(history)-limit-1].Sequence
+	}
+	history := tunnel.historySince(subChannel, since)
+	tunnelsMutex.Unlock()
+
+	history = loadHistory(history)
+	messages := make([]map[string]interface{}, 0, len(history))
+	for _, msg := range history {
+		message := map[string]interface{}{"content": msg.Content, "sequence": msg.Sequence, "sentAt": msg.SentAt.UTC().Format(time.RFC3339Nano)}
+		if msg.Binary {
+			message["content"] = base64.StdEncoding.EncodeToString([]byte(msg.Content))
+			message["encoding"] = base64Encoding
+		}
+		if msg.ContentType != "" {
+			message["contentType"] = msg.ContentType
+		}
+		messages = append(messages, message)
+	}
+
+	writeJSON(w, r, messages)
+	slog.InfoContext(r.Context(), "Served history", "tunnel_id", tunnelId, "subchannel", subChannel)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseHistorySizes(t *testing.T) {
+	setFlag(t, maxHistorySize, 10)
+
+	valid := map[string]map[string]int{
+		"":                          nil,
+		"chat:10,status:1":          {"chat": 10, "status": 1},
+		" chat : 3 , off:0 ":        {"chat": 3, "off": 0},
+		`{"chat": 10, "status": 1}`: {"chat": 10, "status": 1},
+	}
+	for value, want := range valid {
+		sizes, err := parseHistorySizes(value)
+		if err != nil {
+			t.Errorf("parseHistorySizes(%q): %v", value, err)
+			continue
+		}
+		if len(sizes) != len(want) {
+			t.Errorf("parseHistorySizes(%q) = %v, want %v", value, sizes, want)
+			continue
+		}
+		for subChannel, size := range want {
+			if got, ok := sizes[subChannel]; !ok || got != size {
+				t.Errorf("parseHistorySizes(%q) = %v, want %v", value, sizes, want)
+			}
+		}
+	}
+
+	for _, value := range []string{"chat", "chat:many", "chat:-1", "chat:11", "*:5", ":5", `{"chat": 1.5}`, `{"chat": "1"}`, `{"*": 1}`} {
+		if sizes, err := parseHistorySizes(value); err == nil {
+			t.Errorf("parseHistorySizes(%q) = %v, want an error", value, sizes)
+		}
+	}
+}
+
+// historyOf returns the content of the messages the history endpoint serves
+// for a subchannel.
+func historyOf(t *testing.T, id string, subChannel string) []string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	tunnelHistory(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/history?id="+id+"&subChannel="+subChannel, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("history of %s answered %d: %s", subChannel, w.Code, w.Body)
+	}
+	var messages []struct{ Content string }
+	if err := json.Unmarshal(w.Body.Bytes(), &messages); err != nil {
+		t.Fatal(err)
+	}
+	contents := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		contents = append(contents, msg.Content)
+	}
+	return contents
+}
+
+func TestHistorySizesOverrideTheTunnelHistorySize(t *testing.T) {
+	resetTunnels(t)
+
+	w := httptest.NewRecorder()
+	body := `{"id": "hist", "historySize": 2, "historySizes": {"chat": 3, "status": 1, "quiet": 0}}`
+	createTunnel(w, httptest.NewRequest(http.MethodPost, "/api/v3/tunnel/create", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("create answered %d: %s", w.Code, w.Body)
+	}
+
+	for _, subChannel := range []string{"chat", "status", "quiet", "other"} {
+		for _, content := range []string{"1", "2", "3", "4"} {
+			w := httptest.NewRecorder()
+			sendToTunnel(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/send?id=hist&subChannel="+subChannel+"&content="+content, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("send answered %d: %s", w.Code, w.Body)
+			}
+		}
+	}
+
+	want := map[string]string{"chat": "2,3,4", "status": "4", "quiet": "", "other": "3,4"}
+	for subChannel, contents := range want {
+		if got := strings.Join(historyOf(t, "hist", subChannel), ","); got != contents {
+			t.Errorf("history of %s = %q, want %q", subChannel, got, contents)
+		}
+	}
+}
+
+func TestCreateTunnelRejectsInvalidHistorySizes(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, maxHistorySize, 10)
+
+	for _, value := range []string{"chat:11", "chat:-1", "chat", "*:1"} {
+		w := httptest.NewRecorder()
+		createTunnel(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/create?id=hist&historySizes="+value, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("historySizes %q answered %d, want %d", value, w.Code, http.StatusBadRequest)
+		}
+	}
+	if len(tunnels) != 0 {
+		t.Errorf("tunnels = %v, want none created", tunnels)
+	}
+}
+
+func TestHistorySizesArePersisted(t *testing.T) {
+	resetTunnels(t)
+	tunnel := addTestTunnel("hist")
+	tunnel.HistorySizes = map[string]int{"status": 1}
+
+	tunnelsMutex.Lock()
+	saved := tunnel.persisted()
+	tunnelsMutex.Unlock()
+	if err := saved.readContent(); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded persistedTunnel
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := restoreTunnel(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.historyLimit("status") != 1 || restored.historyLimit("chat") != restored.HistorySize {
+		t.Errorf("restored HistorySizes = %v, want status limited to 1", restored.HistorySizes)
+	}
+}
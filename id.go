@@ -0,0 +1,25 @@
+package main
+
+import "flag"
+
+var maxIDLength = flag.Int("max-id-length", 64, "Longest tunnel id a client may choose")
+
+// validTunnelID reports whether a client-chosen tunnel id is safe to use:
+// at most -max-id-length characters, all of them letters, digits or one of
+// `-`, `_`, `.` and `~`. These need no escaping in URLs, and leave no way to
+// forge log lines or hide ids behind look-alike characters.
+func validTunnelID(id string) bool {
+	if id == "" || len(id) > *maxIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"time"
+)
+
+var autoDeleteGrace = flag.Duration("auto-delete-grace", 30*time.Second, "How long an autoDeleteWhenEmpty tunnel survives without subscribers")
+var defaultTTL = flag.Duration("default-ttl", 24*time.Hour, "How long tunnels created without a ttl live (0 keeps them forever)")
+var idleTimeout = flag.Duration("idle-timeout", 0, "Remove tunnels without subscribers that haven't been sent to, read or subscribed to for this long (0 keeps them)")
+var cleanupInterval = flag.Duration("cleanup-interval", time.Minute, "How often expired and idle tunnels are removed")
+
+// Reasons passed to removeTunnel, which subscribers receive in the final
+// `event: closed` of their stream.
+const (
+	closeReasonEmpty    = "empty"
+	closeReasonDeleted  = "deleted"
+	closeReasonExpired  = "expired"
+	closeReasonIdle     = "idle"
+	closeReasonReplaced = "replaced"
+)
+
+// liveTunnel looks up a tunnel that has not expired, see loadTunnel. Expired
+// tunnels are treated as gone even before expireTunnels removes them. It must
+// be called with tunnelsMutex held, which is released while a tunnel that is
+// not in the tunnels map is looked up in the backend.
+func liveTunnel(tunnelId string) (*Tunnel, bool) {
+	tunnel, exists := loadTunnel(tunnelId)
+	if !exists || (!tunnel.ExpiresAt.IsZero() && time.Now().After(tunnel.ExpiresAt)) {
+		return nil, false
+	}
+	return tunnel, true
+}
+
+// touch records activity on the tunnel, see LastActivity. It must be called
+// with tunnelsMutex held.
+func (t *Tunnel) touch() {
+	t.LastActivity = time.Now()
+}
+
+// expireTunnels periodically removes tunnels whose ttl has passed, and those
+// idle for longer than -idle-timeout. Every instance expires tunnels on its
+// own, and the backend expires its copy itself. Idle tunnels are removed
+// everywhere, but only activity this instance saw counts.
+func expireTunnels() {
+	for {
+		time.Sleep(*cleanupInterval)
+		now := time.Now()
+		var expired, idle []*Tunnel
+		tunnelsMutex.Lock()
+		for _, tunnel := range tunnels {
+			tunnel.pruneQueues(now)
+			if !tunnel.ExpiresAt.IsZero() && now.After(tunnel.ExpiresAt) {
+				expired = append(expired, tunnel)
+			} else if *idleTimeout > 0 && now.Sub(tunnel.LastActivity) > *idleTimeout {
+				idle = append(idle, tunnel)
+			}
+		}
+		tunnelsMutex.Unlock()
+
+		for _, tunnel := range expired {
+			dropTunnel(tunnel, closeReasonExpired)
+		}
+		// Open streams are activity too, however long they have been quiet.
+		for _, tunnel := range idle {
+			if tunnelSubscribers(tunnel.ID) == 0 && removeTunnel(tunnel, closeReasonIdle) {
+				slog.Info("Removed idle tunnel", "tunnel_id", tunnel.ID)
+			}
+		}
+	}
+}
+
+// removeTunnel deletes the tunnel, unless it has been replaced in the
+// meantime, and disconnects all of its subscribers by closing their
+// channels, telling them the reason. The other instances are told to do the
+// same.
+func removeTunnel(tunnel *Tunnel, reason string) bool {
+	if !dropTunnel(tunnel, reason) {
+		return false
+	}
+	if err := backend.DeleteTunnel(tunnel.ID); err != nil {
+		slog.Error("Failed to delete tunnel from the backend", "tunnel_id", tunnel.ID, "error", err)
+	}
+	publish(backendEvent{Type: eventTunnelRemoved, TunnelID: tunnel.ID, Reason: reason})
+	return true
+}
+
+// dropTunnel is removeTunnel for this instance only. Every path that removes
+// a tunnel goes through here.
+func dropTunnel(tunnel *Tunnel, reason string) bool {
+	tunnelsMutex.Lock()
+	if tunnels[tunnel.ID] != tunnel {
+		tunnelsMutex.Unlock()
+		return false
+	}
+	delete(tunnels, tunnel.ID)
+	tunnel.clearAll()
+	tunnelsMutex.Unlock()
+
+	var subscribers []*Subscriber
+	clientsMutex.Lock()
+	for _, subChannelClients := range clients[tunnel.ID] {
+		subscribers = append(subscribers, subChannelClients...)
+	}
+	delete(clients, tunnel.ID)
+	clientsMutex.Unlock()
+
+	for _, subscriber := range subscribers {
+		subscriber.close(reason)
+	}
+
+	slog.Info("Removed tunnel", "tunnel_id", tunnel.ID, "reason", reason)
+	return true
+}
+
+// removeSubChannel drops one subchannel of a tunnel, so it reads as if it was
+// never written to, and disconnects the streams subscribed to it. Streams
+// subscribed to all subchannels stay connected. The other instances are told
+// to do the same.
+func removeSubChannel(tunnel *Tunnel, subChannel string, reason string) {
+	dropSubChannel(tunnel, subChannel, reason)
+	if err := backend.DeleteSubChannel(tunnel.ID, subChannel); err != nil {
+		slog.Error("Failed to delete subChannel from the backend", "subchannel", subChannel, "tunnel_id", tunnel.ID, "error", err)
+	}
+	publish(backendEvent{Type: eventSubChannelRemoved, TunnelID: tunnel.ID, SubChannel: subChannel, Reason: reason})
+}
+
+// dropSubChannel is removeSubChannel for this instance only.
+func dropSubChannel(tunnel *Tunnel, subChannel string, reason string) {
+	tunnelsMutex.Lock()
+	tunnel.clearContent(subChannel)
+	delete(tunnel.Sequences, subChannel)
+	tunnel.clearHistory(subChannel)
+	tunnelsMutex.Unlock()
+
+	clientsMutex.Lock()
+	subscribers := clients[tunnel.ID][subChannel]
+	delete(clients[tunnel.ID], subChannel)
+	clientsMutex.Unlock()
+
+	for _, subscriber := range subscribers {
+		subscriber.close(reason)
+	}
+
+	slog.Info("Removed subChannel", "subchannel", subChannel, "tunnel_id", tunnel.ID, "reason", reason)
+
+	if tunnelSubscribers(tunnel.ID) == 0 {
+		scheduleAutoDelete(tunnel.ID)
+	}
+}
+
+// tunnelSubscribers counts the subscribers of a tunnel across all of its
+// subchannels.
+func tunnelSubscribers(tunnelId string) int {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	subscribers := 0
+	for _, subChannelClients := range clients[tunnelId] {
+		subscribers += len(subChannelClients)
+	}
+	return subscribers
+}
+
+// scheduleAutoDelete removes an autoDeleteWhenEmpty tunnel once it has had no
+// subscribers for the grace period, which leaves room for reconnects. Each
+// time the tunnel loses its last subscriber the grace period starts over.
+func scheduleAutoDelete(tunnelId string) {
+	tunnelsMutex.Lock()
+	defer tunnelsMutex.Unlock()
+	tunnel, exists := tunnels[tunnelId]
+	if !exists || !tunnel.AutoDeleteWhenEmpty {
+		return
+	}
+
+	if tunnel.autoDeleteTimer != nil {
+		tunnel.autoDeleteTimer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(*autoDeleteGrace, func() {
+		tunnelsMutex.Lock()
+		current := tunnel.autoDeleteTimer == timer
+		if current {
+			tunnel.autoDeleteTimer = nil
+		}
+		tunnelsMutex.Unlock()
+		// A timer that was replaced or stopped too late has nothing to do.
+		if !current || tunnelSubscribers(tunnelId) > 0 {
+			return
+		}
+		if removeTunnel(tunnel, closeReasonEmpty) {
+			slog.Info("Auto-deleted empty tunnel", "tunnel_id", tunnelId)
+		}
+	})
+	tunnel.autoDeleteTimer = timer
+}
+
+// cancelAutoDelete stops the pending removal of a tunnel that got a
+// subscriber again.
+func cancelAutoDelete(tunnelId string) {
+	tunnelsMutex.Lock()
+	defer tunnelsMutex.Unlock()
+	if tunnel, exists := tunnels[tunnelId]; exists && tunnel.autoDeleteTimer != nil {
+		tunnel.autoDeleteTimer.Stop()
+		tunnel.autoDeleteTimer = nil
+	}
+}
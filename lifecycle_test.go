@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitForRemoval waits up to a second for the tunnel to be removed.
+func waitForRemoval(t *testing.T, tunnel *Tunnel) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for hasTunnel(tunnel) {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel was not removed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAutoDeleteWhenEmptyRemovesTunnelAfterGrace(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, autoDeleteGrace, 20*time.Millisecond)
+	tunnel := addTestTunnel("ephemeral")
+	tunnel.AutoDeleteWhenEmpty = true
+	kept := addTestTunnel("kept")
+
+	for _, tunnel := range []*Tunnel{tunnel, kept} {
+		subscriber := newSubscriber()
+		if err := addSubscriber(tunnel.ID, "main", subscriber); err != nil {
+			t.Fatal(err)
+		}
+		removeSubscriber(tunnel.ID, "main", subscriber)
+	}
+
+	waitForRemoval(t, tunnel)
+	if !hasTunnel(kept) {
+		t.Error("tunnel without autoDeleteWhenEmpty was removed")
+	}
+}
+
+func TestAutoDeleteWhenEmptyIsCancelledByReconnect(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, autoDeleteGrace, 20*time.Millisecond)
+	tunnel := addTestTunnel("ephemeral")
+	tunnel.AutoDeleteWhenEmpty = true
+
+	first := newSubscriber()
+	addSubscriber(tunnel.ID, "main", first)
+	removeSubscriber(tunnel.ID, "main", first)
+	addSubscriber(tunnel.ID, "main", newSubscriber())
+
+	time.Sleep(60 * time.Millisecond)
+	if !hasTunnel(tunnel) {
+		t.Fatal("tunnel with a subscriber was removed")
+	}
+}
+
+func TestAutoDeleteWhenEmptyRestartsGraceOnEachDisconnect(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, autoDeleteGrace, 200*time.Millisecond)
+	tunnel := addTestTunnel("ephemeral")
+	tunnel.AutoDeleteWhenEmpty = true
+
+	first := newSubscriber()
+	addSubscriber(tunnel.ID, "main", first)
+	removeSubscriber(tunnel.ID, "main", first)
+
+	time.Sleep(100 * time.Millisecond)
+	second := newSubscriber()
+	addSubscriber(tunnel.ID, "main", second)
+	removeSubscriber(tunnel.ID, "main", second)
+
+	// The grace period of the first disconnect is over by now, the one of
+	// the second isn't.
+	time.Sleep(150 * time.Millisecond)
+	if !hasTunnel(tunnel) {
+		t.Fatal("tunnel was removed within the grace period of its last disconnect")
+	}
+	waitForRemoval(t, tunnel)
+}
+
+func TestAutoDeleteWhenEmptyRemovesTunnelThatNeverGetsASubscriber(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, autoDeleteGrace, 20*time.Millisecond)
+
+	for _, id := range []string{"ephemeral", "kept"} {
+		target := "/api/v3/tunnel/create?id=" + id
+		if id == "ephemeral" {
+			target += "&autoDeleteWhenEmpty=true"
+		}
+		w := httptest.NewRecorder()
+		createTunnel(w, httptest.NewRequest(http.MethodPost, target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("creating %s answered %d: %s", id, w.Code, w.Body)
+		}
+	}
+	tunnelsMutex.Lock()
+	tunnel, kept := tunnels["ephemeral"], tunnels["kept"]
+	tunnelsMutex.Unlock()
+
+	waitForRemoval(t, tunnel)
+	if !hasTunnel(kept) {
+		t.Error("tunnel without autoDeleteWhenEmpty was removed")
+	}
+}
+
+func TestAutoDeleteWhenEmptyKeepsTunnelSubscribedWithinGrace(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, autoDeleteGrace, 50*time.Millisecond)
+
+	w := httptest.NewRecorder()
+	createTunnel(w, httptest.NewRequest(http.MethodPost, "/api/v3/tunnel/create?id=ephemeral&autoDeleteWhenEmpty=true", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("create answered %d: %s", w.Code, w.Body)
+	}
+	tunnelsMutex.Lock()
+	tunnel := tunnels["ephemeral"]
+	tunnelsMutex.Unlock()
+	addSubscriber(tunnel.ID, "main", newSubscriber())
+
+	time.Sleep(100 * time.Millisecond)
+	if !hasTunnel(tunnel) {
+		t.Fatal("tunnel that got a subscriber within the grace period was removed")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var logLevel = flag.String("log-level", envOr("LOG_LEVEL", "info"), "Minimum level of log records: debug, info, warn or error (env LOG_LEVEL)")
+var logFormat = flag.String("log-format", envOr("LOG_FORMAT", "text"), "Format of log records: text or json (env LOG_FORMAT)")
+
+// setupLogging makes the default logger write records of at least
+// -log-level, in the -log-format format, to stderr.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("invalid -log-level %q, expected debug, info, warn or error", *logLevel)
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(*logFormat) {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("invalid -log-format %q, expected text or json", *logFormat)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	return nil
+}
+
+// fatal logs an error and exits, for failures that leave the server unable
+// to start.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type logAttrsKey struct{}
+
+// maxRequestIDLength bounds the X-Request-ID values taken from clients.
+const maxRequestIDLength = 128
+
+// withLogContext attaches a request ID and the client's IP to the request
+// context, so every record logged with it can be traced back to the request
+// and its client. The ID is taken from the X-Request-ID header when the
+// client or a proxy sent one, and is returned in the same header.
+func withLogContext(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+		attrs := []slog.Attr{slog.String("request_id", requestID), slog.String("remote_ip", clientIP(r))}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), logAttrsKey{}, attrs)))
+	})
+}
+
+// validRequestID accepts non-empty IDs of printable ASCII characters, so a
+// client can't break up or bloat log lines with the ID it sends.
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(requestID); i++ {
+		if requestID[i] < 0x21 || requestID[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		slog.Error("Failed to generate a request ID", "error", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// contextHandler adds the attributes withLogContext attached to the context
+// to each record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		record.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
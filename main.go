@@ -1,413 +1,1566 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
-	"math/rand"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 type Tunnel struct {
 	ID          string
 	Content     string
-	SubChannels map[string]string
+	SubChannels map[string]StoredContent
+	// Spilled maps subchannels whose content was spilled to disk to the file
+	// holding it. See storeContent.
+	Spilled map[string]string
+	// contentWrites counts the changes to the tunnel's content, so content
+	// computed before tunnelsMutex was released can be checked against it.
+	// See sentContent.
+	contentWrites uint64
+	// Binary marks subchannels holding binary content. See storeContent.
+	Binary map[string]bool
+	// ContentTypes holds the media type each subchannel's content was sent
+	// with, for subchannels whose producer declared one.
+	ContentTypes map[string]string
+	// Sequences counts the messages sent to each subchannel, so subscribers
+	// can detect gaps in what they received.
+	Sequences map[string]uint64
+	// History keeps the latest messages of each subchannel, for the history
+	// endpoint and so streams that reconnect with Last-Event-ID can catch up.
+	// See recordHistory.
+	History map[string][]StreamMessage
+	// HistorySize is how many messages History keeps per subchannel.
+	HistorySize int
+	// HistorySizes overrides HistorySize for some subchannels.
+	HistorySizes map[string]int
+	// HistoryBytes is the size of the content kept in History.
+	HistoryBytes int
+	// RotateAfter recycles each stream subscriber after this long by asking it
+	// to reconnect. Zero keeps subscribers connected indefinitely.
+	RotateAfter time.Duration
+	// DefaultContent is returned for subchannels that were never written to.
+	DefaultContent string
+	// AutoDeleteWhenEmpty removes the tunnel shortly after its last stream
+	// subscriber disconnects.
+	AutoDeleteWhenEmpty bool
+	// autoDeleteTimer is the pending removal of an AutoDeleteWhenEmpty
+	// tunnel without subscribers. See scheduleAutoDelete.
+	autoDeleteTimer *time.Timer
+	// AllowedOrigins restricts which origins browsers let read this tunnel's
+	// get, stream and send responses. Empty allows any origin.
+	AllowedOrigins []string
+	// Throughput tracks the recent rate of messages sent to the tunnel.
+	Throughput throughput
+	// CreatedAt, MessagesSent, BytesSent and LastMessageAt are reported by
+	// the stats endpoint. See recordMessage.
+	CreatedAt     time.Time
+	MessagesSent  uint64
+	BytesSent     uint64
+	LastMessageAt time.Time
+	// LastActivity is when the tunnel was last sent to, read or subscribed
+	// to. Tunnels idle for longer than -idle-timeout are removed.
+	LastActivity time.Time
+	// ExpiresAt is when the tunnel is removed. Zero never expires.
+	ExpiresAt time.Time
+	// SecretHash is the hash of the secret required to use the tunnel, or
+	// nil for an open tunnel. See secretStatus.
+	SecretHash []byte
+	// SigningKey signs webhook deliveries and retrieved content, so clients
+	// sharing it can check that nothing was altered. Nil signs nothing. See
+	// signContent.
+	SigningKey []byte
+	// Webhooks maps subchannels to the URLs their messages are POSTed to.
+	// See deliverWebhooks.
+	Webhooks map[string][]string
+	// Queue tunnels keep every message sent to a subchannel in Queues, oldest
+	// first, until the get endpoint consumes it or it expires, instead of
+	// only the latest one. See enqueue.
+	Queue  bool
+	Queues map[string][]StreamMessage
+	// RequestsPerMinute and Burst replace -tunnel-rate and -tunnel-burst for
+	// this tunnel when set. See tunnelRateLimits.
+	RequestsPerMinute int
+	Burst             int
 }
 
+// newTunnel returns an empty tunnel with all of its maps allocated.
+func newTunnel(id string) *Tunnel {
+	now := time.Now()
+	return &Tunnel{ID: id, CreatedAt: now, LastActivity: now, Content: "", SubChannels: make(map[string]StoredContent), Spilled: make(map[string]string), Binary: make(map[string]bool), ContentTypes: make(map[string]string), Sequences: make(map[string]uint64), History: make(map[string][]StreamMessage), HistorySize: *historySize, Webhooks: make(map[string][]string), Queues: make(map[string][]StreamMessage)}
+}
+
+// StreamMessage is what gets delivered to stream subscribers. Comments are
+// written as SSE comment lines, which keep the connection warm without
+// triggering the client's message handler.
+type StreamMessage struct {
+	SubChannel string
+	Content    string
+	// Binary content is base64-encoded on streams.
+	Binary bool
+	// ContentType is the media type the content was sent with, if any.
+	ContentType string
+	Comment     bool
+	Sequence    uint64
+	// SentAt is when the message was sent, as reported by the history
+	// endpoint.
+	SentAt time.Time
+	// Append adds Content to what the subchannel holds, after Separator,
+	// instead of replacing it. Subscribers still only get Content. See
+	// appendContent.
+	Append    bool
+	Separator string
+	// Priority messages overtake the ones waiting for slow subscribers. See
+	// Subscriber.
+	Priority bool
+	// SpillPath is set on history entries whose content is the spilled
+	// content of their subchannel. Content is left empty, as the file holds
+	// it. See recordHistory.
+	SpillPath string
+}
+
+// wildcardSubChannel subscribes a stream to every subchannel of a tunnel.
+const wildcardSubChannel = "*"
+
 var tunnels = make(map[string]*Tunnel)
 var tunnelsMutex = &sync.Mutex{}
-var clients = make(map[string]map[string][]chan string)
+var clients = make(map[string]map[string][]*Subscriber)
 var clientsMutex = &sync.Mutex{}
 
+// Build information, set at build time with -ldflags, e.g.
+// -X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ).
+// See buildInfo.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+var listenPort = flag.String("port", envOr("PORT", "2427"), "Port to listen on (env PORT)")
+var listenAddr = flag.String("addr", os.Getenv("ADDR"), "Interface address to listen on, e.g. 127.0.0.1, defaults to all interfaces (env ADDR)")
+var serverHeader = flag.String("server-header", envOr("SERVER_HEADER", "txttunnel/"+version), "Value of the Server header sent with every response (env SERVER_HEADER)")
+var instanceID = flag.String("instance-id", os.Getenv("INSTANCE_ID"), "Value of the X-Instance-ID header, defaults to the hostname (env INSTANCE_ID)")
+var maxBodySize = flag.Int64("max-body", 1<<20, "Maximum size of a request body in bytes")
+var ipRequestsPerMinute = flag.Int("ip-rate", envInt("IP_RATE", RequestsPerMinute), "Maximum requests per minute per IP, 0 disables the limit (env IP_RATE)")
+var ipBurstSize = flag.Int("ip-burst", envInt("IP_BURST", BurstSize), "Maximum burst of requests per IP (env IP_BURST)")
+var tunnelRequestsPerMinute = flag.Int("tunnel-rate", envInt("TUNNEL_RATE", RequestsPerMinute), "Maximum requests per minute per tunnel, 0 disables the limit (env TUNNEL_RATE)")
+var tunnelBurstSize = flag.Int("tunnel-burst", envInt("TUNNEL_BURST", BurstSize), "Maximum burst of requests per tunnel (env TUNNEL_BURST)")
+var createRequestsPerMinute = flag.Int("create-rate", envInt("CREATE_RATE", 5), "Maximum tunnel creations per minute per IP (env CREATE_RATE)")
+var createBurstSize = flag.Int("create-burst", envInt("CREATE_BURST", 1), "Maximum burst of tunnel creations per IP (env CREATE_BURST)")
+var heartbeatInterval = flag.Duration("heartbeat", 30*time.Second, "Interval of keepalive comments on idle streams (0 disables)")
+var streamRetry = flag.Duration("stream-retry", 3*time.Second, "Reconnect delay streams ask clients to use with the SSE retry field (0 leaves it to the client)")
+var streamMaxContent = flag.Int("stream-max-content", 0, "Truncate content delivered over streams to this many bytes (0 means unlimited)")
+var postOnlyMutations = flag.Bool("post-only-mutations", false, "Only accept POST for creating tunnels and sending content")
+var normalizeNewlines = flag.Bool("normalize-newlines", false, "Convert CRLF and CR line endings in sent content to LF before storing it")
+var fieldAliasList = flag.String("field-alias", "", "Additional accepted field names, e.g. channel=subChannel,data=content")
+
 func main() {
-	log.Println("Starting server on port 2427")
-	http.HandleFunc("/", withCORS(homePage))
-	http.HandleFunc("/LICENSE", withCORS(giveLicense))
-	http.HandleFunc("/api/v3/tunnel/create", withCORS(createTunnel))
-	http.HandleFunc("/api/v3/tunnel/stream", withCORS(streamTunnelContent))
-	http.HandleFunc("/api/v3/tunnel/get", withCORS(getTunnelContent))
-	http.HandleFunc("/api/v3/tunnel/send", withCORS(sendToTunnel))
-	log.Fatal(http.ListenAndServe(":2427", nil))
-}
+	flag.Parse()
 
-func giveLicense(w http.ResponseWriter, r *http.Request) {
-	log.Println("Serving LICENSE file")
-	http.ServeFile(w, r, "web/LICENSE.txt")
-}
+	if err := setupLogging(); err != nil {
+		fatal("Invalid logging settings", "error", err)
+	}
 
-func homePage(w http.ResponseWriter, r *http.Request) {
-	log.Println("Serving home page")
-	http.ServeFile(w, r, "web/index.html")
-}
+	aliases, err := parseFieldAliases(*fieldAliasList)
+	if err != nil {
+		fatal("Invalid -field-alias", "error", err)
+	}
+	fieldAliases = aliases
 
-func withCORS(handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		handler(w, r)
+	if err := validSlowSubscriberPolicy(*slowSubscriberPolicy); err != nil {
+		fatal("Invalid -slow-subscriber", "error", err)
 	}
-}
 
-func getTunnelContent(w http.ResponseWriter, r *http.Request) {
-	tunnelId := ""
-	subChannel := ""
-	if r.Method == http.MethodGet {
-		tunnelId = r.URL.Query().Get("id")
-		subChannel = r.URL.Query().Get("subChannel")
-		if r.URL.Query().Get("subchannel") != "" {
-			subChannel = r.URL.Query().Get("subchannel")
-		}
-		if r.URL.Query().Get("ID") != "" {
-			tunnelId = r.URL.Query().Get("ID")
-		}
-	} else if r.Method == http.MethodPost {
-		requestBody, err := io.ReadAll(r.Body)
+	if err := validBatchDuplicatePolicy(*batchDuplicatePolicy); err != nil {
+		fatal("Invalid -batch-duplicates", "error", err)
+	}
+
+	if err := validWebhookRetryDelay(*webhookRetryDelay); err != nil {
+		fatal("Invalid -webhook-retry-delay", "error", err)
+	}
+
+	*baseURL, err = validBaseURL(*baseURL)
+	if err != nil {
+		fatal("Invalid -base-url", "error", err)
+	}
+
+	trustedProxies, err = parseTrustedProxies(*trustedProxyList)
+	if err != nil {
+		fatal("Invalid -trusted-proxies", "error", err)
+	}
+
+	corsOrigins, err = parseOriginList(*corsOriginList)
+	if err != nil {
+		fatal("Invalid -cors-origins", "error", err)
+	}
+
+	authenticator, err = newAuthenticator()
+	if err != nil {
+		fatal("Invalid authentication settings", "error", err)
+	}
+
+	if *instanceID == "" {
+		hostname, err := os.Hostname()
 		if err != nil {
-			log.Println("Failed to read the request body:", err)
-			http.Error(w, "Failed to read the request body", http.StatusInternalServerError)
-			return
+			slog.Error("Failed to determine the hostname", "error", err)
 		}
+		*instanceID = hostname
+	}
+
+	readOnly.Store(*readOnlyOnStart)
+	if *readOnlyOnStart {
+		slog.Info("Starting in read-only mode")
+	}
+
+	ipLimiters = NewRateLimiterStore(*ipRequestsPerMinute, *ipBurstSize)
+	tunnelLimiters = NewRateLimiterStore(*tunnelRequestsPerMinute, *tunnelBurstSize)
+	tunnelLimiters.overrides = tunnelRateLimits
+	createLimiters = NewRateLimiterStore(*createRequestsPerMinute, *createBurstSize)
 
-		var requestBodyJSON map[string]string
-		err = json.Unmarshal(requestBody, &requestBodyJSON)
+	if *redisURL != "" {
+		redisBackend, err := newRedisBackend(*redisURL, *redisPrefix)
 		if err != nil {
-			log.Println("Failed to parse the request body:", err)
-			http.Error(w, "Failed to parse the request body", http.StatusInternalServerError)
-			return
+			fatal("Failed to connect to Redis", "error", err)
 		}
+		backend = redisBackend
+		slog.Info("Sharing tunnels through Redis")
+	}
 
-		if requestBodyJSON["subchannel"] != "" {
-			subChannel = requestBodyJSON["subchannel"]
+	if *persistPath != "" {
+		if err := loadTunnels(*persistPath); err != nil {
+			fatal("Failed to load tunnels", "error", err)
 		}
+		go persistTunnels()
+	}
+
+	go expireTunnels()
+
+	address := net.JoinHostPort(*listenAddr, *listenPort)
+	slog.Info("Starting server", "address", address, "tls", tlsEnabled(), "version", version, "commit", buildInfo()["commit"])
+	registerRoutes(http.DefaultServeMux)
+	server := &http.Server{Addr: address, Handler: withLogContext(withIdentity(withoutTrailingSlash(withMetrics(http.DefaultServeMux))))}
+	redirect, err := configureTLS(server)
+	if err != nil {
+		fatal("Invalid TLS settings", "error", err)
+	}
+	serveUntilSignal(server, redirect)
 
-		if requestBodyJSON["subChannel"] != "" {
-			subChannel = requestBodyJSON["subChannel"]
+	if *persistPath != "" {
+		if err := saveTunnels(*persistPath); err != nil {
+			slog.Error("Failed to save tunnels", "error", err)
 		}
+	}
+}
 
-		if requestBodyJSON["ID"] != "" {
-			tunnelId = requestBodyJSON["ID"]
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envInt is envOr for numeric settings. Invalid values are reported and
+// ignored.
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("Ignoring invalid environment variable", "name", name, "value", value)
+		return fallback
+	}
+	return number
+}
+
+// envDuration is envOr for durations such as "5m". Invalid values are
+// reported and ignored.
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("Ignoring invalid environment variable", "name", name, "value", value)
+		return fallback
+	}
+	return duration
+}
+
+// withIdentity tags every response with the server name and instance, so it
+// is clear which backend served a request behind a load balancer.
+func withIdentity(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *serverHeader != "" {
+			w.Header().Set("Server", *serverHeader)
+		}
+		if *instanceID != "" {
+			w.Header().Set("X-Instance-ID", *instanceID)
 		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// registerRoutes serves the web pages and the API on mux.
+func registerRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/", withCORS(withGzip(homePage)))
+	mux.HandleFunc("/LICENSE", withCORS(withGzip(giveLicense)))
+	mux.HandleFunc("/api/v3/tunnel/create", withCORS(withRateLimit(withAuth(withCreateRateLimit(createTunnel)))))
+	mux.HandleFunc("/api/v3/tunnel/stream", withTunnelCORS(withRateLimit(withAuth(streamTunnelContent))))
+	mux.HandleFunc("/api/v3/tunnel/get", withTunnelCORS(withRateLimit(withAuth(withGzip(getTunnelContent)))))
+	mux.HandleFunc("/api/v3/tunnel/poll", withTunnelCORS(withRateLimit(withAuth(pollTunnel))))
+	mux.HandleFunc("/api/v3/tunnel/ws", withRateLimit(withAuth(tunnelWebSocket)))
+	mux.HandleFunc("/api/v3/tunnel/history", withTunnelCORS(withRateLimit(withAuth(tunnelHistory))))
+	mux.HandleFunc("/api/v3/tunnel/subchannels", withTunnelCORS(withRateLimit(withAuth(listSubChannels))))
+	mux.HandleFunc("/api/v3/tunnel/webhook", withTunnelCORS(withRateLimit(withAuth(tunnelWebhook))))
+	mux.HandleFunc("/api/v3/tunnel/stats", withTunnelCORS(withRateLimit(withAuth(tunnelStats))))
+	mux.HandleFunc("/api/v3/tunnel/send", withTunnelCORS(withRateLimit(withAuth(sendToTunnel))))
+	mux.HandleFunc("/api/v3/tunnel/batch", withCORS(withRateLimit(withAuth(sendBatch))))
+	mux.HandleFunc("/api/v3/tunnel/delete", withTunnelCORS(withRateLimit(withAuth(deleteTunnel))))
+	mux.HandleFunc("/api/v3/tunnel/list", withCORS(withAdmin(adminListTunnels)))
+	mux.HandleFunc("/api/v3/tunnel/mux", withCORS(withRateLimit(withAuth(streamMultiplexed))))
+	mux.HandleFunc("/api/v3/tunnel/mux/control", withCORS(withRateLimit(withAuth(controlMultiplexed))))
+	mux.HandleFunc("/api/v3/tunnel/auth-check", withCORS(withRateLimit(withAuth(checkTunnelAuth))))
+	mux.HandleFunc("/api/v3/tunnel/exists", withCORS(withRateLimit(withAuth(tunnelExists))))
+	mux.HandleFunc("/api/v3/echo", withCORS(echoParams))
+	mux.HandleFunc("/metrics", metricsHandler())
+	mux.HandleFunc("/healthz", healthCheck)
+	mux.HandleFunc("/version", withCORS(versionInfo))
+	mux.HandleFunc("/readyz", readyCheck)
+	mux.HandleFunc("/api/v3/admin/runtime", withCORS(withAdmin(adminRuntime)))
+	mux.HandleFunc("/api/v3/admin/read-only", withCORS(withAdmin(adminReadOnly)))
+	mux.HandleFunc("/api/v3/admin/ratelimit/inspect", withCORS(withAdmin(inspectRateLimit)))
+	mux.HandleFunc("/api/v3/admin/throughput", withCORS(withAdmin(adminThroughput)))
+}
 
-		if requestBodyJSON["id"] != "" {
-			tunnelId = requestBodyJSON["id"]
+// withoutTrailingSlash serves `/api/v3/tunnel/create/` the same as
+// `/api/v3/tunnel/create`, since some clients and proxies append a slash.
+// The request is rewritten rather than redirected so POST bodies survive.
+func withoutTrailingSlash(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Path) > 1 && strings.HasSuffix(r.URL.Path, "/") {
+			r.URL.Path = strings.TrimRight(r.URL.Path, "/")
+			if r.URL.Path == "" {
+				r.URL.Path = "/"
+			}
+			r.URL.RawPath = ""
 		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func giveLicense(w http.ResponseWriter, r *http.Request) {
+	slog.DebugContext(r.Context(), "Serving LICENSE file")
+	serveWebFile(w, r, "LICENSE.txt")
+}
+
+func homePage(w http.ResponseWriter, r *http.Request) {
+	slog.DebugContext(r.Context(), "Serving home page")
+	serveWebFile(w, r, "index.html")
+}
+
+// readRequestBody reads the request body, bounded by -max-body. On failure it
+// writes the error response itself and returns false.
+func readRequestBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	requestBody, err := io.ReadAll(http.MaxBytesReader(w, r.Body, *maxBodySize))
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			slog.WarnContext(r.Context(), "The request body is too large", "error", err, "status", http.StatusRequestEntityTooLarge)
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("The request body must not exceed %d bytes", maxBytesError.Limit))
+			return nil, false
+		}
+		slog.ErrorContext(r.Context(), "Failed to read the request body", "error", err, "status", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read the request body")
+		return nil, false
+	}
+	return requestBody, true
+}
+
+// writeJSON writes value as the JSON response. Requests with `pretty=true`
+// get indented output, which is easier to read with curl.
+func writeJSON(w http.ResponseWriter, r *http.Request, value interface{}) {
+	var response []byte
+	var err error
+	if r.URL.Query().Get("pretty") == "true" {
+		response, err = json.MarshalIndent(value, "", "  ")
+	} else {
+		response, err = json.Marshal(value)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode response", "error", err, "status", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to encode response")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// writeJSONError is http.Error for the API, answering with a JSON object
+// that holds the message and status code, so clients can parse errors like
+// any other response.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": message, "status": status})
+}
+
+func getTunnelContent(w http.ResponseWriter, r *http.Request) {
+	params, ok := parseTunnelParams(w, r)
+	if !ok {
+		return
+	}
+	tunnelId := params.ID
+	subChannel := params.SubChannel
+	consume := params.Get("consume") == "true"
+	raw := params.Get("raw") == "true"
+	wait := params.Get("wait") == "true"
+
+	if !params.checkID(w, r) {
+		return
+	}
+
+	if !params.checkSubChannel(w, r) {
+		return
 	}
 
-	if subChannel == "" {
-		subChannel = "main"
+	var timeout time.Duration
+	if wait {
+		var ok bool
+		if timeout, ok = parsePollTimeout(w, r, params); !ok {
+			return
+		}
 	}
 
-	if tunnelId == "" {
-		log.Println("The request must contain a valid 'id' parameter or field")
-		http.Error(w, "The request must contain a valid 'id' parameter or field", http.StatusBadRequest)
+	// Consuming clears the content, which read-only mode must not allow.
+	if consume && rejectIfReadOnly(w) {
 		return
 	}
 
 	tunnelsMutex.Lock()
-	tunnel, exists := tunnels[tunnelId]
+	tunnel, exists := liveTunnel(tunnelId)
 	if !exists {
 		tunnelsMutex.Unlock()
-		log.Println("No tunnel with this id exists:", tunnelId)
-		http.Error(w, "No tunnel with this id exists.", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "No tunnel with this id exists", "tunnel_id", tunnelId, "status", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, "No tunnel with this id exists.")
 		return
 	}
-	if tunnel.SubChannels[subChannel] != "" {
-		w.Header().Set("Content-Type", "application/json")
-		response, err := json.Marshal(map[string]string{"content": tunnel.SubChannels[subChannel]})
-		if err != nil {
-			log.Println("Failed to encode response:", err)
-			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
-			return
-		}
-		w.Write(response)
+	if status := tunnel.secretStatus(r, params); status != http.StatusOK {
+		tunnelsMutex.Unlock()
+		rejectSecret(w, r, status, tunnelId)
+		return
 	}
+	// Queue tunnels hand out each message once, so every read consumes.
+	queue := tunnel.Queue
+	if queue && readOnly.Load() {
+		tunnelsMutex.Unlock()
+		rejectIfReadOnly(w)
+		return
+	}
+	tunnel.touch()
+	retrieved := tunnel.takeContent(subChannel, consume)
+	signingKey := tunnel.SigningKey
 	tunnelsMutex.Unlock()
-	log.Println("Retrieved content for tunnel:", tunnelId, "subChannel:", subChannel)
-}
 
-func streamTunnelContent(w http.ResponseWriter, r *http.Request) {
-	tunnelId := ""
-	subChannel := ""
-	if r.Method == http.MethodGet {
-		tunnelId = r.URL.Query().Get("id")
-		subChannel = r.URL.Query().Get("subChannel")
-		if r.URL.Query().Get("subchannel") != "" {
-			subChannel = r.URL.Query().Get("subchannel")
-		}
-		if r.URL.Query().Get("ID") != "" {
-			tunnelId = r.URL.Query().Get("ID")
-		}
-	} else if r.Method == http.MethodPost {
-		requestBody, err := io.ReadAll(r.Body)
-		if err != nil {
-			log.Println("Failed to read the request body:", err)
-			http.Error(w, "Failed to read the request body", http.StatusInternalServerError)
+	if wait && retrieved.ref.empty() {
+		if retrieved, ok = waitForContent(w, r, tunnel, subChannel, consume, timeout); !ok {
 			return
 		}
+	}
+	binary, contentType := retrieved.binary, retrieved.contentType
 
-		var requestBodyJSON map[string]string
-		err = json.Unmarshal(requestBody, &requestBodyJSON)
-		if err != nil {
-			log.Println("Failed to parse the request body:", err)
-			http.Error(w, "Failed to parse the request body", http.StatusInternalServerError)
-			return
-		}
+	content, err := retrieved.ref.read()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read content", "error", err, "status", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read content")
+		return
+	}
 
-		if requestBodyJSON["subchannel"] != "" {
-			subChannel = requestBodyJSON["subchannel"]
+	if consume && !queue {
+		if err := backend.SetContent(tunnelId, StreamMessage{SubChannel: subChannel, Sequence: retrieved.sequence}); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to clear content in the backend", "error", err)
 		}
+		publish(backendEvent{Type: eventCleared, TunnelID: tunnelId, SubChannel: subChannel})
+	}
 
-		if requestBodyJSON["subChannel"] != "" {
-			subChannel = requestBodyJSON["subChannel"]
-		}
+	// A subchannel nothing was sent to yet, or whose content was cleared, has
+	// nothing to return. Say so with a 204 rather than an empty 200, which
+	// clients expecting JSON would wait on or fail to parse.
+	if content == "" {
+		slog.DebugContext(r.Context(), "No content to retrieve", "tunnel_id", tunnelId, "subchannel", subChannel, "status", http.StatusNoContent)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 
-		if requestBodyJSON["ID"] != "" {
-			tunnelId = requestBodyJSON["ID"]
+	var signature string
+	if signingKey != nil {
+		signature = signContent(signingKey, []byte(content))
+	}
+	switch {
+	case raw:
+		if signature != "" {
+			w.Header().Set(signatureHeader, signature)
+		}
+		writeRaw(w, content, contentType, binary)
+	case acceptsOctetStream(r):
+		if signature != "" {
+			w.Header().Set(signatureHeader, signature)
+		}
+		w.Header().Set("Content-Type", octetStream)
+		io.WriteString(w, content)
+	default:
+		response := map[string]string{"content": content}
+		if binary {
+			response["content"] = base64.StdEncoding.EncodeToString([]byte(content))
+			response["encoding"] = base64Encoding
+		}
+		if contentType != "" {
+			response["contentType"] = contentType
+		}
+		if signature != "" {
+			response["signature"] = signature
 		}
+		writeJSON(w, r, response)
+	}
+	if consume || queue {
+		slog.InfoContext(r.Context(), "Consumed content", "tunnel_id", tunnelId, "subchannel", subChannel)
+	} else {
+		slog.InfoContext(r.Context(), "Retrieved content", "tunnel_id", tunnelId, "subchannel", subChannel)
+	}
+}
+
+func streamTunnelContent(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := streamFlusher(w, r)
+	if !ok {
+		return
+	}
 
-		if requestBodyJSON["id"] != "" {
-			tunnelId = requestBodyJSON["id"]
+	params, ok := parseTunnelParams(w, r)
+	if !ok {
+		return
+	}
+	tunnelId := params.ID
+	subChannel := params.SubChannel
+	wildcard := subChannel == wildcardSubChannel
+	withSnapshot := params.Get("withSnapshot") == "true"
+	namedEvents := params.Get("namedEvents") == "true"
+
+	if !params.checkID(w, r) {
+		return
+	}
+
+	if !params.checkSubChannel(w, r) {
+		return
+	}
+
+	heartbeat, err := streamHeartbeat(params.Get("heartbeat"))
+	if err != nil {
+		slog.WarnContext(r.Context(), "Invalid 'heartbeat' value", "value", params.Get("heartbeat"), "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("The 'heartbeat' value must be a number of seconds between 1 and %d", int(maxRequestedHeartbeat/time.Second)))
+		return
+	}
+
+	var minSequence uint64
+	if value := params.Get("minSequence"); value != "" {
+		minSequence, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			slog.WarnContext(r.Context(), "Invalid 'minSequence' value", "value", value, "status", http.StatusBadRequest)
+			writeJSONError(w, http.StatusBadRequest, "The 'minSequence' value must be a non-negative integer")
+			return
 		}
 	}
 
-	if subChannel == "" {
-		subChannel = "main"
+	if withSnapshot && !wildcard {
+		slog.WarnContext(r.Context(), "The 'withSnapshot' option requires subscribing to all subchannels", "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "The 'withSnapshot' option requires the '*' subChannel")
+		return
 	}
 
-	if tunnelId == "" {
-		log.Println("The request must contain a valid 'id' parameter or field")
-		http.Error(w, "The request must contain a valid 'id' parameter or field", http.StatusBadRequest)
+	if namedEvents && !wildcard {
+		slog.WarnContext(r.Context(), "The 'namedEvents' option requires subscribing to all subchannels", "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "The 'namedEvents' option requires the '*' subChannel")
 		return
 	}
 
 	tunnelsMutex.Lock()
-	_, exists := tunnels[tunnelId]
+	tunnel, exists := liveTunnel(tunnelId)
 	if !exists {
 		tunnelsMutex.Unlock()
-		log.Println("No tunnel with this id exists:", tunnelId)
-		http.Error(w, "No tunnel with this id exists.", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "No tunnel with this id exists", "tunnel_id", tunnelId, "status", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, "No tunnel with this id exists.")
+		return
+	}
+	if status := tunnel.secretStatus(r, params); status != http.StatusOK {
+		tunnelsMutex.Unlock()
+		rejectSecret(w, r, status, tunnelId)
 		return
 	}
+	tunnel.touch()
+	rotateAfter := tunnel.RotateAfter
 	tunnelsMutex.Unlock()
 
+	if !acquireConnection() {
+		rejectTooManyConnections(w, r)
+		return
+	}
+	defer releaseConnection()
+
+	slots, err := acquireStreamSlot(r.Context(), tunnelId)
+	switch {
+	case errors.Is(err, errStreamQueueFull):
+		slog.WarnContext(r.Context(), "Too many streams", "tunnel_id", tunnelId, "status", http.StatusTooManyRequests)
+		writeJSONError(w, http.StatusTooManyRequests, "Too many streams for this tunnel. Please try again later.")
+		return
+	case errors.Is(err, errStreamQueueTimeout):
+		slog.WarnContext(r.Context(), "Timed out waiting for a stream slot", "tunnel_id", tunnelId, "status", http.StatusServiceUnavailable)
+		writeJSONError(w, http.StatusServiceUnavailable, "Timed out waiting for a free stream on this tunnel.")
+		return
+	case err != nil:
+		slog.InfoContext(r.Context(), "Client left while waiting for a stream slot", "tunnel_id", tunnelId)
+		return
+	}
+	defer releaseStreamSlot(tunnelId, slots)
+
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	clientChan := make(chan string)
-	clientsMutex.Lock()
-	if clients[tunnelId] == nil {
-		clients[tunnelId] = make(map[string][]chan string)
+	subscriber := newSubscriber()
+	if err := addSubscriber(tunnelId, subChannel, subscriber); err != nil {
+		slog.WarnContext(r.Context(), "Too many wildcard subscribers", "tunnel_id", tunnelId, "status", http.StatusTooManyRequests)
+		writeJSONError(w, http.StatusTooManyRequests, "Too many subscribers to all subchannels. Please try again later.")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Client connected to stream", "tunnel_id", tunnelId, "subchannel", subChannel)
+	activeStreams.Inc()
+	defer activeStreams.Dec()
+
+	writeRetry(w)
+	flusher.Flush()
+
+	// The snapshot is taken after subscribing, so an update racing with it is
+	// delivered again afterwards rather than lost.
+	if withSnapshot {
+		tunnelsMutex.Lock()
+		refs := tunnel.contentRefs()
+		binaries := copyMap(tunnel.Binary)
+		contentTypes := copyMap(tunnel.ContentTypes)
+		tunnelsMutex.Unlock()
+		contents, err := readContents(refs)
+		snapshotContents := make(map[string]interface{}, len(contents))
+		for subChannel, content := range contents {
+			binary := binaries[subChannel]
+			contentType := contentTypes[subChannel]
+			if !binary && contentType == "" {
+				snapshotContents[subChannel] = truncateForStream(content)
+				continue
+			}
+			value := map[string]string{"content": streamContent(content, binary)}
+			if binary {
+				value["encoding"] = base64Encoding
+			}
+			if contentType != "" {
+				value["contentType"] = contentType
+			}
+			snapshotContents[subChannel] = value
+		}
+		var snapshot []byte
+		if err == nil {
+			snapshot, err = json.Marshal(snapshotContents)
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to encode snapshot", "error", err)
+		} else {
+			fmt.Fprintf(w, "event: snapshot\ndata: %s\n\n", snapshot)
+		}
+		flusher.Flush()
+	}
+
+	// Replay what a resuming client missed from the history. Live messages
+	// it already got this way are skipped by raising minSequence. Wildcard
+	// streams carry no event ids, so they have nothing to resume from.
+	if lastSequence, ok := lastEventID(r, params); ok && lastSequence >= minSequence {
+		minSequence = lastSequence + 1
+	}
+	if minSequence > 0 && !wildcard {
+		tunnelsMutex.Lock()
+		missed := tunnel.historySince(subChannel, minSequence-1)
+		tunnelsMutex.Unlock()
+		missed = loadHistory(missed)
+		for _, msg := range missed {
+			writeStreamMessage(w, msg, false, false)
+			minSequence = msg.Sequence + 1
+		}
+		flusher.Flush()
+	}
+
+	var rotate <-chan time.Time
+	if rotateAfter > 0 {
+		rotateTimer := time.NewTimer(rotateAfter)
+		defer rotateTimer.Stop()
+		rotate = rotateTimer.C
+	}
+
+	var keepalive <-chan time.Time
+	if heartbeat > 0 {
+		heartbeatTicker := time.NewTicker(heartbeat)
+		defer heartbeatTicker.Stop()
+		keepalive = heartbeatTicker.C
 	}
-	clients[tunnelId][subChannel] = append(clients[tunnelId][subChannel], clientChan)
-	clientsMutex.Unlock()
 
-	log.Println("Client connected to stream for tunnel:", tunnelId, "subChannel:", subChannel)
+	// Keepalives don't count as activity, or streams of forgotten tabs would
+	// never go idle.
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if *streamIdleTimeout > 0 {
+		idleTimer = time.NewTimer(*streamIdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
 
 	for {
 		select {
-		case msg := <-clientChan:
-			fmt.Fprintf(w, "data: %s\n\n", msg)
-			w.(http.Flusher).Flush()
-		case <-r.Context().Done():
-			clientsMutex.Lock()
-			for i, client := range clients[tunnelId][subChannel] {
-				if client == clientChan {
-					clients[tunnelId][subChannel] = append(clients[tunnelId][subChannel][:i], clients[tunnelId][subChannel][i+1:]...)
-					break
-				}
+		case msg, ok := <-subscriber.next():
+			if !ok {
+				fmt.Fprintf(w, "event: closed\ndata: %s\n\n", subscriber.closeReason)
+				flusher.Flush()
+				slog.InfoContext(r.Context(), "Tunnel removed, closing stream", "tunnel_id", tunnelId, "subchannel", subChannel)
+				return
 			}
-			clientsMutex.Unlock()
-			log.Println("Client disconnected from stream for tunnel:", tunnelId, "subChannel:", subChannel)
+			// Sequences count per subchannel, so on a wildcard stream the
+			// cursor applies to each subchannel separately.
+			if !msg.Comment && msg.Sequence < minSequence {
+				continue
+			}
+			writeStreamMessage(w, msg, wildcard, namedEvents)
+			flusher.Flush()
+			if idleTimer != nil {
+				resetTimer(idleTimer, *streamIdleTimeout)
+			}
+		case <-idle:
+			// The tunnel may have been used without this stream getting
+			// anything, e.g. by reads or sends to other subchannels.
+			tunnelsMutex.Lock()
+			lastActivity := tunnel.LastActivity
+			tunnelsMutex.Unlock()
+			if remaining := *streamIdleTimeout - time.Since(lastActivity); remaining > 0 {
+				idleTimer.Reset(remaining)
+				continue
+			}
+			removeSubscriber(tunnelId, subChannel, subscriber)
+			fmt.Fprintf(w, "event: closed\ndata: %s\n\n", closeReasonIdle)
+			flusher.Flush()
+			slog.InfoContext(r.Context(), "Closed idle stream", "tunnel_id", tunnelId, "subchannel", subChannel)
+			return
+		case <-keepalive:
+			// A failing write means the client is gone, even if the request
+			// context has not noticed yet.
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				removeSubscriber(tunnelId, subChannel, subscriber)
+				slog.InfoContext(r.Context(), "Keepalive failed, closing stream", "tunnel_id", tunnelId, "subchannel", subChannel, "error", err)
+				return
+			}
+			flusher.Flush()
+		case <-subscriber.Evicted:
+			removeSubscriber(tunnelId, subChannel, subscriber)
+			slog.InfoContext(r.Context(), "Closing stream of slow client", "tunnel_id", tunnelId, "subchannel", subChannel)
+			return
+		case <-rotate:
+			removeSubscriber(tunnelId, subChannel, subscriber)
+			fmt.Fprint(w, "event: reconnect\ndata: rotate\n\n")
+			flusher.Flush()
+			slog.InfoContext(r.Context(), "Rotated client on stream", "tunnel_id", tunnelId, "subchannel", subChannel)
+			return
+		case <-shuttingDown:
+			removeSubscriber(tunnelId, subChannel, subscriber)
+			fmt.Fprint(w, "event: reconnect\ndata: shutdown\n\n")
+			flusher.Flush()
+			slog.InfoContext(r.Context(), "Closed stream for shutdown", "tunnel_id", tunnelId, "subchannel", subChannel)
+			return
+		case <-r.Context().Done():
+			removeSubscriber(tunnelId, subChannel, subscriber)
+			slog.InfoContext(r.Context(), "Client disconnected from stream", "tunnel_id", tunnelId, "subchannel", subChannel)
 			return
 		}
 	}
 }
 
-func sendToTunnel(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodPost {
-		requestBody, err := io.ReadAll(r.Body)
-		if err != nil {
-			log.Println("Failed to read the request body:", err)
-			http.Error(w, "Failed to read the request body", http.StatusInternalServerError)
-			return
+const (
+	minHeartbeat          = 5 * time.Second
+	maxHeartbeat          = 5 * time.Minute
+	maxRequestedHeartbeat = time.Hour
+)
+
+// streamHeartbeat returns the keepalive interval for a stream: the server
+// default, or the interval requested by the client clamped to a safe range.
+// Values that are not a positive number of seconds up to an hour are
+// rejected.
+func streamHeartbeat(requested string) (time.Duration, error) {
+	if requested == "" {
+		return *heartbeatInterval, nil
+	}
+	seconds, err := strconv.Atoi(requested)
+	if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxRequestedHeartbeat {
+		return 0, fmt.Errorf("invalid heartbeat: %q", requested)
+	}
+	heartbeat := time.Duration(seconds) * time.Second
+	if heartbeat < minHeartbeat {
+		heartbeat = minHeartbeat
+	}
+	if heartbeat > maxHeartbeat {
+		heartbeat = maxHeartbeat
+	}
+	return heartbeat, nil
+}
+
+// streamFlusher returns the http.Flusher streams need to push each event to
+// the client as it happens. If the ResponseWriter can't flush, it answers
+// 500 instead and returns false.
+func streamFlusher(w http.ResponseWriter, r *http.Request) (http.Flusher, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		slog.ErrorContext(r.Context(), "Streaming is not supported by the response writer", "status", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, "Streaming is not supported by this server.")
+	}
+	return flusher, ok
+}
+
+// writeRetry writes the SSE retry field, which sets how long clients wait
+// before reconnecting a dropped stream, unless -stream-retry is 0.
+func writeRetry(w http.ResponseWriter) {
+	if *streamRetry > 0 {
+		fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds())
+	}
+}
+
+// writeStreamMessage writes a message in SSE framing, using the subchannel's
+// sequence number as the event id. Wildcard subscribers get an `update` event
+// carrying the subchannel and sequence alongside the content instead, as
+// sequences of different subchannels are unrelated. With namedEvents, the
+// update event is named after its subchannel, see updateEventName. SSE can
+// only carry text, so binary content is sent base64-encoded as a `binary`
+// event, or with `encoding` set in an update.
+func writeStreamMessage(w io.Writer, msg StreamMessage, wildcard bool, namedEvents bool) {
+	if msg.Comment {
+		for _, line := range strings.Split(msg.Content, "\n") {
+			fmt.Fprintf(w, ": %s\n", line)
 		}
+		fmt.Fprint(w, "\n")
+		return
+	}
 
-		var requestBodyJSON map[string]string
-		err = json.Unmarshal(requestBody, &requestBodyJSON)
+	content := streamContent(msg.Content, msg.Binary)
+	if wildcard {
+		update := map[string]interface{}{"subChannel": msg.SubChannel, "content": content, "sequence": msg.Sequence}
+		if msg.Binary {
+			update["encoding"] = base64Encoding
+		}
+		if msg.ContentType != "" {
+			update["contentType"] = msg.ContentType
+		}
+		encoded, err := json.Marshal(update)
 		if err != nil {
-			log.Println("Failed to parse the request body:", err)
-			http.Error(w, "Failed to parse the request body", http.StatusInternalServerError)
+			slog.Error("Failed to encode update", "error", err)
 			return
 		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", updateEventName(msg.SubChannel, namedEvents), encoded)
+		return
+	}
 
-		if requestBodyJSON["subchannel"] != "" {
-			requestBodyJSON["subChannel"] = requestBodyJSON["subchannel"]
-		}
+	// The content type goes in an event of its own right before the message,
+	// which clients that only listen for messages simply ignore.
+	if msg.ContentType != "" {
+		fmt.Fprintf(w, "event: contentType\ndata: %s\n\n", msg.ContentType)
+	}
+	if msg.Binary {
+		fmt.Fprintf(w, "event: binary\nid: %d\ndata: %s\n\n", msg.Sequence, content)
+		return
+	}
+	fmt.Fprintf(w, "id: %d\ndata: %s\n\n", msg.Sequence, content)
+}
 
-		if requestBodyJSON["subChannel"] == "" {
-			requestBodyJSON["subChannel"] = "main"
-		}
+// reservedEventNames are the events streams send besides messages, which
+// subchannels can't be named after without being mistaken for them.
+var reservedEventNames = map[string]bool{
+	"message":     true,
+	"binary":      true,
+	"contentType": true,
+	"update":      true,
+	"snapshot":    true,
+	"closed":      true,
+	"reconnect":   true,
+}
+
+// updateEventName returns the SSE event of a wildcard update: `update`, or
+// with namedEvents the subchannel's name, unless that is reserved or can't
+// be sent as an event name.
+func updateEventName(subChannel string, namedEvents bool) string {
+	if !namedEvents || subChannel == "" || reservedEventNames[subChannel] || strings.ContainsAny(subChannel, "\r\n") {
+		return "update"
+	}
+	return subChannel
+}
+
+const truncatedMarker = "...[truncated]"
+
+// truncateForStream shortens content to -stream-max-content bytes, cutting
+// on a character boundary and appending a marker. Clients can fetch the full
+// value with the get endpoint.
+func truncateForStream(content string) string {
+	if *streamMaxContent <= 0 || len(content) <= *streamMaxContent {
+		return content
+	}
+	cut := *streamMaxContent
+	for cut > 0 && !utf8.RuneStart(content[cut]) {
+		cut--
+	}
+	return content[:cut] + truncatedMarker
+}
 
-		if requestBodyJSON["ID"] != "" {
-			requestBodyJSON["id"] = requestBodyJSON["ID"]
+// allowedMutationMethod checks the method of a request that creates or sends,
+// writing a 405 response and returning false if it is not allowed. With
+// -post-only-mutations only POST is accepted, so a cross-site GET (an image
+// tag or a link) can never change state.
+func allowedMutationMethod(w http.ResponseWriter, r *http.Request) bool {
+	if *postOnlyMutations {
+		if r.Method != http.MethodPost {
+			slog.WarnContext(r.Context(), "Method not allowed. Only POST requests are allowed.", "status", http.StatusMethodNotAllowed)
+			writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed. Only POST requests are allowed.")
+			return false
 		}
+		return true
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		slog.WarnContext(r.Context(), "Method not allowed. Only POST and GET requests are allowed.", "status", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed. Only POST and GET requests are allowed.")
+		return false
+	}
+	return true
+}
+
+// normalizeLineEndings converts CRLF and lone CR line endings to LF, so
+// content from any client is framed the same way on streams.
+func normalizeLineEndings(content string) string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	return strings.ReplaceAll(content, "\r", "\n")
+}
+
+func sendToTunnel(w http.ResponseWriter, r *http.Request) {
+	if !allowedMutationMethod(w, r) {
+		return
+	}
+
+	if rejectIfReadOnly(w) {
+		return
+	}
+
+	params, ok := parseTunnelParams(w, r)
+	if !ok {
+		return
+	}
+	msg, rejection := newSendMessage(params)
+	if rejection != nil {
+		slog.WarnContext(r.Context(), rejection.log, "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, rejection.message)
+		return
+	}
+	id := params.ID
+	subChannel := msg.SubChannel
+
+	tunnelsMutex.Lock()
+	tunnel, exists := liveTunnel(id)
+	if !exists {
+		tunnelsMutex.Unlock()
+		slog.WarnContext(r.Context(), "No tunnel with this id exists", "tunnel_id", id, "status", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, "No tunnel with this id exists.")
+		return
+	}
+	if status := tunnel.secretStatus(r, params); status != http.StatusOK {
+		tunnelsMutex.Unlock()
+		rejectSecret(w, r, status, id)
+		return
+	}
+	tunnelsMutex.Unlock()
 
-		if requestBodyJSON["id"] == "" || requestBodyJSON["subChannel"] == "" || requestBodyJSON["content"] == "" {
-			log.Println("The request body must contain a valid 'id', 'subChannel' and 'content' field")
-			http.Error(w, "The request body must contain a valid 'id', 'subChannel' and 'content' field", http.StatusBadRequest)
+	if _, err := sendContent(tunnel, msg); err != nil {
+		if errors.Is(err, errTunnelGone) {
+			slog.WarnContext(r.Context(), "No tunnel with this id exists", "tunnel_id", id, "status", http.StatusNotFound)
+			writeJSONError(w, http.StatusNotFound, "No tunnel with this id exists.")
 			return
 		}
-
-		tunnelsMutex.Lock()
-		tunnel, exists := tunnels[requestBodyJSON["id"]]
-		if !exists {
-			tunnelsMutex.Unlock()
-			log.Println("No tunnel with this id exists:", requestBodyJSON["id"])
-			http.Error(w, "No tunnel with this id exists.", http.StatusNotFound)
+		if status, message, ok := queueSendError(err); ok {
+			slog.WarnContext(r.Context(), "Failed to queue content", "tunnel_id", id, "error", err, "status", status)
+			writeJSONError(w, status, message)
 			return
 		}
-		tunnel.SubChannels[requestBodyJSON["subChannel"]] = requestBodyJSON["content"]
-		tunnelsMutex.Unlock()
+		slog.ErrorContext(r.Context(), "Failed to store content", "error", err, "status", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to store content")
+		return
+	}
 
-		clientsMutex.Lock()
-		for _, client := range clients[requestBodyJSON["id"]][requestBodyJSON["subChannel"]] {
-			client <- requestBodyJSON["content"]
-		}
-		clientsMutex.Unlock()
+	w.WriteHeader(http.StatusOK)
+	slog.InfoContext(r.Context(), "Sent content", "tunnel_id", id, "subchannel", subChannel)
+}
 
-		w.WriteHeader(http.StatusOK)
-		log.Println("Sent content to tunnel:", requestBodyJSON["id"], "subChannel:", requestBodyJSON["subChannel"])
-	} else if r.Method == http.MethodGet {
-		id := r.URL.Query().Get("id")
-		subChannel := r.URL.Query().Get("subChannel")
-		content := r.URL.Query().Get("content")
+// sendRejection is why a send was refused before its tunnel was looked up.
+// It is answered with 400 Bad Request.
+type sendRejection struct {
+	// log is the message logged for the rejection, message the one returned
+	// to the client.
+	log     string
+	message string
+}
 
-		if r.URL.Query().Get("subchannel") != "" {
-			subChannel = r.URL.Query().Get("subchannel")
-		}
+// newSendMessage validates the parameters of a send and builds the message to
+// deliver.
+func newSendMessage(params TunnelParams) (StreamMessage, *sendRejection) {
+	asComment := params.Get("asComment") == "true"
+	appendMode := params.Get("append") == "true"
 
-		if r.URL.Query().Get("ID") != "" {
-			id = r.URL.Query().Get("ID")
-		}
+	content, binary, err := sentContent(params)
+	if err != nil {
+		return StreamMessage{}, &sendRejection{"Failed to decode content", "The 'content' must be valid base64 when 'encoding' is 'base64', the only supported encoding"}
+	}
 
-		if id == "" || subChannel == "" || content == "" {
-			log.Println("The request must contain a valid 'id', 'subChannel' and 'content' parameters")
-			http.Error(w, "The request must contain a valid 'id', 'subChannel' and 'content' parameters", http.StatusBadRequest)
-			return
-		}
+	contentType, err := parseContentType(params.Get("contentType"))
+	if err != nil {
+		return StreamMessage{}, &sendRejection{"Invalid 'contentType' value", "The 'contentType' must be a valid media type, such as 'application/json'"}
+	}
 
-		tunnelsMutex.Lock()
-		tunnel, exists := tunnels[id]
-		if !exists {
+	if params.ID == "" || content == "" {
+		return StreamMessage{}, &sendRejection{"The request must contain a valid 'id' and 'content' parameter or field", "The request must contain a valid 'id' and 'content' parameter or field"}
+	}
+
+	if params.SubChannel == "" {
+		return StreamMessage{}, &sendRejection{"The request must contain a valid 'subChannel' parameter or field", "The request must contain a valid 'subChannel' parameter or field"}
+	}
+
+	if params.SubChannel == wildcardSubChannel {
+		return StreamMessage{}, &sendRejection{"Content cannot be sent to the wildcard subchannel", "Content cannot be sent to the '*' subChannel"}
+	}
+
+	if (binary || contentType != "") && asComment {
+		return StreamMessage{}, &sendRejection{"Binary or typed content cannot be sent as a comment", "Binary content and content with a 'contentType' cannot be sent as a comment"}
+	}
+
+	if appendMode && (binary || asComment) {
+		return StreamMessage{}, &sendRejection{"Binary content and comments cannot be appended", "Binary content and comments cannot be sent with 'append'"}
+	}
+
+	priority, err := parsePriority(params.Get("priority"))
+	if err != nil {
+		return StreamMessage{}, &sendRejection{"Invalid 'priority' value", "The 'priority' must be 'high' or 'normal'"}
+	}
+
+	if *normalizeNewlines && !binary {
+		content = normalizeLineEndings(content)
+	}
+
+	msg := StreamMessage{SubChannel: params.SubChannel, Content: content, Binary: binary, ContentType: contentType, Comment: asComment, Append: appendMode, Separator: params.Get("separator"), Priority: priority}
+	return msg, nil
+}
+
+// parsePriority reports whether a send's `priority` asks for its message to
+// overtake the others, which it does when it is `high`.
+func parsePriority(priority string) (bool, error) {
+	switch priority {
+	case "", "normal":
+		return false, nil
+	case "high":
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown priority %q", priority)
+}
+
+// errTunnelGone is returned by sendContent when the tunnel was removed or
+// replaced after it was looked up.
+var errTunnelGone = errors.New("the tunnel no longer exists")
+
+// sendContent stores a message in its subchannel of a tunnel that was looked
+// up and authorized before, and delivers it to the subchannel's subscribers
+// on every instance. Comments are only delivered. It returns the message's
+// sequence number, which is zero for comments.
+func sendContent(tunnel *Tunnel, msg StreamMessage) (uint64, error) {
+	id := tunnel.ID
+	tunnelsMutex.Lock()
+	// Working out the stored content may release tunnelsMutex while it reads
+	// spilled content or compresses and spills the result, so it goes before
+	// the checks. Queues store nothing, and reject appends below.
+	stored := msg.Content
+	var prepared preparedContent
+	if !msg.Comment && !tunnel.Queue {
+		var err error
+		if stored, prepared, err = tunnel.sentContent(msg); err != nil {
 			tunnelsMutex.Unlock()
-			log.Println("No tunnel with this id exists:", id)
-			http.Error(w, "No tunnel with this id exists.", http.StatusNotFound)
-			return
+			return 0, err
 		}
-		tunnel.SubChannels[subChannel] = content
+	}
+	if current, exists := liveTunnel(id); !exists || current != tunnel {
+		tunnelsMutex.Unlock()
+		prepared.discard()
+		return 0, errTunnelGone
+	}
+	msg.SentAt = time.Now()
+	queue := tunnel.Queue && !msg.Comment
+	if queue && msg.Append {
+		tunnelsMutex.Unlock()
+		return 0, errQueueAppend
+	}
+	if queue && tunnel.queueFull(msg.SubChannel, msg.SentAt) {
 		tunnelsMutex.Unlock()
+		return 0, errQueueFull
+	}
+	tunnel.touch()
+	tunnel.recordMessage(msg.SentAt, len(msg.Content))
+	messagesSent.Inc()
+	bytesSent.Add(float64(len(msg.Content)))
+	if !msg.Comment && !queue {
+		tunnel.storeContent(msg.SubChannel, prepared, msg.Binary)
+		tunnel.setContentType(msg.SubChannel, msg.ContentType)
+	}
+	if !msg.Comment {
+		tunnel.Sequences[msg.SubChannel]++
+		msg.Sequence = tunnel.Sequences[msg.SubChannel]
+		if queue {
+			tunnel.enqueue(msg)
+		}
+		tunnel.recordHistory(msg, msg.Append)
+	}
+	var webhooks []string
+	if !msg.Comment {
+		webhooks = tunnel.webhooksFor(msg.SubChannel)
+	}
+	signingKey := tunnel.SigningKey
+	tunnelsMutex.Unlock()
 
-		clientsMutex.Lock()
-		for _, client := range clients[id][subChannel] {
-			client <- content
+	// Queues are only kept on this instance, see createTunnel.
+	if !msg.Comment && !queue {
+		storedMsg := msg
+		storedMsg.Content = stored
+		if err := backend.SetContent(id, storedMsg); err != nil {
+			return 0, fmt.Errorf("storing content in the backend: %w", err)
 		}
-		clientsMutex.Unlock()
-		w.WriteHeader(http.StatusOK)
-		log.Println("Sent content to tunnel:", id, "subChannel:", subChannel)
-	} else {
-		log.Println("Method not allowed. Only POST and GET requests are allowed.")
-		http.Error(w, "Method not allowed. Only POST and GET requests are allowed.", http.StatusMethodNotAllowed)
+	}
+	event := backendEvent{Type: eventSent, TunnelID: id, SubChannel: msg.SubChannel, Content: []byte(msg.Content), Binary: msg.Binary, ContentType: msg.ContentType, Comment: msg.Comment, Sequence: msg.Sequence, SentAt: msg.SentAt}
+	if msg.Append {
+		event.Stored = []byte(stored)
+	}
+	publish(event)
+
+	broadcast(id, msg.SubChannel, msg)
+	deliverWebhooks(id, webhooks, signingKey, msg)
+	return msg.Sequence, nil
+}
+
+// checkTunnelAuth tells a client whether it may access a tunnel, without
+// reading or changing any content. Requests that fail authentication never
+// get here, so what is left to check is the tunnel's own secret.
+func checkTunnelAuth(w http.ResponseWriter, r *http.Request) {
+	params, ok := parseTunnelParams(w, r)
+	if !ok {
+		return
+	}
+
+	if !params.checkID(w, r) {
+		return
+	}
+
+	tunnelsMutex.Lock()
+	tunnel, exists := liveTunnel(params.ID)
+	tunnelsMutex.Unlock()
+	if !exists {
+		slog.WarnContext(r.Context(), "No tunnel with this id exists", "tunnel_id", params.ID, "status", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, "No tunnel with this id exists.")
+		return
+	}
+
+	if status := tunnel.secretStatus(r, params); status != http.StatusOK {
+		rejectSecret(w, r, status, params.ID)
 		return
 	}
+
+	writeJSON(w, r, map[string]bool{"authorized": true, "protected": authenticator != nil || tunnel.SecretHash != nil})
+	slog.InfoContext(r.Context(), "Checked access", "tunnel_id", params.ID)
+}
+
+// tunnelExists tells a client whether a tunnel exists, without reading or
+// changing it. It always answers 200, so the answer can be cached like any
+// other.
+func tunnelExists(w http.ResponseWriter, r *http.Request) {
+	params, ok := parseTunnelParams(w, r)
+	if !ok {
+		return
+	}
+
+	if !params.checkID(w, r) {
+		return
+	}
+
+	tunnelsMutex.Lock()
+	_, exists := liveTunnel(params.ID)
+	tunnelsMutex.Unlock()
+
+	writeJSON(w, r, map[string]bool{"exists": exists})
+	slog.DebugContext(r.Context(), "Checked tunnel exists", "tunnel_id", params.ID, "exists", exists)
+}
+
+// echoParams reports how the server parsed a request without touching any
+// tunnel state, so clients can check their parameter formatting.
+func echoParams(w http.ResponseWriter, r *http.Request) {
+	params, ok := parseTunnelParams(w, r)
+	if !ok {
+		return
+	}
+
+	rateLimits := map[string]string{"ip": clientIP(r)}
+	if params.ID != "" {
+		rateLimits["tunnel"] = params.ID
+	}
+
+	writeJSON(w, r, map[string]interface{}{
+		"method":     r.Method,
+		"id":         params.ID,
+		"subChannel": params.SubChannel,
+		"content":    params.Content,
+		"fields":     params.Fields,
+		"clientIP":   clientIP(r),
+		"rateLimits": rateLimits,
+	})
+	slog.InfoContext(r.Context(), "Echoed request parameters")
 }
 
 func createTunnel(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodPost {
-		requestBody, err := io.ReadAll(r.Body)
-		if err != nil {
-			log.Println("Failed to read the request body:", err)
-			http.Error(w, "Failed to read the request body", http.StatusInternalServerError)
-			return
-		}
+	if !allowedMutationMethod(w, r) {
+		return
+	}
 
-		var requestBodyJSON map[string]string
-		err = json.Unmarshal(requestBody, &requestBodyJSON)
-		if err != nil {
-			log.Println("Failed to parse the request body:", err)
-			http.Error(w, "Failed to parse the request body", http.StatusInternalServerError)
-			return
-		}
+	if rejectIfReadOnly(w) {
+		return
+	}
 
-		if requestBodyJSON["id"] == "" {
-			log.Println("The request body must contain a valid 'id' field")
-			http.Error(w, "The request body must contain a valid 'id' field", http.StatusBadRequest)
-			return
-		}
+	params, ok := parseTunnelParams(w, r)
+	if !ok {
+		return
+	}
+	tunnelId := params.ID
 
-		tunnelsMutex.Lock()
-		tunnels[requestBodyJSON["id"]] = &Tunnel{ID: requestBodyJSON["id"], Content: "", SubChannels: make(map[string]string)}
-		tunnelsMutex.Unlock()
+	if tunnelId == "" && r.Method == http.MethodPost {
+		slog.WarnContext(r.Context(), "The request body must contain a valid 'id' field", "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "The request body must contain a valid 'id' field")
+		return
+	}
 
-		response, err := json.Marshal(map[string]string{"id": requestBodyJSON["id"]})
-		if err != nil {
-			log.Println("Error creating the tunnel:", err)
-			http.Error(w, "Error creating the tunnel", http.StatusInternalServerError)
+	if tunnelId != "" && !validTunnelID(tunnelId) {
+		slog.WarnContext(r.Context(), "Invalid 'id' value", "value", tunnelId, "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("The 'id' must be at most %d letters, digits, '-', '_', '.' or '~'", *maxIDLength))
+		return
+	}
+
+	rotateAfter, err := parseSeconds(params.Get("rotateAfter"))
+	if err != nil {
+		slog.WarnContext(r.Context(), "Invalid 'rotateAfter' value", "value", params.Get("rotateAfter"), "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "The 'rotateAfter' value must be a non-negative number of seconds")
+		return
+	}
+
+	ttl, err := parseSeconds(params.Get("ttl"))
+	if err != nil {
+		slog.WarnContext(r.Context(), "Invalid 'ttl' value", "value", params.Get("ttl"), "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "The 'ttl' value must be a non-negative number of seconds")
+		return
+	}
+	if ttl == 0 {
+		ttl = *defaultTTL
+	}
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	var secretHash []byte
+	if secret := params.Get("secret"); secret != "" {
+		secretHash = hashSecret(secret)
+	}
+
+	var signingKey []byte
+	if key := params.Get("signingKey"); key != "" {
+		signingKey = []byte(key)
+	}
+
+	tunnelHistorySize := *historySize
+	if value := params.Get("historySize"); value != "" {
+		tunnelHistorySize, err = strconv.Atoi(value)
+		if err != nil || tunnelHistorySize < 0 || tunnelHistorySize > *maxHistorySize {
+			slog.WarnContext(r.Context(), "Invalid 'historySize' value", "value", value, "status", http.StatusBadRequest)
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("The 'historySize' value must be a number of messages between 0 and %d", *maxHistorySize))
 			return
 		}
+	}
+	historySizes, err := parseHistorySizes(params.Get("historySizes"))
+	if err != nil {
+		slog.WarnContext(r.Context(), "Invalid 'historySizes' value", "value", params.Get("historySizes"), "error", err, "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("The 'historySizes' value must map subchannels to a number of messages between 0 and %d, e.g. 'chat:100,status:1'", *maxHistorySize))
+		return
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(response)
-		log.Println("Created tunnel with ID:", requestBodyJSON["id"])
-	} else if r.Method == http.MethodGet {
-		if r.URL.Query().Get("id") == "" {
-			tunnelId := generateRandomID(6)
-			tunnelsMutex.Lock()
-			tunnels[tunnelId] = &Tunnel{ID: tunnelId, Content: "", SubChannels: make(map[string]string)}
-			tunnelsMutex.Unlock()
+	autoDeleteWhenEmpty := params.Get("autoDeleteWhenEmpty") == "true"
+	defaultContent := params.Get("defaultContent")
 
-			w.Header().Set("Content-Type", "application/json")
-			response, err := json.Marshal(map[string]string{"id": tunnelId})
-			if err != nil {
-				log.Println("Failed to encode response:", err)
-				http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	requestsPerMinute, ok := parseRateOverride(w, r, params, "requestsPerMinute", *maxTunnelRate)
+	if !ok {
+		return
+	}
+	burst, ok := parseRateOverride(w, r, params, "burst", *maxTunnelBurst)
+	if !ok {
+		return
+	}
+
+	mode := firstNonEmpty(params.Get("mode"), modeLatest)
+	if mode != modeLatest && mode != modeQueue {
+		slog.WarnContext(r.Context(), "Invalid 'mode' value", "value", mode, "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "The 'mode' must be 'latest' or 'queue'")
+		return
+	}
+	// Queues are kept by the instance they are sent to, which would split
+	// them between instances sharing a backend.
+	if mode == modeQueue && *redisURL != "" {
+		slog.WarnContext(r.Context(), "Queue tunnels are not supported with a shared backend", "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "Queue tunnels are not supported by this server")
+		return
+	}
+
+	allowedOrigins, err := parseOriginList(params.Get("allowedOrigins"))
+	if err != nil {
+		slog.WarnContext(r.Context(), "Invalid 'allowedOrigins' value", "value", params.Get("allowedOrigins"), "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "The 'allowedOrigins' value must be a list of origins")
+		return
+	}
+
+	randomID := tunnelId == ""
+	force := params.Get("force") == "true"
+
+	var replaced *Tunnel
+	tunnelsMutex.Lock()
+	if randomID {
+		tunnelId = freeRandomID()
+		if tunnelId == "" {
+			tunnelsMutex.Unlock()
+			slog.ErrorContext(r.Context(), "Failed to find a free random tunnel ID", "status", http.StatusInternalServerError)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to generate a tunnel ID. Please try again.")
+			return
+		}
+	} else if existing, exists := loadTunnel(tunnelId); exists {
+		if _, live := liveTunnel(tunnelId); live {
+			if !force {
+				tunnelsMutex.Unlock()
+				slog.WarnContext(r.Context(), "A tunnel with this id already exists", "tunnel_id", tunnelId, "status", http.StatusConflict)
+				writeJSONError(w, http.StatusConflict, "A tunnel with this id already exists. Pass 'force' to replace it.")
 				return
 			}
-			w.Write(response)
-			log.Println("Created tunnel with random ID:", tunnelId)
-		} else {
-			tunnelsMutex.Lock()
-			tunnels[r.URL.Query().Get("id")] = &Tunnel{ID: r.URL.Query().Get("id"), Content: "", SubChannels: make(map[string]string)}
-			tunnelsMutex.Unlock()
-			response, err := json.Marshal(map[string]string{"id": r.URL.Query().Get("id")})
-			if err != nil {
-				log.Println("Error creating the tunnel:", err)
-				http.Error(w, "Error creating the tunnel", http.StatusInternalServerError)
+			// Replacing a protected tunnel takes its secret, or anyone could
+			// take it over.
+			if status := existing.secretStatus(r, params); status != http.StatusOK {
+				tunnelsMutex.Unlock()
+				rejectSecret(w, r, status, tunnelId)
 				return
 			}
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(response)
-			log.Println("Created tunnel with ID:", r.URL.Query().Get("id"))
 		}
+		replaced = existing
+	}
+	tunnelsMutex.Unlock()
+
+	// The replaced tunnel goes through removeTunnel like any other, so its
+	// streams are told why they are closed instead of silently moving over.
+	if replaced != nil {
+		removeTunnel(replaced, closeReasonReplaced)
+	}
+
+	tunnelsMutex.Lock()
+	if _, exists := tunnels[tunnelId]; exists {
+		tunnelsMutex.Unlock()
+		slog.WarnContext(r.Context(), "A tunnel with this id was created concurrently", "tunnel_id", tunnelId, "status", http.StatusConflict)
+		writeJSONError(w, http.StatusConflict, "A tunnel with this id already exists.")
+		return
+	}
+	tunnel := newTunnel(tunnelId)
+	tunnel.RotateAfter = rotateAfter
+	tunnel.DefaultContent = defaultContent
+	tunnel.AutoDeleteWhenEmpty = autoDeleteWhenEmpty
+	tunnel.AllowedOrigins = allowedOrigins
+	tunnel.ExpiresAt = expiresAt
+	tunnel.SecretHash = secretHash
+	tunnel.SigningKey = signingKey
+	tunnel.HistorySize = tunnelHistorySize
+	tunnel.HistorySizes = historySizes
+	tunnel.Queue = mode == modeQueue
+	tunnel.RequestsPerMinute = requestsPerMinute
+	tunnel.Burst = burst
+	tunnels[tunnelId] = tunnel
+	saved := tunnel.persisted()
+	tunnelsMutex.Unlock()
+
+	err = saved.readContent()
+	if err == nil {
+		err = backend.SaveTunnel(saved)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save tunnel to the backend", "tunnel_id", tunnelId, "error", err, "status", http.StatusInternalServerError)
+		dropTunnel(tunnel, closeReasonDeleted)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create the tunnel")
+		return
+	}
+	// A tunnel that deletes itself when empty starts out empty, and goes
+	// away unless a client subscribes within the grace period.
+	if autoDeleteWhenEmpty && tunnelSubscribers(tunnelId) == 0 {
+		scheduleAutoDelete(tunnelId)
+	}
+
+	created := map[string]interface{}{"id": tunnelId, "urls": tunnelURLs(r, tunnelId)}
+	if !expiresAt.IsZero() {
+		created["expiresAt"] = expiresAt.UTC().Format(time.RFC3339)
+		created["ttl"] = int(ttl.Seconds())
+	}
+	writeJSON(w, r, created)
+	tunnelsCreated.Inc()
+	if randomID {
+		slog.InfoContext(r.Context(), "Created tunnel with a random ID", "tunnel_id", tunnelId)
 	} else {
-		log.Println("Method not allowed. Only POST and GET requests are allowed.")
-		http.Error(w, "Method not allowed. Only POST and GET requests are allowed.", http.StatusMethodNotAllowed)
+		slog.InfoContext(r.Context(), "Created tunnel", "tunnel_id", tunnelId)
+	}
+}
+
+// deleteTunnel removes a tunnel, or only one of its subchannels when a
+// subChannel is given, disconnecting the affected streams.
+func deleteTunnel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+		slog.WarnContext(r.Context(), "Method not allowed for deleting a tunnel", "method", r.Method, "status", http.StatusMethodNotAllowed)
+		w.Header().Set("Allow", "DELETE, POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, "Tunnels can only be deleted with DELETE or POST")
+		return
+	}
+
+	if rejectIfReadOnly(w) {
+		return
+	}
+
+	params, ok := parseTunnelParams(w, r)
+	if !ok {
+		return
+	}
+
+	if !params.checkID(w, r) {
+		return
+	}
+
+	if params.SubChannel == wildcardSubChannel {
+		slog.WarnContext(r.Context(), "The wildcard subchannel cannot be deleted", "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "The '*' subChannel cannot be deleted, delete the tunnel instead")
+		return
+	}
+
+	tunnelsMutex.Lock()
+	tunnel, exists := liveTunnel(params.ID)
+	tunnelsMutex.Unlock()
+	if !exists {
+		slog.WarnContext(r.Context(), "No tunnel with this id exists", "tunnel_id", params.ID, "status", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, "No tunnel with this id exists.")
+		return
+	}
+
+	if status := tunnel.secretStatus(r, params); status != http.StatusOK {
+		rejectSecret(w, r, status, params.ID)
+		return
+	}
+
+	if params.SubChannelGiven {
+		removeSubChannel(tunnel, params.SubChannel, closeReasonDeleted)
+		w.WriteHeader(http.StatusOK)
+		slog.InfoContext(r.Context(), "Deleted subChannel", "subchannel", params.SubChannel, "tunnel_id", params.ID)
+		return
+	}
+
+	if !removeTunnel(tunnel, closeReasonDeleted) {
+		// Replaced by a create in the meantime, which the caller did not
+		// mean to delete.
+		slog.WarnContext(r.Context(), "Tunnel was replaced before it could be deleted", "tunnel_id", params.ID, "status", http.StatusConflict)
+		writeJSONError(w, http.StatusConflict, "The tunnel was replaced while deleting it. Please try again.")
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+	slog.InfoContext(r.Context(), "Deleted tunnel", "tunnel_id", params.ID)
 }
 
-func generateRandomID(amount int) string {
-	const charset = "ABCDEFGHJKLMNPQRSTUVWXYZ123456789!@#$%&*_-+=;:,.<>/?"
+// parseSeconds parses an optional duration given in whole seconds. An empty
+// value yields zero.
+func parseSeconds(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid number of seconds: %q", value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// randomIDAttempts bounds how many random IDs createTunnel tries before
+// giving up on finding one that is not taken.
+const randomIDAttempts = 10
+
+// newRandomID generates the IDs freeRandomID tries. Tests replace it to
+// force collisions.
+var newRandomID = generateRandomID
+
+// freeRandomID returns a random tunnel ID that is not in use, or an empty
+// string if none was found. Must be called with tunnelsMutex held, so the ID
+// stays free until the tunnel is stored.
+func freeRandomID() string {
+	for attempt := 0; attempt < randomIDAttempts; attempt++ {
+		id, err := newRandomID(6)
+		if err != nil {
+			slog.Error("Failed to generate a random ID", "error", err)
+			return ""
+		}
+		if _, exists := loadTunnel(id); !exists {
+			return id
+		}
+	}
+	return ""
+}
+
+// generateRandomID returns an id of upper case letters and digits, which are
+// safe in URLs as is. Letters and digits that are easily mistaken for one
+// another, such as O and 0, are left out. Ids grant access to their tunnel,
+// so they come from crypto/rand and can't be predicted from earlier ones.
+func generateRandomID(amount int) (string, error) {
+	const charset = "ABCDEFGHJKLMNPQRSTUVWXYZ123456789"
 	b := make([]byte, amount)
 	for i := range b {
-		b[i] = charset[rand.Intn(len(charset))]
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = charset[n.Int64()]
 	}
-	return string(b)
+	return string(b), nil
 }
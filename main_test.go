@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestGenerateRandomIDIsURLSafe(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		id, err := generateRandomID(6)
+		if err != nil {
+			t.Fatalf("generateRandomID: %v", err)
+		}
+		if len(id) != 6 {
+			t.Fatalf("generateRandomID(6) = %q, want 6 characters", id)
+		}
+		if escaped := url.QueryEscape(id); escaped != id {
+			t.Fatalf("url.QueryEscape(%q) = %q, want it unchanged", id, escaped)
+		}
+		if escaped := url.PathEscape(id); escaped != id {
+			t.Fatalf("url.PathEscape(%q) = %q, want it unchanged", id, escaped)
+		}
+		if !validTunnelID(id) {
+			t.Fatalf("validTunnelID(%q) = false, want true", id)
+		}
+	}
+}
+
+// resetTunnels starts a test without tunnels or stream subscribers, and
+// removes the ones it leaves behind.
+func resetTunnels(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		tunnelsMutex.Lock()
+		tunnels = make(map[string]*Tunnel)
+		tunnelsMutex.Unlock()
+		clientsMutex.Lock()
+		clients = make(map[string]map[string][]*Subscriber)
+		clientsMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// stubRandomIDs makes newRandomID hand out ids in turn, repeating the last
+// one, and returns how many were asked for.
+func stubRandomIDs(t *testing.T, ids ...string) *int {
+	t.Helper()
+	calls := 0
+	previous := newRandomID
+	newRandomID = func(int) (string, error) {
+		id := ids[len(ids)-1]
+		if calls < len(ids) {
+			id = ids[calls]
+		}
+		calls++
+		return id, nil
+	}
+	t.Cleanup(func() { newRandomID = previous })
+	return &calls
+}
+
+func TestFreeRandomIDRetriesCollisions(t *testing.T) {
+	resetTunnels(t)
+	tunnels["TAKEN1"] = newTunnel("TAKEN1")
+	calls := stubRandomIDs(t, "TAKEN1", "FREE22")
+
+	tunnelsMutex.Lock()
+	id := freeRandomID()
+	tunnelsMutex.Unlock()
+
+	if id != "FREE22" {
+		t.Errorf("freeRandomID() = %q, want FREE22", id)
+	}
+	if *calls != 2 {
+		t.Errorf("generated %d ids, want 2", *calls)
+	}
+}
+
+func TestFreeRandomIDGivesUpAfterAttempts(t *testing.T) {
+	resetTunnels(t)
+	tunnels["TAKEN1"] = newTunnel("TAKEN1")
+	calls := stubRandomIDs(t, "TAKEN1")
+
+	tunnelsMutex.Lock()
+	id := freeRandomID()
+	tunnelsMutex.Unlock()
+
+	if id != "" {
+		t.Errorf("freeRandomID() = %q, want no id", id)
+	}
+	if *calls != randomIDAttempts {
+		t.Errorf("generated %d ids, want %d", *calls, randomIDAttempts)
+	}
+}
+
+func TestCreateRandomTunnelFailsWhenNoIDIsFree(t *testing.T) {
+	resetTunnels(t)
+	tunnels["TAKEN1"] = newTunnel("TAKEN1")
+	stubRandomIDs(t, "TAKEN1")
+
+	w := httptest.NewRecorder()
+	createTunnel(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/create", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if len(tunnels) != 1 || tunnels["TAKEN1"] == nil {
+		t.Errorf("tunnels = %v, want only the existing tunnel", tunnels)
+	}
+}
+
+// setFlag changes a flag for the duration of a test.
+func setFlag[T any](t testing.TB, flag *T, value T) {
+	t.Helper()
+	previous := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = previous })
+}
+
+// addTestTunnel stores a new tunnel for a test that started with
+// resetTunnels.
+func addTestTunnel(id string) *Tunnel {
+	tunnel := newTunnel(id)
+	tunnelsMutex.Lock()
+	tunnels[id] = tunnel
+	tunnelsMutex.Unlock()
+	return tunnel
+}
+
+// hasTunnel reports whether the tunnel is still stored.
+func hasTunnel(tunnel *Tunnel) bool {
+	tunnelsMutex.Lock()
+	defer tunnelsMutex.Unlock()
+	return tunnels[tunnel.ID] == tunnel
+}
+
+func TestOversizedBodiesAnswer413(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, &tunnelLimiters, NewRateLimiterStore(0, 0))
+	setFlag(t, maxBodySize, 64)
+	addTestTunnel("big")
+
+	oversized := `{"id": "big", "content": "` + strings.Repeat("x", 64) + `"}`
+	binary := httptest.NewRequest(http.MethodPost, "/api/v3/tunnel/send?id=big", strings.NewReader(strings.Repeat("x", 65)))
+	binary.Header.Set("Content-Type", "application/octet-stream")
+	requests := []struct {
+		name    string
+		handler http.HandlerFunc
+		request *http.Request
+	}{
+		{"send", sendToTunnel, httptest.NewRequest(http.MethodPost, "/api/v3/tunnel/send", strings.NewReader(oversized))},
+		{"binary send", sendToTunnel, binary},
+		{"batch", sendBatch, httptest.NewRequest(http.MethodPost, "/api/v3/tunnel/batch", strings.NewReader("["+oversized+"]"))},
+	}
+	for _, test := range requests {
+		w := httptest.NewRecorder()
+		test.handler(w, test.request)
+
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s answered %d, want %d", test.name, w.Code, http.StatusRequestEntityTooLarge)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%s answered with Content-Type %q, want application/json", test.name, contentType)
+		}
+		var body struct {
+			Error  string
+			Status int
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error != "The request body must not exceed 64 bytes" || body.Status != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s answered %q, want the size error", test.name, w.Body)
+		}
+	}
+
+	// A body right at the limit is still read.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/v3/tunnel/send?id=big", strings.NewReader(strings.Repeat("x", 64)))
+	r.Header.Set("Content-Type", "application/octet-stream")
+	sendToTunnel(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("body of 64 bytes answered %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+}
+
+func TestRoutesAcceptATrailingSlash(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, &ipLimiters, NewRateLimiterStore(0, 0))
+	setFlag(t, &tunnelLimiters, NewRateLimiterStore(0, 0))
+	setFlag(t, &createLimiters, NewRateLimiterStore(0, 0))
+	addTestTunnel("slash")
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	handler := withoutTrailingSlash(mux)
+
+	// Streams that stay open are left out; they share the routing.
+	routes := []string{
+		"/LICENSE",
+		"/api/v3/tunnel/create",
+		"/api/v3/tunnel/get?id=slash",
+		"/api/v3/tunnel/history?id=slash",
+		"/api/v3/tunnel/subchannels?id=slash",
+		"/api/v3/tunnel/webhook?id=slash",
+		"/api/v3/tunnel/stats?id=slash",
+		"/api/v3/tunnel/send?id=slash&content=hi",
+		"/api/v3/tunnel/batch",
+		"/api/v3/tunnel/delete?id=missing",
+		"/api/v3/tunnel/list",
+		"/api/v3/tunnel/mux/control",
+		"/api/v3/tunnel/auth-check?id=slash",
+		"/api/v3/tunnel/exists?id=slash",
+		"/api/v3/echo",
+		"/healthz",
+		"/version",
+		"/api/v3/admin/runtime",
+		"/api/v3/admin/read-only",
+		"/api/v3/admin/throughput",
+	}
+	for _, route := range routes {
+		path, query, _ := strings.Cut(route, "?")
+		statuses := make([]int, 0, 2)
+		for _, target := range []string{path + "?" + query, path + "/?" + query} {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+			if strings.Contains(w.Body.String(), "404 page not found") {
+				t.Errorf("%s is not routed", target)
+			}
+			statuses = append(statuses, w.Code)
+		}
+		if statuses[0] != statuses[1] {
+			t.Errorf("%s answered %d, and %d with a trailing slash", path, statuses[0], statuses[1])
+		}
+	}
+}
+
+func TestTrailingSlashKeepsThePostBody(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, &ipLimiters, NewRateLimiterStore(0, 0))
+	setFlag(t, &tunnelLimiters, NewRateLimiterStore(0, 0))
+	tunnel := addTestTunnel("slash")
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+
+	w := httptest.NewRecorder()
+	withoutTrailingSlash(mux).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v3/tunnel/send/", strings.NewReader(`{"id": "slash", "content": "kept"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("send with a trailing slash answered %d: %s", w.Code, w.Body)
+	}
+	tunnelsMutex.Lock()
+	defer tunnelsMutex.Unlock()
+	if got := string(tunnel.SubChannels["main"].Data); got != "kept" {
+		t.Errorf("content = %q, want the posted content", got)
+	}
+}
+
+func TestPostOnlyMutationsRejectGetCreatesAndSends(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, postOnlyMutations, true)
+	tunnel := addTestTunnel("post")
+
+	gets := map[string]func(http.ResponseWriter, *http.Request){
+		"/api/v3/tunnel/create?id=created":          createTunnel,
+		"/api/v3/tunnel/send?id=post&content=sneak": sendToTunnel,
+	}
+	for target, handler := range gets {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s answered %d, want %d", target, w.Code, http.StatusMethodNotAllowed)
+		}
+	}
+	if len(tunnels) != 1 || len(tunnel.Sequences) != 0 {
+		t.Fatal("a GET mutation went through")
+	}
+
+	w := httptest.NewRecorder()
+	createTunnel(w, httptest.NewRequest(http.MethodPost, "/api/v3/tunnel/create", strings.NewReader(`{"id": "created"}`)))
+	if w.Code != http.StatusOK {
+		t.Errorf("POST create answered %d: %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	sendToTunnel(w, httptest.NewRequest(http.MethodPost, "/api/v3/tunnel/send", strings.NewReader(`{"id": "post", "content": "posted"}`)))
+	if w.Code != http.StatusOK {
+		t.Errorf("POST send answered %d: %s", w.Code, w.Body)
+	}
+
+	// Reads stay available over GET.
+	w = httptest.NewRecorder()
+	getTunnelContent(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/get?id=post&raw=true", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "posted" {
+		t.Errorf("GET get answered %d %q, want the posted content", w.Code, w.Body)
+	}
+	server := httptest.NewServer(http.HandlerFunc(streamTunnelContent))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "?id=post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET stream answered %d", resp.StatusCode)
+	}
+}
+
+func TestGetMutationsAreAcceptedByDefault(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, postOnlyMutations, false)
+
+	w := httptest.NewRecorder()
+	createTunnel(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/create?id=get", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET create answered %d: %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	sendToTunnel(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/send?id=get&content=hi", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET send answered %d: %s", w.Code, w.Body)
+	}
+	for _, method := range []string{http.MethodPut, http.MethodPatch} {
+		w := httptest.NewRecorder()
+		sendToTunnel(w, httptest.NewRequest(method, "/api/v3/tunnel/send?id=get&content=hi", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s send answered %d, want %d", method, w.Code, http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func TestNormalizeLineEndings(t *testing.T) {
+	tests := map[string]string{
+		"one\r\ntwo\r\n":  "one\ntwo\n",
+		"one\rtwo":        "one\ntwo",
+		"one\r\r\ntwo":    "one\n\ntwo",
+		"one\ntwo":        "one\ntwo",
+		"no line ending":  "no line ending",
+		"\r\n\r\n":        "\n\n",
+		"mixed\r\nx\ry\n": "mixed\nx\ny\n",
+	}
+	for content, want := range tests {
+		if got := normalizeLineEndings(content); got != want {
+			t.Errorf("normalizeLineEndings(%q) = %q, want %q", content, got, want)
+		}
+	}
+}
+
+func TestSendNormalizesCRLFContent(t *testing.T) {
+	for _, normalize := range []bool{true, false} {
+		resetTunnels(t)
+		setFlag(t, normalizeNewlines, normalize)
+		tunnel := addTestTunnel("crlf")
+		subscriber := newSubscriber()
+		if err := addSubscriber("crlf", "main", subscriber); err != nil {
+			t.Fatal(err)
+		}
+
+		sent := "line one\r\nline two\r\n"
+		want := sent
+		if normalize {
+			want = "line one\nline two\n"
+		}
+		w := httptest.NewRecorder()
+		sendToTunnel(w, httptest.NewRequest(http.MethodPost, "/api/v3/tunnel/send", strings.NewReader(`{"id": "crlf", "content": "line one\r\nline two\r\n"}`)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("send answered %d: %s", w.Code, w.Body)
+		}
+
+		if stored := string(tunnel.SubChannels["main"].Data); stored != want {
+			t.Errorf("normalize %t: stored %q, want %q", normalize, stored, want)
+		}
+		if msg := <-subscriber.next(); msg.Content != want {
+			t.Errorf("normalize %t: streamed %q, want %q", normalize, msg.Content, want)
+		}
+	}
+}
+
+func TestNormalizingLeavesBinaryContentAlone(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, normalizeNewlines, true)
+	tunnel := addTestTunnel("crlf")
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v3/tunnel/send?id=crlf", strings.NewReader("\x00\r\n\x01"))
+	r.Header.Set("Content-Type", "application/octet-stream")
+	w := httptest.NewRecorder()
+	sendToTunnel(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("send answered %d: %s", w.Code, w.Body)
+	}
+	if stored := string(tunnel.SubChannels["main"].Data); stored != "\x00\r\n\x01" {
+		t.Errorf("stored %q, want the bytes as sent", stored)
+	}
+}
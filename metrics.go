@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var publicMetrics = flag.Bool("metrics-public", false, "Serve /metrics without the admin key, for scraping on a private network")
+var metricsMaxTunnels = flag.Int("metrics-max-tunnels", 20, "Report per-tunnel message counters and throughput for this many of the busiest tunnels (0 disables)")
+
+var (
+	tunnelsCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "txttunnel_tunnels_created_total",
+		Help: "Tunnels created.",
+	})
+	messagesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "txttunnel_messages_sent_total",
+		Help: "Messages sent to tunnels, comments included.",
+	})
+	bytesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "txttunnel_bytes_sent_total",
+		Help: "Bytes of content sent to tunnels.",
+	})
+	activeStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "txttunnel_streams",
+		Help: "Open SSE connections, multiplexed streams included.",
+	})
+	rateLimitRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "txttunnel_rate_limit_rejections_total",
+		Help: "Requests rejected by a rate limit, by the bucket that ran out.",
+	}, []string{"scope"})
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "txttunnel_webhook_deliveries_total",
+		Help: "Webhook deliveries, by whether they were delivered or failed after all retries.",
+	}, []string{"result"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "txttunnel_http_request_duration_seconds",
+		Help:    "Time taken to handle requests, by the route that handled them. Streams and polls observe how long they were open.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler"})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "txttunnel_tunnels",
+		Help: "Tunnels held by this instance.",
+	}, func() float64 {
+		tunnelsMutex.Lock()
+		defer tunnelsMutex.Unlock()
+		return float64(len(tunnels))
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "txttunnel_subscribers",
+		Help: "Stream subscriptions across all tunnels.",
+	}, func() float64 {
+		return float64(countSubscribers())
+	})
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "txttunnel_dropped_messages_total",
+		Help: "Messages dropped for slow subscribers.",
+	}, func() float64 {
+		return float64(droppedMessages.Load())
+	})
+	prometheus.MustRegister(tunnelThroughputCollector{})
+}
+
+var (
+	tunnelMessagesSentDesc = prometheus.NewDesc("txttunnel_tunnel_messages_sent_total", "Messages sent to each of the busiest tunnels, comments included.", []string{"tunnel"}, nil)
+	tunnelBytesSentDesc    = prometheus.NewDesc("txttunnel_tunnel_bytes_sent_total", "Bytes of content sent to each of the busiest tunnels.", []string{"tunnel"}, nil)
+	tunnelMessageRateDesc  = prometheus.NewDesc("txttunnel_tunnel_messages_per_second", "Messages per second sent to each of the busiest tunnels over the last minute.", []string{"tunnel"}, nil)
+	tunnelByteRateDesc     = prometheus.NewDesc("txttunnel_tunnel_bytes_per_second", "Bytes per second sent to each of the busiest tunnels over the last minute.", []string{"tunnel"}, nil)
+)
+
+// metricsLabelKey keys the labels tunnels are reported under. Tunnel ids
+// grant access to their tunnel, so they must not be readable from the
+// metrics, which may be served without a key. Short ids are quick to
+// enumerate, so the label is keyed rather than a plain hash.
+var metricsLabelKey = newMetricsLabelKey()
+
+func newMetricsLabelKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		fatal("Failed to generate the metrics label key", "error", err)
+	}
+	return key
+}
+
+// tunnelMetricsLabel returns the label a tunnel's metrics are reported
+// under. It stays the same for as long as the server runs, and the admin
+// throughput endpoint lists it next to the id.
+func tunnelMetricsLabel(tunnelId string) string {
+	mac := hmac.New(sha256.New, metricsLabelKey)
+	mac.Write([]byte(tunnelId))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// tunnelThroughputCollector reports the counters and throughput of the
+// busiest tunnels, at most -metrics-max-tunnels of them, so the number of
+// series stays bounded however many tunnels there are. A tunnel's counters
+// continue where they left off when it gets busy again. Tunnels are labelled
+// with tunnelMetricsLabel rather than their id.
+type tunnelThroughputCollector struct{}
+
+func (tunnelThroughputCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tunnelMessagesSentDesc
+	ch <- tunnelBytesSentDesc
+	ch <- tunnelMessageRateDesc
+	ch <- tunnelByteRateDesc
+}
+
+func (tunnelThroughputCollector) Collect(ch chan<- prometheus.Metric) {
+	if *metricsMaxTunnels <= 0 {
+		return
+	}
+	rates := tunnelThroughputs("", time.Now())
+	if len(rates) > *metricsMaxTunnels {
+		rates = rates[:*metricsMaxTunnels]
+	}
+	for _, rate := range rates {
+		ch <- prometheus.MustNewConstMetric(tunnelMessagesSentDesc, prometheus.CounterValue, float64(rate.messagesSent), rate.MetricsLabel)
+		ch <- prometheus.MustNewConstMetric(tunnelBytesSentDesc, prometheus.CounterValue, float64(rate.bytesSent), rate.MetricsLabel)
+		ch <- prometheus.MustNewConstMetric(tunnelMessageRateDesc, prometheus.GaugeValue, rate.MessagesPerSecond, rate.MetricsLabel)
+		ch <- prometheus.MustNewConstMetric(tunnelByteRateDesc, prometheus.GaugeValue, rate.BytesPerSecond, rate.MetricsLabel)
+	}
+}
+
+// metricsHandler serves the default Prometheus registry, behind the admin
+// key unless -metrics-public is set.
+func metricsHandler() http.HandlerFunc {
+	handler := promhttp.Handler().ServeHTTP
+	if *publicMetrics {
+		return handler
+	}
+	return withAdmin(handler)
+}
+
+// withMetrics records the duration of every request, labelled with the
+// pattern of the route that handles it so unknown paths share one label.
+func withMetrics(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		start := time.Now()
+		mux.ServeHTTP(w, r)
+		requestDuration.WithLabelValues(pattern).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTunnelMetricsReportTheBusiestTunnels(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, metricsMaxTunnels, 2)
+
+	now := time.Now()
+	for id, messages := range map[string]int{"quiet": 1, "busy": 5, "busier": 9} {
+		tunnel := addTestTunnel(id)
+		tunnelsMutex.Lock()
+		for i := 0; i < messages; i++ {
+			tunnel.recordMessage(now, 10)
+		}
+		tunnelsMutex.Unlock()
+	}
+
+	if count := testutil.CollectAndCount(tunnelThroughputCollector{}); count != 8 {
+		t.Fatalf("collected %d series, want 4 for each of the 2 busiest tunnels", count)
+	}
+	expected := fmt.Sprintf(`
+# HELP txttunnel_tunnel_messages_sent_total Messages sent to each of the busiest tunnels, comments included.
+# TYPE txttunnel_tunnel_messages_sent_total counter
+txttunnel_tunnel_messages_sent_total{tunnel=%[1]q} 9
+txttunnel_tunnel_messages_sent_total{tunnel=%[2]q} 5
+# HELP txttunnel_tunnel_bytes_sent_total Bytes of content sent to each of the busiest tunnels.
+# TYPE txttunnel_tunnel_bytes_sent_total counter
+txttunnel_tunnel_bytes_sent_total{tunnel=%[1]q} 90
+txttunnel_tunnel_bytes_sent_total{tunnel=%[2]q} 50
+`, tunnelMetricsLabel("busier"), tunnelMetricsLabel("busy"))
+	err := testutil.CollectAndCompare(tunnelThroughputCollector{}, strings.NewReader(expected), "txttunnel_tunnel_messages_sent_total", "txttunnel_tunnel_bytes_sent_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTunnelMetricsCanBeTurnedOff(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, metricsMaxTunnels, 0)
+
+	tunnel := addTestTunnel("busy")
+	tunnelsMutex.Lock()
+	tunnel.recordMessage(time.Now(), 10)
+	tunnelsMutex.Unlock()
+
+	if count := testutil.CollectAndCount(tunnelThroughputCollector{}); count != 0 {
+		t.Fatalf("collected %d series with -metrics-max-tunnels 0, want none", count)
+	}
+}
+
+func TestPublicMetricsDoNotRevealTunnelIDs(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, publicMetrics, true)
+	setFlag(t, metricsMaxTunnels, 20)
+
+	ids := []string{"K7QX2M", "private-tunnel"}
+	for _, id := range ids {
+		tunnel := addTestTunnel(id)
+		tunnelsMutex.Lock()
+		tunnel.recordMessage(time.Now(), 10)
+		tunnelsMutex.Unlock()
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler()(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	body, _ := io.ReadAll(w.Body)
+	for _, id := range ids {
+		if strings.Contains(string(body), id) {
+			t.Errorf("metrics contain the tunnel id %q", id)
+		}
+		label := fmt.Sprintf("txttunnel_tunnel_messages_sent_total{tunnel=%q} 1", tunnelMetricsLabel(id))
+		if !strings.Contains(string(body), label) {
+			t.Errorf("metrics lack %s", label)
+		}
+	}
+}
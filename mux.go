@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// muxKey identifies one (tunnel, subchannel) subscription of a multiplexed
+// stream.
+type muxKey struct {
+	TunnelID   string
+	SubChannel string
+}
+
+type muxEvent struct {
+	TunnelID string
+	Message  StreamMessage
+	// ClosedReason is set instead of Message when the tunnel was removed.
+	ClosedReason string
+}
+
+type muxSubscription struct {
+	subscriber *Subscriber
+	stop       chan struct{}
+}
+
+// muxSession is a single stream connection carrying any number of tunnel
+// subscriptions, which are added and removed through the control endpoint.
+type muxSession struct {
+	events        chan muxEvent
+	done          chan struct{}
+	mutex         sync.Mutex
+	subscriptions map[muxKey]*muxSubscription
+}
+
+var muxSessions = make(map[string]*muxSession)
+var muxSessionsMutex = &sync.Mutex{}
+
+// subscribe registers the session in clients like a regular stream would and
+// forwards everything it receives to the session's connection.
+func (s *muxSession) subscribe(key muxKey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	if _, exists := s.subscriptions[key]; exists {
+		return nil
+	}
+
+	subscription := &muxSubscription{subscriber: newSubscriber(), stop: make(chan struct{})}
+	if err := addSubscriber(key.TunnelID, key.SubChannel, subscription.subscriber); err != nil {
+		return err
+	}
+	s.subscriptions[key] = subscription
+
+	go s.forward(key, subscription)
+	return nil
+}
+
+func (s *muxSession) forward(key muxKey, subscription *muxSubscription) {
+	for {
+		select {
+		case msg, ok := <-subscription.subscriber.next():
+			if !ok {
+				// The tunnel was removed and the subscription with it.
+				s.drop(key, subscription)
+				select {
+				case s.events <- muxEvent{TunnelID: key.TunnelID, Message: StreamMessage{SubChannel: key.SubChannel}, ClosedReason: subscription.subscriber.closeReason}:
+				case <-s.done:
+				}
+				return
+			}
+			// Once the connection is gone messages are discarded, so a
+			// concurrent broadcast never waits on a session being torn down.
+			select {
+			case s.events <- muxEvent{TunnelID: key.TunnelID, Message: msg}:
+			case <-s.done:
+			}
+		case <-subscription.subscriber.Evicted:
+			s.drop(key, subscription)
+			return
+		case <-subscription.stop:
+			return
+		}
+	}
+}
+
+// drop forgets a subscription that is already gone from clients.
+func (s *muxSession) drop(key muxKey, subscription *muxSubscription) {
+	s.mutex.Lock()
+	if s.subscriptions[key] == subscription {
+		delete(s.subscriptions, key)
+	}
+	s.mutex.Unlock()
+}
+
+func (s *muxSession) unsubscribe(key muxKey) {
+	s.mutex.Lock()
+	subscription, exists := s.subscriptions[key]
+	delete(s.subscriptions, key)
+	s.mutex.Unlock()
+	if !exists {
+		return
+	}
+
+	removeSubscriber(key.TunnelID, key.SubChannel, subscription.subscriber)
+	close(subscription.stop)
+}
+
+func (s *muxSession) close() {
+	close(s.done)
+	s.mutex.Lock()
+	keys := make([]muxKey, 0, len(s.subscriptions))
+	for key := range s.subscriptions {
+		keys = append(keys, key)
+	}
+	s.mutex.Unlock()
+	for _, key := range keys {
+		s.unsubscribe(key)
+	}
+}
+
+// streamMultiplexed opens a stream that starts out with no subscriptions. The
+// first event carries the session id used with the control endpoint, and
+// every delivered message is tagged with its tunnel and subchannel.
+func streamMultiplexed(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := streamFlusher(w, r)
+	if !ok {
+		return
+	}
+
+	if !acquireConnection() {
+		rejectTooManyConnections(w, r)
+		return
+	}
+	defer releaseConnection()
+
+	sessionId, err := generateRandomID(16)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to generate a session id", "error", err, "status", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to open the stream. Please try again.")
+		return
+	}
+	session := &muxSession{
+		events:        make(chan muxEvent),
+		done:          make(chan struct{}),
+		subscriptions: make(map[muxKey]*muxSubscription),
+	}
+	muxSessionsMutex.Lock()
+	muxSessions[sessionId] = session
+	muxSessionsMutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	writeRetry(w)
+	sessionJSON, err := json.Marshal(map[string]string{"session": sessionId})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to encode session", "error", err)
+	} else {
+		fmt.Fprintf(w, "event: session\ndata: %s\n\n", sessionJSON)
+	}
+	flusher.Flush()
+
+	slog.InfoContext(r.Context(), "Client connected to multiplexed stream", "session_id", sessionId)
+	activeStreams.Inc()
+	defer activeStreams.Dec()
+
+	var keepalive <-chan time.Time
+	if *heartbeatInterval > 0 {
+		heartbeatTicker := time.NewTicker(*heartbeatInterval)
+		defer heartbeatTicker.Stop()
+		keepalive = heartbeatTicker.C
+	}
+
+	for {
+		select {
+		case <-keepalive:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				muxSessionsMutex.Lock()
+				delete(muxSessions, sessionId)
+				muxSessionsMutex.Unlock()
+				session.close()
+				slog.InfoContext(r.Context(), "Keepalive failed, closing multiplexed stream", "session_id", sessionId, "error", err)
+				return
+			}
+			flusher.Flush()
+		case event := <-session.events:
+			if event.ClosedReason != "" {
+				closed, err := json.Marshal(map[string]string{
+					"id":         event.TunnelID,
+					"subChannel": event.Message.SubChannel,
+					"reason":     event.ClosedReason,
+				})
+				if err != nil {
+					slog.ErrorContext(r.Context(), "Failed to encode closed event", "error", err)
+					continue
+				}
+				fmt.Fprintf(w, "event: closed\ndata: %s\n\n", closed)
+			} else if event.Message.Comment {
+				writeStreamMessage(w, event.Message, false, false)
+			} else {
+				message := map[string]interface{}{
+					"id":         event.TunnelID,
+					"subChannel": event.Message.SubChannel,
+					"content":    streamContent(event.Message.Content, event.Message.Binary),
+					"sequence":   event.Message.Sequence,
+				}
+				if event.Message.Binary {
+					message["encoding"] = base64Encoding
+				}
+				if event.Message.ContentType != "" {
+					message["contentType"] = event.Message.ContentType
+				}
+				encoded, err := json.Marshal(message)
+				if err != nil {
+					slog.ErrorContext(r.Context(), "Failed to encode message", "error", err)
+					continue
+				}
+				fmt.Fprintf(w, "event: message\ndata: %s\n\n", encoded)
+			}
+			flusher.Flush()
+		case <-shuttingDown:
+			muxSessionsMutex.Lock()
+			delete(muxSessions, sessionId)
+			muxSessionsMutex.Unlock()
+			session.close()
+			fmt.Fprint(w, "event: reconnect\ndata: shutdown\n\n")
+			flusher.Flush()
+			slog.InfoContext(r.Context(), "Closed multiplexed stream for shutdown", "session_id", sessionId)
+			return
+		case <-r.Context().Done():
+			muxSessionsMutex.Lock()
+			delete(muxSessions, sessionId)
+			muxSessionsMutex.Unlock()
+			session.close()
+			slog.InfoContext(r.Context(), "Client disconnected from multiplexed stream", "session_id", sessionId)
+			return
+		}
+	}
+}
+
+// controlMultiplexed subscribes or unsubscribes a multiplexed stream to a
+// tunnel subchannel.
+func controlMultiplexed(w http.ResponseWriter, r *http.Request) {
+	params, ok := parseTunnelParams(w, r)
+	if !ok {
+		return
+	}
+	sessionId := params.Get("session")
+	action := params.Get("action")
+
+	if sessionId == "" || params.ID == "" || (action != "subscribe" && action != "unsubscribe") {
+		slog.WarnContext(r.Context(), "The request must contain a valid 'session', 'action' and 'id' parameter or field", "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "The request must contain a valid 'session', 'action' ('subscribe' or 'unsubscribe') and 'id' parameter or field")
+		return
+	}
+
+	if !params.checkSubChannel(w, r) {
+		return
+	}
+
+	muxSessionsMutex.Lock()
+	session, exists := muxSessions[sessionId]
+	muxSessionsMutex.Unlock()
+	if !exists {
+		slog.WarnContext(r.Context(), "No multiplexed stream with this session exists", "session_id", sessionId, "status", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, "No multiplexed stream with this session exists.")
+		return
+	}
+
+	key := muxKey{TunnelID: params.ID, SubChannel: params.SubChannel}
+	if action == "unsubscribe" {
+		session.unsubscribe(key)
+		w.WriteHeader(http.StatusOK)
+		slog.InfoContext(r.Context(), "Unsubscribed multiplexed stream", "session_id", sessionId, "tunnel_id", key.TunnelID, "subchannel", key.SubChannel)
+		return
+	}
+
+	tunnelsMutex.Lock()
+	tunnel, exists := liveTunnel(key.TunnelID)
+	tunnelsMutex.Unlock()
+	if !exists {
+		slog.WarnContext(r.Context(), "No tunnel with this id exists", "tunnel_id", key.TunnelID, "status", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, "No tunnel with this id exists.")
+		return
+	}
+
+	if status := tunnel.secretStatus(r, params); status != http.StatusOK {
+		rejectSecret(w, r, status, key.TunnelID)
+		return
+	}
+	tunnelsMutex.Lock()
+	tunnel.touch()
+	tunnelsMutex.Unlock()
+
+	if err := session.subscribe(key); err != nil {
+		slog.WarnContext(r.Context(), "Too many wildcard subscribers", "tunnel_id", key.TunnelID, "status", http.StatusTooManyRequests)
+		writeJSONError(w, http.StatusTooManyRequests, "Too many subscribers to all subchannels. Please try again later.")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	slog.InfoContext(r.Context(), "Subscribed multiplexed stream", "session_id", sessionId, "tunnel_id", key.TunnelID, "subchannel", key.SubChannel)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fieldAlias is an operator-declared name for the canonical `id`,
+// `subChannel` or `content` field. See -field-alias.
+type fieldAlias struct {
+	alias     string
+	canonical string
+}
+
+// fieldAliases are the declared aliases, in the order of -field-alias, which
+// is the order they are tried in.
+var fieldAliases []fieldAlias
+
+var requireSubChannel = flag.Bool("require-subchannel", false, "Reject requests that name no subchannel instead of defaulting to main")
+
+// TunnelParams holds the parameters shared by the tunnel endpoints, gathered
+// from the query string and, for POST requests, the JSON body.
+type TunnelParams struct {
+	ID         string
+	SubChannel string
+	// SubChannelGiven is false when SubChannel is only the default.
+	SubChannelGiven bool
+	Content         string
+	// RawContent is true when Content is the body of an
+	// application/octet-stream request rather than a field.
+	RawContent bool
+	Fields     map[string]string
+}
+
+// Get returns a raw request parameter, such as an endpoint specific option.
+func (p TunnelParams) Get(name string) string {
+	return p.Fields[name]
+}
+
+// parseTunnelParams collects the request parameters, resolving `id` and
+// `subChannel` in any casing and defaulting the subchannel to `main` unless
+// -require-subchannel is set. Body fields
+// take precedence over query parameters, and both over the `X-Subchannel`
+// header. The body of an application/octet-stream request is taken as the
+// content as is, leaving the query string for the other parameters. On
+// failure it writes the error response itself and returns false.
+func parseTunnelParams(w http.ResponseWriter, r *http.Request) (TunnelParams, bool) {
+	fields := queryFields(r)
+
+	rawContent := false
+	if r.Method == http.MethodPost {
+		requestBody, ok := readRequestBody(w, r)
+		if !ok {
+			return TunnelParams{}, false
+		}
+
+		if isOctetStream(r) {
+			fields["content"] = string(requestBody)
+			rawContent = true
+		} else {
+			// A malformed body is the client's mistake, not a server error.
+			if err := addBodyFields(fields, requestBody); err != nil {
+				slog.WarnContext(r.Context(), "Failed to parse the request body", "error", err, "status", http.StatusBadRequest)
+				message := "The request body must be a JSON object"
+				var syntaxError *json.SyntaxError
+				if errors.As(err, &syntaxError) {
+					message = fmt.Sprintf("The request body is not valid JSON: %s", err)
+				}
+				writeJSONError(w, http.StatusBadRequest, message)
+				return TunnelParams{}, false
+			}
+		}
+	}
+	resolveFieldAliases(fields)
+	return newTunnelParams(r, fields, rawContent), true
+}
+
+// newTunnelParams builds the parameters from the resolved fields of a
+// request.
+func newTunnelParams(r *http.Request, fields map[string]string, rawContent bool) TunnelParams {
+	defaultSubChannel := "main"
+	if *requireSubChannel {
+		defaultSubChannel = ""
+	}
+
+	subChannel := firstNonEmpty(fields["subChannel"], r.Header.Get("X-Subchannel"))
+	return TunnelParams{
+		ID:              fields["id"],
+		SubChannel:      firstNonEmpty(subChannel, defaultSubChannel),
+		SubChannelGiven: subChannel != "",
+		Content:         fields["content"],
+		RawContent:      rawContent,
+		Fields:          fields,
+	}
+}
+
+// queryFields returns the first value of each query parameter.
+func queryFields(r *http.Request) map[string]string {
+	fields := make(map[string]string)
+	for name, values := range r.URL.Query() {
+		if len(values) > 0 {
+			fields[name] = values[0]
+		}
+	}
+	return fields
+}
+
+// addBodyFields adds the fields of a JSON object body to fields, replacing
+// query parameters of the same name. An empty body adds nothing, so a POST
+// can pass everything in the query string.
+func addBodyFields(fields map[string]string, body []byte) error {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	var requestBodyJSON map[string]interface{}
+	if err := json.Unmarshal(body, &requestBodyJSON); err != nil {
+		return err
+	}
+	for name, value := range requestBodyJSON {
+		fields[name] = fieldString(value)
+	}
+	return nil
+}
+
+// canonicalFields are the fields whose names are matched case-insensitively,
+// so `subchannel`, `SubChannel` and `subChannel` all name the same one.
+var canonicalFields = []string{"id", "subChannel"}
+
+// resolveFieldAliases copies `id` and `subChannel` given in another casing,
+// and then the fields named by -field-alias, to their canonical names, unless
+// those are set already. When several casings are given, the canonical one
+// wins, then the first in sort order. When several aliases of a field are
+// given, the one declared first wins.
+func resolveFieldAliases(fields map[string]string) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, canonical := range canonicalFields {
+		if fields[canonical] != "" {
+			continue
+		}
+		for _, name := range names {
+			if strings.EqualFold(name, canonical) && fields[name] != "" {
+				fields[canonical] = fields[name]
+				break
+			}
+		}
+	}
+
+	for _, alias := range fieldAliases {
+		if fields[alias.canonical] == "" && fields[alias.alias] != "" {
+			fields[alias.canonical] = fields[alias.alias]
+		}
+	}
+}
+
+// checkID writes a 400 response and returns false if the request names no
+// tunnel.
+func (p TunnelParams) checkID(w http.ResponseWriter, r *http.Request) bool {
+	if p.ID != "" {
+		return true
+	}
+	slog.WarnContext(r.Context(), "The request must contain a valid 'id' parameter or field", "status", http.StatusBadRequest)
+	writeJSONError(w, http.StatusBadRequest, "The request must contain a valid 'id' parameter or field")
+	return false
+}
+
+// checkSubChannel writes a 400 response and returns false if the request
+// names no subchannel, which only happens with -require-subchannel.
+func (p TunnelParams) checkSubChannel(w http.ResponseWriter, r *http.Request) bool {
+	if p.SubChannel != "" {
+		return true
+	}
+	slog.WarnContext(r.Context(), "The request must contain a valid 'subChannel' parameter or field", "status", http.StatusBadRequest)
+	writeJSONError(w, http.StatusBadRequest, "The request must contain a valid 'subChannel' parameter or field")
+	return false
+}
+
+// parseFieldAliases parses a comma separated list of alias=canonical pairs,
+// such as "channel=subChannel,data=content".
+func parseFieldAliases(value string) ([]fieldAlias, error) {
+	var aliases []fieldAlias
+	declared := make(map[string]bool)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		alias, canonical, found := strings.Cut(pair, "=")
+		alias = strings.TrimSpace(alias)
+		canonical = strings.TrimSpace(canonical)
+		if !found || alias == "" {
+			return nil, fmt.Errorf("invalid field alias %q, expected alias=field", pair)
+		}
+		if canonical != "id" && canonical != "subChannel" && canonical != "content" {
+			return nil, fmt.Errorf("invalid field alias %q, the field must be one of id, subChannel or content", pair)
+		}
+		if declared[alias] {
+			return nil, fmt.Errorf("invalid field alias %q, %s is declared twice", pair, alias)
+		}
+		declared[alias] = true
+		aliases = append(aliases, fieldAlias{alias: alias, canonical: canonical})
+	}
+	return aliases, nil
+}
+
+// fieldString flattens a decoded JSON value so `"consume": true` and
+// `"consume": "true"` are treated the same.
+func fieldString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(encoded)
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
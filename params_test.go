@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subChannelCasings are the names a subchannel can be given by.
+var subChannelCasings = []string{"subChannel", "subchannel", "SubChannel", "SUBCHANNEL"}
+
+func TestSubChannelCasingsReachTheSameSubChannel(t *testing.T) {
+	resetTunnels(t)
+	addTestTunnel("case")
+
+	for _, sendName := range subChannelCasings {
+		for _, getName := range subChannelCasings {
+			content := sendName + "-" + getName
+			w := httptest.NewRecorder()
+			sendToTunnel(w, httptest.NewRequest(http.MethodPost, "/api/v3/tunnel/send", strings.NewReader(`{"id": "case", "`+sendName+`": "room", "content": "`+content+`"}`)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("send with %s answered %d: %s", sendName, w.Code, w.Body)
+			}
+
+			w = httptest.NewRecorder()
+			getTunnelContent(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/get?raw=true&id=case&"+getName+"=room", nil))
+			if got := w.Body.String(); got != content {
+				t.Errorf("sent with %s, got with %s: %q, want %q", sendName, getName, got, content)
+			}
+		}
+	}
+
+	tunnelsMutex.Lock()
+	defer tunnelsMutex.Unlock()
+	if _, exists := tunnels["case"].SubChannels["main"]; exists {
+		t.Error("a casing fell back to the main subchannel")
+	}
+}
+
+func TestSubChannelCasingsStreamTheSameSubChannel(t *testing.T) {
+	resetTunnels(t)
+	addTestTunnel("case")
+	server := httptest.NewServer(http.HandlerFunc(streamTunnelContent))
+	defer server.Close()
+
+	for _, streamName := range subChannelCasings {
+		for _, sendName := range subChannelCasings {
+			resp, err := http.Get(server.URL + "?id=case&" + streamName + "=room")
+			if err != nil {
+				t.Fatal(err)
+			}
+			waitForSubscribers(t, "case", 1)
+
+			content := streamName + "-" + sendName
+			w := httptest.NewRecorder()
+			sendToTunnel(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/send?id=case&"+sendName+"=room&content="+content, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("send with %s answered %d: %s", sendName, w.Code, w.Body)
+			}
+
+			if got := receiveData(t, streamData(resp.Body)); got != content {
+				t.Errorf("streamed with %s, sent with %s: %q, want %q", streamName, sendName, got, content)
+			}
+			resp.Body.Close()
+			waitForSubscribers(t, "case", 0)
+		}
+	}
+}
+
+// waitForSubscribers waits until a tunnel has the given number of stream
+// subscribers.
+func waitForSubscribers(t *testing.T, tunnelId string, subscribers int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for tunnelSubscribers(tunnelId) != subscribers {
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel %s has %d subscribers, want %d", tunnelId, tunnelSubscribers(tunnelId), subscribers)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMalformedJSONBodiesAnswer400(t *testing.T) {
+	resetTunnels(t)
+	addTestTunnel("json")
+
+	handlers := map[string]http.HandlerFunc{
+		"create": createTunnel,
+		"send":   sendToTunnel,
+		"get":    getTunnelContent,
+		"delete": deleteTunnel,
+	}
+	bodies := []struct {
+		body  string
+		error string
+	}{
+		{`{"id": "json" "content": "hi"}`, "The request body is not valid JSON: invalid character '\"' after object key:value pair"},
+		{`{"id": "json",`, "The request body is not valid JSON: unexpected end of JSON input"},
+		{`["json"]`, "The request body must be a JSON object"},
+		{`"json"`, "The request body must be a JSON object"},
+		{`42`, "The request body must be a JSON object"},
+	}
+	for name, handler := range handlers {
+		for _, test := range bodies {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodPost, "/api/v3/tunnel/"+name, strings.NewReader(test.body)))
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s with %s answered %d, want %d", name, test.body, w.Code, http.StatusBadRequest)
+			}
+			var body struct{ Error string }
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error != test.error {
+				t.Errorf("%s with %s answered %q, want %q", name, test.body, body.Error, test.error)
+			}
+		}
+	}
+	if _, exists := tunnels["json"]; !exists {
+		t.Error("a malformed delete removed the tunnel")
+	}
+}
+
+func TestSubChannelHeaderRanksBelowQueryAndBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		want   string
+	}{
+		{"header only", http.MethodGet, "/?id=hdr", "", "from-header"},
+		{"query wins", http.MethodGet, "/?id=hdr&subChannel=from-query", "", "from-query"},
+		{"body wins", http.MethodPost, "/", `{"id": "hdr", "subChannel": "from-body"}`, "from-body"},
+		{"header with body", http.MethodPost, "/", `{"id": "hdr"}`, "from-header"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+		r.Header.Set("X-Subchannel", "from-header")
+		params, ok := parseTunnelParams(httptest.NewRecorder(), r)
+		if !ok {
+			t.Fatalf("%s: parseTunnelParams failed", test.name)
+		}
+		if params.SubChannel != test.want || !params.SubChannelGiven {
+			t.Errorf("%s: subchannel = %q (given %t), want %q", test.name, params.SubChannel, params.SubChannelGiven, test.want)
+		}
+	}
+}
+
+func TestSubChannelHeaderSelectsTheSubChannel(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, requireSubChannel, true)
+	addTestTunnel("hdr")
+
+	send := httptest.NewRequest(http.MethodPost, "/api/v3/tunnel/send", strings.NewReader(`{"id": "hdr", "content": "via header"}`))
+	send.Header.Set("X-Subchannel", "proxied")
+	w := httptest.NewRecorder()
+	sendToTunnel(w, send)
+	if w.Code != http.StatusOK {
+		t.Fatalf("send answered %d: %s", w.Code, w.Body)
+	}
+
+	get := httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/get?id=hdr&raw=true", nil)
+	get.Header.Set("X-Subchannel", "proxied")
+	w = httptest.NewRecorder()
+	getTunnelContent(w, get)
+	if w.Code != http.StatusOK || w.Body.String() != "via header" {
+		t.Errorf("get answered %d %q, want the content sent through the header", w.Code, w.Body)
+	}
+}
+
+func TestRequireSubChannelRejectsRequestsWithoutOne(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, requireSubChannel, true)
+	tunnel := addTestTunnel("req")
+
+	handlers := map[string]http.HandlerFunc{
+		"/api/v3/tunnel/send?id=req&content=hi": sendToTunnel,
+		"/api/v3/tunnel/get?id=req":             getTunnelContent,
+		"/api/v3/tunnel/stream?id=req":          streamTunnelContent,
+	}
+	for target, handler := range handlers {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "must contain a valid 'subChannel'") {
+			t.Errorf("%s answered %d %s, want 400 asking for a subChannel", target, w.Code, w.Body)
+		}
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, target+"&subChannel=main&raw=true", nil).WithContext(canceledContext()))
+		if w.Code == http.StatusBadRequest {
+			t.Errorf("%s with subChannel=main answered %d: %s", target, w.Code, w.Body)
+		}
+	}
+	if _, exists := tunnel.SubChannels[""]; exists {
+		t.Error("content was stored without a subchannel")
+	}
+}
+
+func TestSubChannelDefaultsToMain(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, requireSubChannel, false)
+	addTestTunnel("req")
+
+	w := httptest.NewRecorder()
+	sendToTunnel(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/send?id=req&content=hi", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("send answered %d: %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	getTunnelContent(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/get?id=req&subChannel=main&raw=true", nil))
+	if w.Body.String() != "hi" {
+		t.Errorf("main holds %q, want the content sent without a subchannel", w.Body)
+	}
+}
+
+// canceledContext is the context of a client that is already gone, so
+// streams given it return right away.
+func canceledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+func TestFieldAliasesApplyInDeclarationOrder(t *testing.T) {
+	aliases, err := parseFieldAliases("channel=subChannel, topic=subChannel, data=content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, &fieldAliases, aliases)
+
+	// Map order changes from run to run, so a few runs would catch an
+	// alias winning by chance.
+	for i := 0; i < 20; i++ {
+		fields := map[string]string{"topic": "second", "channel": "first", "data": "hi"}
+		resolveFieldAliases(fields)
+		if fields["subChannel"] != "first" || fields["content"] != "hi" {
+			t.Fatalf("resolved %v, want the alias declared first", fields)
+		}
+	}
+
+	fields := map[string]string{"topic": "alias", "SubChannel": "casing"}
+	resolveFieldAliases(fields)
+	if fields["subChannel"] != "casing" {
+		t.Errorf("resolved subChannel %q, want the canonical field over its aliases", fields["subChannel"])
+	}
+}
+
+func TestFieldAliasDeclaredTwiceIsRejected(t *testing.T) {
+	if _, err := parseFieldAliases("channel=subChannel,channel=content"); err == nil {
+		t.Error("an alias declared twice was accepted")
+	}
+}
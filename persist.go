@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var persistPath = flag.String("persist", "", "Save tunnels to this file periodically and on shutdown, and load them on startup (empty disables)")
+var persistInterval = flag.Duration("persist-interval", time.Minute, "How often tunnels are saved with -persist")
+
+// persistedTunnel is the part of a tunnel that survives a restart: its
+// settings and the latest content of each subchannel, or the pending messages
+// of queue tunnels. Subscribers reconnect
+// on their own, and the history is not kept.
+type persistedTunnel struct {
+	ID                  string                        `json:"id"`
+	SubChannels         map[string][]byte             `json:"subChannels"`
+	Binary              map[string]bool               `json:"binary,omitempty"`
+	ContentTypes        map[string]string             `json:"contentTypes,omitempty"`
+	Sequences           map[string]uint64             `json:"sequences,omitempty"`
+	RotateAfter         time.Duration                 `json:"rotateAfter,omitempty"`
+	DefaultContent      string                        `json:"defaultContent,omitempty"`
+	AutoDeleteWhenEmpty bool                          `json:"autoDeleteWhenEmpty,omitempty"`
+	AllowedOrigins      []string                      `json:"allowedOrigins,omitempty"`
+	HistorySize         int                           `json:"historySize"`
+	HistorySizes        map[string]int                `json:"historySizes,omitempty"`
+	ExpiresAt           time.Time                     `json:"expiresAt,omitempty"`
+	SecretHash          []byte                        `json:"secretHash,omitempty"`
+	SigningKey          []byte                        `json:"signingKey,omitempty"`
+	Webhooks            map[string][]string           `json:"webhooks,omitempty"`
+	CreatedAt           time.Time                     `json:"createdAt"`
+	LastActivity        time.Time                     `json:"lastActivity,omitempty"`
+	Queue               bool                          `json:"queue,omitempty"`
+	Queues              map[string][]persistedMessage `json:"queues,omitempty"`
+	RequestsPerMinute   int                           `json:"requestsPerMinute,omitempty"`
+	Burst               int                           `json:"burst,omitempty"`
+	// refs points at the content of the subchannels until readContent reads
+	// it into SubChannels.
+	refs map[string]contentRef
+}
+
+// persistedMessage is a message waiting in the queue of a queue tunnel.
+type persistedMessage struct {
+	Content     []byte    `json:"content"`
+	Binary      bool      `json:"binary,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	Sequence    uint64    `json:"sequence"`
+	SentAt      time.Time `json:"sentAt"`
+}
+
+// persistTunnels saves the tunnels every -persist-interval.
+func persistTunnels() {
+	for {
+		time.Sleep(*persistInterval)
+		if err := saveTunnels(*persistPath); err != nil {
+			slog.Error("Failed to save tunnels", "error", err)
+		}
+	}
+}
+
+// saveTunnels writes all live tunnels to path. The file is replaced
+// atomically, so a crash while saving leaves the previous one intact.
+func saveTunnels(path string) error {
+	tunnelsMutex.Lock()
+	persisted := make([]persistedTunnel, 0, len(tunnels))
+	for id := range tunnels {
+		tunnel, exists := liveTunnel(id)
+		if !exists {
+			continue
+		}
+		persisted = append(persisted, tunnel.persisted())
+	}
+	tunnelsMutex.Unlock()
+
+	var err error
+	for i := range persisted {
+		if readErr := persisted[i].readContent(); readErr != nil && err == nil {
+			err = readErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	slog.Info("Saved tunnels", "tunnels", len(persisted), "path", path)
+	return nil
+}
+
+// loadTunnels restores the tunnels saved to path. A missing file is not an
+// error, it just means there is nothing to restore yet.
+func loadTunnels(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var persisted []persistedTunnel
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var restored []*Tunnel
+	tunnelsMutex.Lock()
+	for _, saved := range persisted {
+		if !saved.ExpiresAt.IsZero() && now.After(saved.ExpiresAt) {
+			continue
+		}
+		tunnel, err := restoreTunnel(saved)
+		if err != nil {
+			tunnelsMutex.Unlock()
+			return err
+		}
+		tunnels[tunnel.ID] = tunnel
+		restored = append(restored, tunnel)
+	}
+	tunnelsMutex.Unlock()
+
+	// Nobody is subscribed after a restart, so tunnels that delete themselves
+	// when empty go away unless a client reconnects within the grace period.
+	for _, tunnel := range restored {
+		scheduleAutoDelete(tunnel.ID)
+	}
+	slog.Info("Restored tunnels", "tunnels", len(restored), "path", path)
+	return nil
+}
+
+// persisted copies what is kept of the tunnel. It must be called with
+// tunnelsMutex held, and readContent called on the copy once it is released.
+func (t *Tunnel) persisted() persistedTunnel {
+	queues := make(map[string][]persistedMessage, len(t.Queues))
+	for subChannel, queue := range t.Queues {
+		for _, msg := range queue {
+			queues[subChannel] = append(queues[subChannel], persistedMessage{Content: []byte(msg.Content), Binary: msg.Binary, ContentType: msg.ContentType, Sequence: msg.Sequence, SentAt: msg.SentAt})
+		}
+	}
+	return persistedTunnel{
+		ID:                  t.ID,
+		refs:                t.contentRefs(),
+		Binary:              copyMap(t.Binary),
+		ContentTypes:        copyMap(t.ContentTypes),
+		Sequences:           copyMap(t.Sequences),
+		RotateAfter:         t.RotateAfter,
+		DefaultContent:      t.DefaultContent,
+		AutoDeleteWhenEmpty: t.AutoDeleteWhenEmpty,
+		AllowedOrigins:      t.AllowedOrigins,
+		HistorySize:         t.HistorySize,
+		HistorySizes:        t.HistorySizes,
+		ExpiresAt:           t.ExpiresAt,
+		SecretHash:          t.SecretHash,
+		SigningKey:          t.SigningKey,
+		Webhooks:            copyMap(t.Webhooks),
+		CreatedAt:           t.CreatedAt,
+		LastActivity:        t.LastActivity,
+		Queue:               t.Queue,
+		Queues:              queues,
+		RequestsPerMinute:   t.RequestsPerMinute,
+		Burst:               t.Burst,
+	}
+}
+
+// readContent reads the content of the subchannels into SubChannels. It must
+// be called without tunnelsMutex held.
+func (p *persistedTunnel) readContent() error {
+	contents, err := readContents(p.refs)
+	p.refs = nil
+	if err != nil {
+		return err
+	}
+	p.SubChannels = make(map[string][]byte, len(contents))
+	for subChannel, content := range contents {
+		p.SubChannels[subChannel] = []byte(content)
+	}
+	return nil
+}
+
+// restoreTunnel rebuilds a tunnel from what persisted kept. Its content is
+// stored through setContent, so -spill-threshold and -compress-content apply.
+// The tunnel is not in the tunnels map yet, so tunnelsMutex need not be held.
+func restoreTunnel(saved persistedTunnel) (*Tunnel, error) {
+	tunnel := newTunnel(saved.ID)
+	tunnel.RotateAfter = saved.RotateAfter
+	tunnel.DefaultContent = saved.DefaultContent
+	tunnel.AutoDeleteWhenEmpty = saved.AutoDeleteWhenEmpty
+	tunnel.AllowedOrigins = saved.AllowedOrigins
+	tunnel.HistorySize = saved.HistorySize
+	tunnel.HistorySizes = saved.HistorySizes
+	tunnel.ExpiresAt = saved.ExpiresAt
+	tunnel.SecretHash = saved.SecretHash
+	tunnel.SigningKey = saved.SigningKey
+	tunnel.Queue = saved.Queue
+	tunnel.RequestsPerMinute = saved.RequestsPerMinute
+	tunnel.Burst = saved.Burst
+	for subChannel, queue := range saved.Queues {
+		for _, msg := range queue {
+			tunnel.enqueue(StreamMessage{SubChannel: subChannel, Content: string(msg.Content), Binary: msg.Binary, ContentType: msg.ContentType, Sequence: msg.Sequence, SentAt: msg.SentAt})
+		}
+	}
+	for subChannel, urls := range saved.Webhooks {
+		tunnel.Webhooks[subChannel] = urls
+	}
+	if !saved.CreatedAt.IsZero() {
+		tunnel.CreatedAt = saved.CreatedAt
+	}
+	if !saved.LastActivity.IsZero() {
+		tunnel.LastActivity = saved.LastActivity
+	}
+	for subChannel, sequence := range saved.Sequences {
+		tunnel.Sequences[subChannel] = sequence
+	}
+	for subChannel, content := range saved.SubChannels {
+		if err := tunnel.setContent(subChannel, string(content), saved.Binary[subChannel]); err != nil {
+			tunnel.clearAll()
+			return nil, err
+		}
+		tunnel.setContentType(subChannel, saved.ContentTypes[subChannel])
+	}
+	return tunnel, nil
+}
+
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	copied := make(map[K]V, len(m))
+	for key, value := range m {
+		copied[key] = value
+	}
+	return copied
+}
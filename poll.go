@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var pollTimeout = flag.Duration("poll-timeout", 30*time.Second, "Longest a poll request, or a get request with wait, waits for a message, and the default when it doesn't ask for less")
+
+// pollTunnel is a long-polling alternative to streamTunnelContent for clients
+// that can't use SSE. It waits for the next message on the subchannel and
+// returns it as JSON, or 204 No Content once the timeout passes without one.
+// A `lastEventId` returns a message sent since that sequence right away, if
+// it is still kept, so a polling loop doesn't miss messages between requests.
+func pollTunnel(w http.ResponseWriter, r *http.Request) {
+	params, ok := parseTunnelParams(w, r)
+	if !ok {
+		return
+	}
+	tunnelId := params.ID
+	subChannel := params.SubChannel
+	wildcard := subChannel == wildcardSubChannel
+
+	if !params.checkID(w, r) {
+		return
+	}
+
+	if !params.checkSubChannel(w, r) {
+		return
+	}
+
+	timeout, ok := parsePollTimeout(w, r, params)
+	if !ok {
+		return
+	}
+
+	tunnelsMutex.Lock()
+	tunnel, exists := liveTunnel(tunnelId)
+	if !exists {
+		tunnelsMutex.Unlock()
+		slog.WarnContext(r.Context(), "No tunnel with this id exists", "tunnel_id", tunnelId, "status", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, "No tunnel with this id exists.")
+		return
+	}
+	if status := tunnel.secretStatus(r, params); status != http.StatusOK {
+		tunnelsMutex.Unlock()
+		rejectSecret(w, r, status, tunnelId)
+		return
+	}
+	tunnel.touch()
+	tunnelsMutex.Unlock()
+
+	subscriber := newSubscriber()
+	if err := addSubscriber(tunnelId, subChannel, subscriber); err != nil {
+		slog.WarnContext(r.Context(), "Too many wildcard subscribers", "tunnel_id", tunnelId, "status", http.StatusTooManyRequests)
+		writeJSONError(w, http.StatusTooManyRequests, "Too many subscribers to all subchannels. Please try again later.")
+		return
+	}
+	defer removeSubscriber(tunnelId, subChannel, subscriber)
+
+	// As with streams, the history is checked after subscribing, so a message
+	// sent in between is not lost.
+	var minSequence uint64
+	if lastSequence, ok := lastEventID(r, params); ok {
+		minSequence = lastSequence + 1
+		if !wildcard {
+			tunnelsMutex.Lock()
+			missed := tunnel.historySince(subChannel, lastSequence)
+			tunnelsMutex.Unlock()
+			missed = loadHistory(missed)
+			if len(missed) > 0 {
+				writePolledMessage(w, r, missed[0])
+				slog.InfoContext(r.Context(), "Returned missed message to poll", "tunnel_id", tunnelId, "subchannel", subChannel)
+				return
+			}
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case msg, ok := <-subscriber.next():
+			if !ok {
+				slog.InfoContext(r.Context(), "Tunnel removed, ending poll", "tunnel_id", tunnelId, "subchannel", subChannel, "status", http.StatusGone)
+				writeJSONError(w, http.StatusGone, fmt.Sprintf("The tunnel was removed: %s", subscriber.closeReason))
+				return
+			}
+			// Comments are only meant for streams.
+			if msg.Comment || (!wildcard && msg.Sequence < minSequence) {
+				continue
+			}
+			writePolledMessage(w, r, msg)
+			slog.InfoContext(r.Context(), "Returned message to poll", "tunnel_id", tunnelId, "subchannel", subChannel)
+			return
+		case <-subscriber.Evicted:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-shuttingDown:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			slog.InfoContext(r.Context(), "Client left poll", "tunnel_id", tunnelId, "subchannel", subChannel)
+			return
+		}
+	}
+}
+
+// parsePollTimeout returns the `timeout` a request asks to wait for, in
+// seconds, capped at and defaulting to -poll-timeout. On failure it writes
+// the error response itself and returns false.
+func parsePollTimeout(w http.ResponseWriter, r *http.Request, params TunnelParams) (time.Duration, bool) {
+	timeout, err := parseSeconds(params.Get("timeout"))
+	if err != nil {
+		slog.WarnContext(r.Context(), "Invalid 'timeout' value", "value", params.Get("timeout"), "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "The 'timeout' value must be a non-negative number of seconds")
+		return 0, false
+	}
+	if timeout == 0 || timeout > *pollTimeout {
+		timeout = *pollTimeout
+	}
+	return timeout, true
+}
+
+// waitForContent waits up to timeout for content to be sent to a subchannel
+// that has none, for the get endpoint's `wait` option, and takes it as
+// takeContent does. Another consumer may take the content first, in which
+// case it keeps waiting. It returns empty content if nothing arrives in
+// time, and false if it answered the request itself because the tunnel was
+// removed or the client left.
+func waitForContent(w http.ResponseWriter, r *http.Request, tunnel *Tunnel, subChannel string, consume bool, timeout time.Duration) (retrievedContent, bool) {
+	subscriber := newSubscriber()
+	if err := addSubscriber(tunnel.ID, subChannel, subscriber); err != nil {
+		slog.WarnContext(r.Context(), "Too many wildcard subscribers", "tunnel_id", tunnel.ID, "status", http.StatusTooManyRequests)
+		writeJSONError(w, http.StatusTooManyRequests, "Too many subscribers to all subchannels. Please try again later.")
+		return retrievedContent{}, false
+	}
+	defer removeSubscriber(tunnel.ID, subChannel, subscriber)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		// Content is checked after subscribing, so a message sent in between
+		// is not missed.
+		tunnelsMutex.Lock()
+		if current, exists := liveTunnel(tunnel.ID); !exists || current != tunnel {
+			tunnelsMutex.Unlock()
+			slog.InfoContext(r.Context(), "Tunnel removed, ending wait", "tunnel_id", tunnel.ID, "subchannel", subChannel, "status", http.StatusGone)
+			writeJSONError(w, http.StatusGone, "The tunnel was removed.")
+			return retrievedContent{}, false
+		}
+		retrieved := tunnel.takeContent(subChannel, consume)
+		tunnelsMutex.Unlock()
+		if !retrieved.ref.empty() {
+			return retrieved, true
+		}
+
+		for received := false; !received; {
+			select {
+			case msg, ok := <-subscriber.next():
+				if !ok {
+					slog.InfoContext(r.Context(), "Tunnel removed, ending wait", "tunnel_id", tunnel.ID, "subchannel", subChannel, "status", http.StatusGone)
+					writeJSONError(w, http.StatusGone, fmt.Sprintf("The tunnel was removed: %s", subscriber.closeReason))
+					return retrievedContent{}, false
+				}
+				// Comments are only meant for streams.
+				received = !msg.Comment
+			case <-subscriber.Evicted:
+				return retrievedContent{}, true
+			case <-timer.C:
+				return retrievedContent{}, true
+			case <-shuttingDown:
+				return retrievedContent{}, true
+			case <-r.Context().Done():
+				slog.InfoContext(r.Context(), "Client left wait", "tunnel_id", tunnel.ID, "subchannel", subChannel)
+				return retrievedContent{}, false
+			}
+		}
+	}
+}
+
+// writePolledMessage writes a message as the JSON response of a poll. Binary
+// content is base64-encoded with `encoding` set, as on streams.
+func writePolledMessage(w http.ResponseWriter, r *http.Request, msg StreamMessage) {
+	response := map[string]interface{}{"subChannel": msg.SubChannel, "content": msg.Content, "sequence": msg.Sequence}
+	if msg.Binary {
+		response["content"] = base64.StdEncoding.EncodeToString([]byte(msg.Content))
+		response["encoding"] = base64Encoding
+	}
+	if msg.ContentType != "" {
+		response["contentType"] = msg.ContentType
+	}
+	writeJSON(w, r, response)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var queueTTL = flag.Duration("queue-ttl", time.Hour, "How long messages wait in the queues of queue tunnels before they are dropped (0 keeps them until consumed)")
+var maxQueueLength = flag.Int("max-queue-length", 1000, "Maximum pending messages per subchannel of a queue tunnel")
+
+// Modes of a tunnel, chosen when it is created. Latest tunnels hold the
+// latest message of each subchannel, queue tunnels every message until it is
+// consumed.
+const (
+	modeLatest = "latest"
+	modeQueue  = "queue"
+)
+
+var errQueueFull = errors.New("the queue is full")
+var errQueueAppend = errors.New("content cannot be appended to a queue")
+
+// queueSendError returns the response status and message for the errors
+// sendContent returns for queue tunnels, and false for any other error.
+func queueSendError(err error) (int, string, bool) {
+	switch {
+	case errors.Is(err, errQueueFull):
+		return http.StatusInsufficientStorage, fmt.Sprintf("The subchannel already holds %d pending messages. Please try again once some are consumed.", *maxQueueLength), true
+	case errors.Is(err, errQueueAppend):
+		return http.StatusBadRequest, "Content cannot be sent with 'append' to a queue tunnel", true
+	}
+	return 0, "", false
+}
+
+// The queue methods below must be called with tunnelsMutex held.
+
+// queueFull reports whether a subchannel's queue has no room for another
+// message, after dropping the expired ones.
+func (t *Tunnel) queueFull(subChannel string, now time.Time) bool {
+	t.pruneQueue(subChannel, now)
+	return len(t.Queues[subChannel]) >= *maxQueueLength
+}
+
+func (t *Tunnel) enqueue(msg StreamMessage) {
+	t.Queues[msg.SubChannel] = append(t.Queues[msg.SubChannel], msg)
+}
+
+// dequeue removes and returns the oldest message of a subchannel's queue
+// that hasn't expired, and false if there is none.
+func (t *Tunnel) dequeue(subChannel string, now time.Time) (StreamMessage, bool) {
+	t.pruneQueue(subChannel, now)
+	queue := t.Queues[subChannel]
+	if len(queue) == 0 {
+		return StreamMessage{}, false
+	}
+	msg := queue[0]
+	if len(queue) == 1 {
+		delete(t.Queues, subChannel)
+	} else {
+		// Clear the slot so the content can be collected before the queue
+		// is reallocated.
+		queue[0] = StreamMessage{}
+		t.Queues[subChannel] = queue[1:]
+	}
+	return msg, true
+}
+
+// pruneQueue drops the messages that have waited longer than -queue-ttl.
+func (t *Tunnel) pruneQueue(subChannel string, now time.Time) {
+	if *queueTTL <= 0 {
+		return
+	}
+	queue := t.Queues[subChannel]
+	expired := 0
+	for expired < len(queue) && now.Sub(queue[expired].SentAt) >= *queueTTL {
+		queue[expired] = StreamMessage{}
+		expired++
+	}
+	if expired == 0 {
+		return
+	}
+	if expired == len(queue) {
+		delete(t.Queues, subChannel)
+		return
+	}
+	t.Queues[subChannel] = queue[expired:]
+}
+
+// pruneQueues drops the expired messages of every subchannel.
+func (t *Tunnel) pruneQueues(now time.Time) {
+	for subChannel := range t.Queues {
+		t.pruneQueue(subChannel, now)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Defaults of the -ip-rate, -ip-burst, -tunnel-rate, -tunnel-burst and
+// -ratelimit-cleanup flags.
+const (
+	RequestsPerMinute = 100
+	BurstSize         = 10
+	CleanupInterval   = 5 * time.Minute
+)
+
+var rateLimitCleanup = flag.Duration("ratelimit-cleanup", envDuration("RATELIMIT_CLEANUP", CleanupInterval), "How long unused rate limit buckets are kept (env RATELIMIT_CLEANUP)")
+
+var maxTunnelRate = flag.Int("max-tunnel-rate", 1000, "Highest requestsPerMinute a tunnel may be created with")
+var maxTunnelBurst = flag.Int("max-tunnel-burst", 100, "Highest burst a tunnel may be created with")
+
+type rateLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiterStore hands out one token bucket per key (an IP or a tunnel ID)
+// and forgets buckets that have not been used for -ratelimit-cleanup.
+type RateLimiterStore struct {
+	mutex             sync.Mutex
+	limiters          map[string]*rateLimiterEntry
+	limit             rate.Limit
+	burst             int
+	requestsPerMinute int
+	// overrides, if set, returns the rate and burst of keys that don't use
+	// the store's, with zero meaning the store's. See tunnelRateLimits.
+	overrides func(key string) (requestsPerMinute int, burst int)
+}
+
+// NewRateLimiterStore creates a store whose buckets refill at
+// requestsPerMinute. A non-positive rate disables limiting.
+func NewRateLimiterStore(requestsPerMinute int, burst int) *RateLimiterStore {
+	store := &RateLimiterStore{
+		limiters:          make(map[string]*rateLimiterEntry),
+		limit:             perMinute(requestsPerMinute),
+		burst:             burst,
+		requestsPerMinute: requestsPerMinute,
+	}
+	go store.cleanup()
+	return store
+}
+
+func perMinute(requestsPerMinute int) rate.Limit {
+	if requestsPerMinute <= 0 {
+		return rate.Inf
+	}
+	return rate.Every(time.Minute / time.Duration(requestsPerMinute))
+}
+
+// limits returns the rate and burst of a key's bucket. It must not be called
+// with the store's mutex held, as overrides may take other locks.
+func (s *RateLimiterStore) limits(key string) (limit rate.Limit, burst int, requestsPerMinute int) {
+	limit, burst, requestsPerMinute = s.limit, s.burst, s.requestsPerMinute
+	if s.overrides == nil {
+		return limit, burst, requestsPerMinute
+	}
+	overrideRate, overrideBurst := s.overrides(key)
+	if overrideRate > 0 {
+		limit, requestsPerMinute = perMinute(overrideRate), overrideRate
+	}
+	if overrideBurst > 0 {
+		burst = overrideBurst
+	}
+	return limit, burst, requestsPerMinute
+}
+
+func (s *RateLimiterStore) getLimiter(key string) *rate.Limiter {
+	limit, burst, _ := s.limits(key)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// A key's limits can change while its bucket is kept, as when a tunnel is
+	// created with overrides after the request creating it used the
+	// defaults. The bucket then starts over with the new limits.
+	entry, exists := s.limiters[key]
+	if !exists || entry.limiter.Limit() != limit || entry.limiter.Burst() != burst {
+		entry = &rateLimiterEntry{limiter: rate.NewLimiter(limit, burst)}
+		s.limiters[key] = entry
+	}
+	entry.lastSeen = time.Now()
+	return entry.limiter
+}
+
+// allow takes a token from the key's bucket if one is available. It also
+// returns the whole tokens left and, when denied, how long until the next
+// token is available.
+func (s *RateLimiterStore) allow(key string) (allowed bool, remaining int, retryAfter time.Duration) {
+	limiter := s.getLimiter(key)
+	now := time.Now()
+	allowed = limiter.AllowN(now, 1)
+	tokens := limiter.TokensAt(now)
+	if tokens > 0 {
+		remaining = int(tokens)
+	}
+	if limit := limiter.Limit(); !allowed && limit > 0 && limit != rate.Inf {
+		retryAfter = time.Duration((1 - tokens) / float64(limit) * float64(time.Second))
+	}
+	return allowed, remaining, retryAfter
+}
+
+// setHeaders reports the state of a key's bucket in X-RateLimit headers,
+// naming the bucket in X-RateLimit-Scope. Disabled limits report nothing.
+func (s *RateLimiterStore) setHeaders(w http.ResponseWriter, key string, scope string, remaining int) {
+	limit, _, requestsPerMinute := s.limits(key)
+	if limit == rate.Inf {
+		return
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(requestsPerMinute))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Scope", scope)
+}
+
+// rejectRateLimited answers 429 with a Retry-After in whole seconds.
+func rejectRateLimited(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeJSONError(w, http.StatusTooManyRequests, message)
+}
+
+// inspect reports the tokens currently available in a key's bucket and when
+// it was last used, without consuming a token or creating the bucket.
+func (s *RateLimiterStore) inspect(key string) (tokens float64, lastSeen time.Time, exists bool) {
+	_, burst, _ := s.limits(key)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, exists := s.limiters[key]
+	if !exists {
+		return float64(burst), time.Time{}, false
+	}
+	return entry.limiter.Tokens(), entry.lastSeen, true
+}
+
+func (s *RateLimiterStore) cleanup() {
+	for {
+		time.Sleep(*rateLimitCleanup)
+		s.mutex.Lock()
+		for key, entry := range s.limiters {
+			if time.Since(entry.lastSeen) > *rateLimitCleanup {
+				delete(s.limiters, key)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+var ipLimiters *RateLimiterStore
+var tunnelLimiters *RateLimiterStore
+
+// parseRateOverride parses the optional `requestsPerMinute` or `burst` of a
+// tunnel, which must be between 1 and max. On failure it writes the error
+// response itself and returns false.
+func parseRateOverride(w http.ResponseWriter, r *http.Request, params TunnelParams, name string, max int) (int, bool) {
+	value := params.Get(name)
+	if value == "" {
+		return 0, true
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 1 || parsed > max {
+		slog.WarnContext(r.Context(), fmt.Sprintf("Invalid '%s' value", name), "value", value, "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("The '%s' value must be a number between 1 and %d", name, max))
+		return 0, false
+	}
+	return parsed, true
+}
+
+// tunnelRateLimits returns the requestsPerMinute and burst a tunnel was
+// created with, zero for those it didn't set.
+func tunnelRateLimits(tunnelId string) (int, int) {
+	tunnelsMutex.Lock()
+	defer tunnelsMutex.Unlock()
+	tunnel, exists := liveTunnel(tunnelId)
+	if !exists {
+		return 0, 0
+	}
+	return tunnel.RequestsPerMinute, tunnel.Burst
+}
+
+var createLimiters *RateLimiterStore
+
+var trustedProxyList = flag.String("trusted-proxies", "", "Comma separated IPs or CIDRs of proxies whose X-Forwarded-For header is honored. The client is the right-most entry that is not a trusted proxy, not the left-most, so list every proxy in the chain")
+
+// trustedProxies is parsed from -trusted-proxies at startup.
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma separated list of IPs and CIDRs.
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client. Requests arriving through a
+// trusted proxy are attributed to the right-most X-Forwarded-For entry that
+// is not itself a trusted proxy, since everything left of it can be forged
+// by the client.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			// A malformed entry can't be trusted and neither can anything
+			// left of it.
+			return ip
+		}
+		ip = hops[i]
+		if !isTrustedProxy(ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// requestTunnelID extracts the tunnel id the way parseTunnelParams does, from
+// the query string or, for POST requests, from the JSON body. The body is
+// restored so handlers can read it.
+func requestTunnelID(r *http.Request) string {
+	fields := queryFields(r)
+	if r.Method == http.MethodPost && r.Body != nil && !isOctetStream(r) {
+		// Never buffer more than the handler would accept; whatever is left
+		// stays in the body so the handler can still report it as too large.
+		requestBody, err := io.ReadAll(io.LimitReader(r.Body, *maxBodySize))
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(requestBody), r.Body), r.Body}
+		if err == nil {
+			addBodyFields(fields, requestBody)
+		}
+	}
+	resolveFieldAliases(fields)
+	return fields["id"]
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func withRateLimit(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		allowed, remaining, retryAfter := ipLimiters.allow(ip)
+		ipLimiters.setHeaders(w, ip, "ip", remaining)
+		if !allowed {
+			rateLimitRejections.WithLabelValues("ip").Inc()
+			slog.WarnContext(r.Context(), "Rate limit exceeded", "limiter", "ip", "status", http.StatusTooManyRequests)
+			rejectRateLimited(w, retryAfter, "Too many requests. Please slow down.")
+			return
+		}
+
+		// The tunnel bucket is reported instead of the IP bucket when it is
+		// the one that is closer to running out.
+		if tunnelId := requestTunnelID(r); tunnelId != "" {
+			allowed, tunnelRemaining, retryAfter := tunnelLimiters.allow(tunnelId)
+			if !allowed || tunnelRemaining < remaining {
+				tunnelLimiters.setHeaders(w, tunnelId, "tunnel", tunnelRemaining)
+			}
+			if !allowed {
+				rateLimitRejections.WithLabelValues("tunnel").Inc()
+				slog.WarnContext(r.Context(), "Rate limit exceeded", "limiter", "tunnel", "tunnel_id", tunnelId, "status", http.StatusTooManyRequests)
+				rejectRateLimited(w, retryAfter, "Too many requests for this tunnel. Please slow down.")
+				return
+			}
+		}
+
+		handler(w, r)
+	}
+}
+
+// withCreateRateLimit applies the stricter per-IP limit for tunnel creation on
+// top of the general limits enforced by withRateLimit.
+func withCreateRateLimit(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		allowed, remaining, retryAfter := createLimiters.allow(ip)
+		if !allowed {
+			createLimiters.setHeaders(w, ip, "create", remaining)
+			rateLimitRejections.WithLabelValues("create").Inc()
+			slog.WarnContext(r.Context(), "Rate limit exceeded", "limiter", "create", "status", http.StatusTooManyRequests)
+			rejectRateLimited(w, retryAfter, "Too many tunnels created. Please slow down.")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// inspectRateLimit shows the state of the rate limit buckets for a key, to
+// help diagnose why a client is being throttled.
+func inspectRateLimit(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	limiterType := r.URL.Query().Get("type")
+
+	stores := map[string]*RateLimiterStore{}
+	switch limiterType {
+	case "ip":
+		stores["ip"] = ipLimiters
+		stores["create"] = createLimiters
+	case "tunnel":
+		stores["tunnel"] = tunnelLimiters
+	default:
+		slog.WarnContext(r.Context(), "Invalid rate limiter type", "limiter", limiterType, "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "The 'type' parameter must be 'ip' or 'tunnel'")
+		return
+	}
+
+	if key == "" {
+		slog.WarnContext(r.Context(), "The request must contain a valid 'key' parameter", "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "The request must contain a valid 'key' parameter")
+		return
+	}
+
+	buckets := make(map[string]interface{})
+	for name, store := range stores {
+		tokens, lastSeen, exists := store.inspect(key)
+		_, burst, _ := store.limits(key)
+		bucket := map[string]interface{}{
+			"tokens": tokens,
+			"burst":  burst,
+			"active": exists,
+		}
+		if exists {
+			bucket["lastSeen"] = lastSeen
+		}
+		buckets[name] = bucket
+	}
+
+	writeJSON(w, r, map[string]interface{}{"key": key, "type": limiterType, "buckets": buckets})
+	slog.InfoContext(r.Context(), "Inspected rate limits", "limiter", limiterType, "key", key)
+}
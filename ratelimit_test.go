@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBurstMatchesConfiguration(t *testing.T) {
+	for _, burst := range []int{1, 3, 10} {
+		// One token a minute, so none comes back during the test.
+		store := NewRateLimiterStore(1, burst)
+
+		for i := 1; i <= burst; i++ {
+			allowed, remaining, _ := store.allow("key")
+			if !allowed {
+				t.Fatalf("burst %d: request %d was denied", burst, i)
+			}
+			if remaining != burst-i {
+				t.Errorf("burst %d: %d remaining after request %d, want %d", burst, remaining, i, burst-i)
+			}
+		}
+		allowed, remaining, retryAfter := store.allow("key")
+		if allowed || remaining != 0 {
+			t.Errorf("burst %d: request %d allowed %t with %d remaining, want it denied", burst, burst+1, allowed, remaining)
+		}
+		if retryAfter <= 59*time.Second || retryAfter > time.Minute {
+			t.Errorf("burst %d: retry after %v, want about a minute", burst, retryAfter)
+		}
+
+		// Other keys have buckets of their own.
+		if allowed, _, _ := store.allow("other"); !allowed {
+			t.Errorf("burst %d: another key was denied", burst)
+		}
+	}
+}
+
+func TestRateRefillsTheBurst(t *testing.T) {
+	// A token every 10ms.
+	store := NewRateLimiterStore(6000, 2)
+	store.allow("key")
+	store.allow("key")
+	if allowed, _, _ := store.allow("key"); allowed {
+		t.Fatal("request beyond the burst was allowed")
+	}
+	time.Sleep(25 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if allowed, _, _ := store.allow("key"); !allowed {
+			t.Fatalf("request %d after refilling was denied", i+1)
+		}
+	}
+}
+
+func TestZeroRateDisablesLimiting(t *testing.T) {
+	store := NewRateLimiterStore(0, 1)
+	for i := 0; i < 1000; i++ {
+		if allowed, _, _ := store.allow("key"); !allowed {
+			t.Fatalf("request %d was denied with limiting disabled", i+1)
+		}
+	}
+}
+
+func TestTunnelBurstOverride(t *testing.T) {
+	resetTunnels(t)
+	store := NewRateLimiterStore(1, 2)
+	store.overrides = tunnelRateLimits
+	addTestTunnel("roomy").Burst = 5
+	addTestTunnel("default")
+
+	for id, burst := range map[string]int{"roomy": 5, "default": 2} {
+		allowed := 0
+		for i := 0; i < 10; i++ {
+			if ok, _, _ := store.allow(id); ok {
+				allowed++
+			}
+		}
+		if allowed != burst {
+			t.Errorf("tunnel %s allowed %d requests in a burst, want %d", id, allowed, burst)
+		}
+	}
+}
+
+func TestIPAndTunnelBurstsAreConfiguredSeparately(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, &ipLimiters, NewRateLimiterStore(1, 2))
+	setFlag(t, &tunnelLimiters, NewRateLimiterStore(1, 3))
+	addTestTunnel("limited")
+	handler := withRateLimit(func(w http.ResponseWriter, r *http.Request) {})
+	request := func(ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/get?id=limited", nil)
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	// One client runs out of its IP burst first.
+	for i := 1; i <= 3; i++ {
+		w := request("192.0.2.1")
+		if want := i <= 2; (w.Code == http.StatusOK) != want {
+			t.Fatalf("request %d from one IP answered %d", i, w.Code)
+		}
+		if i == 3 && w.Header().Get("X-RateLimit-Scope") != "ip" {
+			t.Errorf("rejected with scope %q, want ip", w.Header().Get("X-RateLimit-Scope"))
+		}
+	}
+
+	// Many clients run out of the tunnel's burst, which the first one
+	// already used two tokens of.
+	w := request("192.0.2.2")
+	if w.Code != http.StatusOK {
+		t.Fatalf("third request to the tunnel answered %d", w.Code)
+	}
+	for i := 3; i < 6; i++ {
+		w := request(fmt.Sprintf("192.0.2.%d", i))
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("X-RateLimit-Scope") != "tunnel" {
+			t.Errorf("request from a new IP answered %d with scope %q, want 429 for the tunnel", w.Code, w.Header().Get("X-RateLimit-Scope"))
+		}
+	}
+}
+
+func TestClientIPIsTheRightMostUntrustedForwardedEntry(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, &trustedProxies, proxies)
+
+	cases := []struct {
+		remote    string
+		forwarded string
+		want      string
+	}{
+		// The left-most entry is whatever the client claims.
+		{"10.0.0.1:1234", "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+		{"10.0.0.1:1234", "198.51.100.7, 10.0.0.2", "198.51.100.7"},
+		{"10.0.0.1:1234", "not-an-ip, 10.0.0.2", "10.0.0.2"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		// Untrusted peers can't pick their address.
+		{"192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if ip := clientIP(r); ip != c.want {
+			t.Errorf("clientIP from %s with X-Forwarded-For %q = %s, want %s", c.remote, c.forwarded, ip, c.want)
+		}
+	}
+}
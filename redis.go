@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var redisURL = flag.String("redis", os.Getenv("REDIS_URL"), "Share tunnels between instances through this Redis server, e.g. redis://localhost:6379/0 (env REDIS_URL)")
+var redisPrefix = flag.String("redis-prefix", envOr("REDIS_PREFIX", "txttunnel:"), "Prefix of the keys and the channel used in Redis (env REDIS_PREFIX)")
+
+// Fields of a tunnel's Redis hash. The tunnel itself is kept under
+// redisMetaField, each subchannel under redisSubChannelField plus its name.
+const (
+	redisMetaField       = "meta"
+	redisSubChannelField = "subChannel:"
+)
+
+// redisSetIfExists writes a hash field only while the hash exists, so
+// content sent while the tunnel is being deleted doesn't bring back a hash
+// without a tunnel or expiry.
+var redisSetIfExists = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+end
+return 0
+`)
+
+// redisBackend keeps each tunnel in a Redis hash that expires with the
+// tunnel, and publishes events on a single channel that every instance
+// subscribes to.
+type redisBackend struct {
+	client *redis.Client
+	prefix string
+}
+
+// redisSubChannel is what is kept of a subchannel in Redis.
+type redisSubChannel struct {
+	Content     []byte `json:"content"`
+	Binary      bool   `json:"binary,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Sequence    uint64 `json:"sequence"`
+}
+
+// newRedisBackend connects to the Redis server at rawURL and starts applying
+// the events of the other instances.
+func newRedisBackend(rawURL string, prefix string) (*redisBackend, error) {
+	options, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	b := &redisBackend{client: redis.NewClient(options), prefix: prefix}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.client.Ping(ctx).Err(); err != nil {
+		return nil, err
+	}
+
+	// Subscribing before returning means no event published after startup
+	// is missed. The client resubscribes by itself after a lost connection.
+	subscription := b.client.Subscribe(ctx, b.channel())
+	if _, err := subscription.Receive(ctx); err != nil {
+		return nil, err
+	}
+	go b.receive(subscription)
+	return b, nil
+}
+
+func (b *redisBackend) key(id string) string {
+	return b.prefix + "tunnel:" + id
+}
+
+func (b *redisBackend) channel() string {
+	return b.prefix + "events"
+}
+
+func (b *redisBackend) receive(subscription *redis.PubSub) {
+	for message := range subscription.Channel() {
+		var event backendEvent
+		if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+			slog.Error("Failed to decode event from another instance", "error", err)
+			continue
+		}
+		if event.Instance == backendInstance {
+			continue
+		}
+		applyEvent(event)
+	}
+}
+
+func (b *redisBackend) LoadTunnel(id string) (*persistedTunnel, error) {
+	fields, err := b.client.HGetAll(context.Background(), b.key(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	meta, exists := fields[redisMetaField]
+	if !exists {
+		return nil, nil
+	}
+
+	var saved persistedTunnel
+	if err := json.Unmarshal([]byte(meta), &saved); err != nil {
+		return nil, err
+	}
+	saved.SubChannels = make(map[string][]byte)
+	saved.Binary = make(map[string]bool)
+	saved.ContentTypes = make(map[string]string)
+	saved.Sequences = make(map[string]uint64)
+	for field, value := range fields {
+		if !strings.HasPrefix(field, redisSubChannelField) {
+			continue
+		}
+		subChannel := strings.TrimPrefix(field, redisSubChannelField)
+		var stored redisSubChannel
+		if err := json.Unmarshal([]byte(value), &stored); err != nil {
+			return nil, err
+		}
+		saved.SubChannels[subChannel] = stored.Content
+		saved.Binary[subChannel] = stored.Binary
+		saved.ContentTypes[subChannel] = stored.ContentType
+		saved.Sequences[subChannel] = stored.Sequence
+	}
+	return &saved, nil
+}
+
+func (b *redisBackend) SaveTunnel(tunnel persistedTunnel) error {
+	// Content is kept in fields of its own, written by SetContent.
+	tunnel.SubChannels, tunnel.Binary, tunnel.ContentTypes, tunnel.Sequences = nil, nil, nil, nil
+	meta, err := json.Marshal(tunnel)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	key := b.key(tunnel.ID)
+	_, err = b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, redisMetaField, meta)
+		if !tunnel.ExpiresAt.IsZero() {
+			pipe.PExpireAt(ctx, key, tunnel.ExpiresAt)
+		}
+		return nil
+	})
+	return err
+}
+
+func (b *redisBackend) DeleteTunnel(id string) error {
+	return b.client.Del(context.Background(), b.key(id)).Err()
+}
+
+func (b *redisBackend) SetContent(id string, msg StreamMessage) error {
+	stored, err := json.Marshal(redisSubChannel{Content: []byte(msg.Content), Binary: msg.Binary, ContentType: msg.ContentType, Sequence: msg.Sequence})
+	if err != nil {
+		return err
+	}
+	err = redisSetIfExists.Run(context.Background(), b.client, []string{b.key(id)}, redisSubChannelField+msg.SubChannel, stored).Err()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	return err
+}
+
+func (b *redisBackend) DeleteSubChannel(id string, subChannel string) error {
+	return b.client.HDel(context.Background(), b.key(id), redisSubChannelField+subChannel).Err()
+}
+
+func (b *redisBackend) Publish(event backendEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(context.Background(), b.channel(), payload).Err()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for requests to finish when shutting down")
+
+// shuttingDown is closed once the server starts shutting down. Streams
+// watch it to ask their clients to reconnect, since they would otherwise
+// keep the server from draining.
+var shuttingDown = make(chan struct{})
+
+func isShuttingDown() bool {
+	select {
+	case <-shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// serveUntilSignal runs the server, and the server redirecting to it if
+// there is one, until SIGINT or SIGTERM, then closes all streams and waits
+// up to -shutdown-timeout for requests in flight.
+func serveUntilSignal(server *http.Server, redirect *http.Server) {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- listenAndServe(server)
+	}()
+	redirectErr := make(chan error, 1)
+	if redirect != nil {
+		go func() {
+			redirectErr <- redirect.ListenAndServe()
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		fatal("Server failed", "error", err)
+	case err := <-redirectErr:
+		fatal("Redirecting server failed", "error", err)
+	case sig := <-signals:
+		slog.Info("Received signal, shutting down", "signal", sig.String())
+	}
+
+	close(shuttingDown)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if redirect != nil {
+		redirect.Shutdown(ctx)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Failed to drain all connections", "error", err)
+	}
+	if err := <-serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Server error", "error", err)
+	}
+	slog.Info("Server stopped")
+}
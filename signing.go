@@ -0,0 +1,18 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// signatureHeader carries the signature of webhook bodies and raw content.
+const signatureHeader = "X-Signature"
+
+// signContent returns the HMAC-SHA256 of data under a tunnel's signing key,
+// formatted as `sha256=` followed by the lower case hex digest.
+func signContent(key []byte, data []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
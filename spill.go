@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+var spillThreshold = flag.Int("spill-threshold", 0, "Content larger than this many bytes is kept on disk instead of in memory (0 disables)")
+var spillDir = flag.String("spill-dir", os.TempDir(), "Directory for content spilled to disk")
+
+// spillContent writes content to a new file in the spill directory and
+// returns its path. It must be called without tunnelsMutex held, so a large
+// write doesn't hold up other tunnels.
+func spillContent(content string) (string, error) {
+	file, err := os.CreateTemp(*spillDir, "txttunnel-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = file.WriteString(content)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// spillRefs counts what refers to each spill file: the subchannel whose
+// content it holds, history entries and reads in progress. A file is deleted
+// once nothing refers to it, so it can be read without holding tunnelsMutex
+// even if its subchannel is written to meanwhile. It is guarded by
+// spillMutex rather than tunnelsMutex, so reads can release their file
+// without taking tunnelsMutex again.
+var spillRefs = make(map[string]int)
+var spillMutex = &sync.Mutex{}
+
+func retainSpill(path string) {
+	spillMutex.Lock()
+	defer spillMutex.Unlock()
+	spillRefs[path]++
+}
+
+func releaseSpill(path string) {
+	spillMutex.Lock()
+	defer spillMutex.Unlock()
+	spillRefs[path]--
+	if spillRefs[path] > 0 {
+		return
+	}
+	delete(spillRefs, path)
+	discardSpill(path)
+}
+
+// discardSpill removes a spill file, see releaseSpill. Files that nothing
+// was made to refer to yet are removed with it directly.
+func discardSpill(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		slog.Error("Failed to remove spilled content", "error", err)
+	}
+}
+
+func readSpill(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+func spillSize(path string) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return int(info.Size()), nil
+}
+
+func (t *Tunnel) removeSpill(subChannel string) {
+	path, spilled := t.Spilled[subChannel]
+	if !spilled {
+		return
+	}
+	delete(t.Spilled, subChannel)
+	releaseSpill(path)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// spillFiles returns the files in the spill directory.
+func spillFiles(t *testing.T) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(*spillDir, "txttunnel-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func setupSpill(t *testing.T) *Tunnel {
+	t.Helper()
+	resetTunnels(t)
+	setFlag(t, spillDir, t.TempDir())
+	setFlag(t, spillThreshold, 10)
+	return addTestTunnel("spill")
+}
+
+func TestSpilledContentIsOnlyReferencedByHistory(t *testing.T) {
+	tunnel := setupSpill(t)
+	large := strings.Repeat("large ", 10)
+	if _, err := sendContent(tunnel, StreamMessage{SubChannel: "main", Content: large}); err != nil {
+		t.Fatal(err)
+	}
+
+	tunnelsMutex.Lock()
+	history := tunnel.History["main"]
+	tunnelsMutex.Unlock()
+	if len(history) != 1 || history[0].Content != "" || history[0].SpillPath == "" {
+		t.Fatalf("history = %+v, want one entry referring to the spill file", history)
+	}
+	if files := spillFiles(t); len(files) != 1 {
+		t.Fatalf("spill files = %v, want the one shared by content and history", files)
+	}
+
+	tunnelsMutex.Lock()
+	missed := tunnel.historySince("main", 0)
+	tunnelsMutex.Unlock()
+	missed = loadHistory(missed)
+	if len(missed) != 1 || missed[0].Content != large {
+		t.Errorf("loaded history = %+v, want the spilled content", missed)
+	}
+}
+
+func TestSpillFileIsRemovedOnceNothingRefersToIt(t *testing.T) {
+	tunnel := setupSpill(t)
+	large := strings.Repeat("large ", 10)
+	sendContent(tunnel, StreamMessage{SubChannel: "main", Content: large})
+	path := spillFiles(t)[0]
+
+	// Replacing the content leaves the file to the history.
+	sendContent(tunnel, StreamMessage{SubChannel: "main", Content: "small"})
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("spill file kept by the history is gone: %v", err)
+	}
+
+	dropSubChannel(tunnel, "main", closeReasonDeleted)
+	if files := spillFiles(t); len(files) != 0 {
+		t.Errorf("spill files = %v, want none once the subchannel is gone", files)
+	}
+}
+
+func TestSpilledContentIsReadAfterItIsReplaced(t *testing.T) {
+	tunnel := setupSpill(t)
+	tunnel.HistorySize = 0
+	large := strings.Repeat("large ", 10)
+	sendContent(tunnel, StreamMessage{SubChannel: "main", Content: large})
+
+	// A reader that took the ref under the lock still gets the content it
+	// saw after a send replaced it.
+	tunnelsMutex.Lock()
+	retrieved := tunnel.takeContent("main", false)
+	tunnelsMutex.Unlock()
+	sendContent(tunnel, StreamMessage{SubChannel: "main", Content: strings.Repeat("newer ", 10)})
+
+	content, err := retrieved.ref.read()
+	if err != nil || content != large {
+		t.Fatalf("content = %q, %v, want the content before the send", content, err)
+	}
+	if files := spillFiles(t); len(files) != 1 {
+		t.Errorf("spill files = %v, want only the newer content", files)
+	}
+}
+
+func TestConsumedSpilledContentIsRemovedAfterReading(t *testing.T) {
+	tunnel := setupSpill(t)
+	tunnel.HistorySize = 0
+	large := strings.Repeat("large ", 10)
+	sendContent(tunnel, StreamMessage{SubChannel: "main", Content: large})
+
+	tunnelsMutex.Lock()
+	retrieved := tunnel.takeContent("main", true)
+	tunnelsMutex.Unlock()
+	content, err := retrieved.ref.read()
+
+	if err != nil || content != large {
+		t.Fatalf("content = %q, %v, want the spilled content", content, err)
+	}
+	if files := spillFiles(t); len(files) != 0 {
+		t.Errorf("spill files = %v, want none after consuming", files)
+	}
+}
+
+func TestAppendToSpilledContent(t *testing.T) {
+	tunnel := setupSpill(t)
+	sendContent(tunnel, StreamMessage{SubChannel: "main", Content: strings.Repeat("a", 20)})
+	sendContent(tunnel, StreamMessage{SubChannel: "main", Content: "b", Append: true, Separator: ","})
+
+	tunnelsMutex.Lock()
+	ref := tunnel.contentRef("main")
+	history := tunnel.History["main"]
+	tunnelsMutex.Unlock()
+	content, err := ref.read()
+
+	if want := strings.Repeat("a", 20) + ",b"; err != nil || content != want {
+		t.Errorf("content = %q, %v, want %q", content, err, want)
+	}
+	// The spill file holds the whole content, so the history keeps the
+	// appended part itself.
+	if last := history[len(history)-1]; last.Content != "b" || last.SpillPath != "" {
+		t.Errorf("history entry of the append = %+v, want its own content", last)
+	}
+}
+
+func TestConcurrentAppendsToSpilledContentKeepEveryPart(t *testing.T) {
+	tunnel := setupSpill(t)
+	tunnel.HistorySize = 0
+	sendContent(tunnel, StreamMessage{SubChannel: "main", Content: strings.Repeat("a", 20)})
+
+	// Each append is spilled with tunnelsMutex released, so the others get
+	// in between and must not be lost.
+	const appends = 20
+	var wg sync.WaitGroup
+	for i := 0; i < appends; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := sendContent(tunnel, StreamMessage{SubChannel: "main", Content: "b", Append: true}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	tunnelsMutex.Lock()
+	ref := tunnel.contentRef("main")
+	tunnelsMutex.Unlock()
+	content, err := ref.read()
+	if want := strings.Repeat("a", 20) + strings.Repeat("b", appends); err != nil || content != want {
+		t.Errorf("content = %q, %v, want %q", content, err, want)
+	}
+	if files := spillFiles(t); len(files) != 1 {
+		t.Errorf("spill files = %v, want only the current content's", files)
+	}
+}
+
+func TestSubChannelSizesOfStoredContent(t *testing.T) {
+	tunnel := setupSpill(t)
+	setFlag(t, spillThreshold, 100)
+	setFlag(t, compressContent, true)
+	setFlag(t, compressThreshold, 10)
+	sendContent(tunnel, StreamMessage{SubChannel: "compressed", Content: strings.Repeat("c", 50)})
+	sendContent(tunnel, StreamMessage{SubChannel: "plain", Content: "p"})
+	sendContent(tunnel, StreamMessage{SubChannel: "spilled", Content: strings.Repeat("s", 200)})
+
+	w := httptest.NewRecorder()
+	listSubChannels(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/subchannels?id=spill", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var list []struct {
+		Name string `json:"name"`
+		Size int    `json:"size"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	sizes := make(map[string]int)
+	for _, entry := range list {
+		sizes[entry.Name] = entry.Size
+	}
+	want := map[string]int{"compressed": 50, "plain": 1, "spilled": 200}
+	for name, size := range want {
+		if sizes[name] != size {
+			t.Errorf("size of %s = %d, want %d", name, sizes[name], size)
+		}
+	}
+
+	// Sizing releases the spill file it retained, so it is still removed
+	// with its subchannel.
+	dropSubChannel(tunnel, "spilled", closeReasonDeleted)
+	if files := spillFiles(t); len(files) != 0 {
+		t.Errorf("spill files = %v, want none once the subchannel is gone", files)
+	}
+}
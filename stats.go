@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// recordMessage counts a message sent to the tunnel, for its stats and
+// throughput. It must be called with tunnelsMutex held.
+func (t *Tunnel) recordMessage(now time.Time, bytes int) {
+	t.MessagesSent++
+	t.BytesSent += uint64(bytes)
+	t.LastMessageAt = now
+	t.Throughput.record(now, bytes)
+}
+
+// tunnelStats reports how busy a tunnel is, which helps to find abandoned
+// and hot tunnels.
+func tunnelStats(w http.ResponseWriter, r *http.Request) {
+	params, ok := parseTunnelParams(w, r)
+	if !ok {
+		return
+	}
+	tunnelId := params.ID
+
+	if !params.checkID(w, r) {
+		return
+	}
+
+	tunnelsMutex.Lock()
+	tunnel, exists := liveTunnel(tunnelId)
+	if !exists {
+		tunnelsMutex.Unlock()
+		slog.WarnContext(r.Context(), "No tunnel with this id exists", "tunnel_id", tunnelId, "status", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, "No tunnel with this id exists.")
+		return
+	}
+	if status := tunnel.secretStatus(r, params); status != http.StatusOK {
+		tunnelsMutex.Unlock()
+		rejectSecret(w, r, status, tunnelId)
+		return
+	}
+	messagesPerSecond, bytesPerSecond := tunnel.Throughput.rates(time.Now())
+	stats := map[string]interface{}{
+		"id":                tunnelId,
+		"createdAt":         tunnel.CreatedAt.UTC().Format(time.RFC3339),
+		"messagesSent":      tunnel.MessagesSent,
+		"bytesSent":         tunnel.BytesSent,
+		"messagesPerSecond": messagesPerSecond,
+		"bytesPerSecond":    bytesPerSecond,
+	}
+	if !tunnel.LastMessageAt.IsZero() {
+		stats["lastMessageAt"] = tunnel.LastMessageAt.UTC().Format(time.RFC3339)
+	}
+	stats["lastActivityAt"] = tunnel.LastActivity.UTC().Format(time.RFC3339)
+	tunnelsMutex.Unlock()
+
+	stats["subscribers"] = tunnelSubscribers(tunnelId)
+	writeJSON(w, r, stats)
+	slog.InfoContext(r.Context(), "Served stats", "tunnel_id", tunnelId)
+}
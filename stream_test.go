@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nonFlushingWriter is a ResponseWriter that can't flush, as some proxies
+// and middleware provide.
+type nonFlushingWriter struct {
+	header http.Header
+	status int
+	body   []byte
+}
+
+func (w *nonFlushingWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *nonFlushingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body = append(w.body, b...)
+	return len(b), nil
+}
+
+func (w *nonFlushingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func TestStreamsWithoutFlusherAnswer500(t *testing.T) {
+	resetTunnels(t)
+	addTestTunnel("flush")
+
+	streams := map[string]http.HandlerFunc{
+		"/api/v3/tunnel/stream?id=flush": streamTunnelContent,
+		"/api/v3/tunnel/mux":             streamMultiplexed,
+	}
+	for target, handler := range streams {
+		w := &nonFlushingWriter{}
+		handler(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+		if w.status != http.StatusInternalServerError {
+			t.Errorf("%s answered %d, want %d", target, w.status, http.StatusInternalServerError)
+		}
+		var body struct{ Error string }
+		if err := json.Unmarshal(w.body, &body); err != nil || body.Error != "Streaming is not supported by this server." {
+			t.Errorf("%s answered %q, want the streaming error", target, w.body)
+		}
+	}
+}
+
+// streamData sends the data lines of an SSE stream to a channel, which is
+// closed when the stream ends.
+func streamData(stream io.Reader) <-chan string {
+	data := make(chan string, 16)
+	go func() {
+		defer close(data)
+		scanner := bufio.NewScanner(stream)
+		for scanner.Scan() {
+			if line, found := strings.CutPrefix(scanner.Text(), "data: "); found {
+				data <- line
+			}
+		}
+	}()
+	return data
+}
+
+// receiveData waits for the next data line of a stream.
+func receiveData(t *testing.T, data <-chan string) string {
+	t.Helper()
+	select {
+	case line, ok := <-data:
+		if !ok {
+			t.Fatal("the stream ended")
+		}
+		return line
+	case <-time.After(time.Second):
+		t.Fatal("no data on the stream")
+		return ""
+	}
+}
+
+// noData checks that a stream has no data line waiting.
+func noData(t *testing.T, data <-chan string) {
+	t.Helper()
+	select {
+	case line := <-data:
+		t.Errorf("stream got %q, want nothing", line)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStreamWithMinSequenceReplaysFromTheCursor(t *testing.T) {
+	resetTunnels(t)
+	addTestTunnel("cursor")
+	send := func(content string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		sendToTunnel(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/send?id=cursor&content="+content, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("send answered %d: %s", w.Code, w.Body)
+		}
+	}
+	for _, content := range []string{"m1", "m2", "m3", "m4", "m5"} {
+		send(content)
+	}
+	server := httptest.NewServer(http.HandlerFunc(streamTunnelContent))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?id=cursor&minSequence=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := streamData(resp.Body)
+	for _, want := range []string{"m3", "m4", "m5"} {
+		if got := receiveData(t, data); got != want {
+			t.Fatalf("replayed %q, want %q", got, want)
+		}
+	}
+	waitForSubscribers(t, "cursor", 1)
+	send("m6")
+	if got := receiveData(t, data); got != "m6" {
+		t.Errorf("got %q live, want m6", got)
+	}
+	resp.Body.Close()
+	waitForSubscribers(t, "cursor", 0)
+
+	// A cursor ahead of the tunnel skips live messages until it is reached.
+	resp, err = http.Get(server.URL + "?id=cursor&minSequence=8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data = streamData(resp.Body)
+	waitForSubscribers(t, "cursor", 1)
+	noData(t, data)
+	send("m7")
+	send("m8")
+	if got := receiveData(t, data); got != "m8" {
+		t.Errorf("got %q, want m8, the first message at the cursor", got)
+	}
+}
+
+func TestLastEventIDBeyondMinSequenceWins(t *testing.T) {
+	resetTunnels(t)
+	addTestTunnel("cursor")
+	for _, content := range []string{"m1", "m2", "m3"} {
+		w := httptest.NewRecorder()
+		sendToTunnel(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/send?id=cursor&content="+content, nil))
+	}
+	server := httptest.NewServer(http.HandlerFunc(streamTunnelContent))
+	defer server.Close()
+
+	r, err := http.NewRequest(http.MethodGet, server.URL+"?id=cursor&minSequence=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Last-Event-ID", "2")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data := streamData(resp.Body)
+	if got := receiveData(t, data); got != "m3" {
+		t.Errorf("replayed %q first, want m3 after Last-Event-ID 2", got)
+	}
+	noData(t, data)
+}
+
+func TestStreamRejectsAnInvalidMinSequence(t *testing.T) {
+	resetTunnels(t)
+	addTestTunnel("cursor")
+
+	for _, value := range []string{"-1", "two", "1.5"} {
+		w := httptest.NewRecorder()
+		streamTunnelContent(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/stream?id=cursor&minSequence="+value, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("minSequence %s answered %d, want %d", value, w.Code, http.StatusBadRequest)
+		}
+	}
+}
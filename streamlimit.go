@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var maxStreamsPerTunnel = flag.Int("max-streams-per-tunnel", 0, "Maximum open streams per tunnel (0 means unlimited)")
+var streamQueueSize = flag.Int("stream-queue-size", 0, "How many streams may wait for a slot on a full tunnel before new ones are rejected")
+var streamQueueTimeout = flag.Duration("stream-queue-timeout", 10*time.Second, "How long a queued stream waits for a slot before giving up")
+var maxConnections = flag.Int("max-connections", 0, "Maximum open streams across all tunnels, including WebSockets and multiplexed streams (0 means unlimited)")
+var streamIdleTimeout = flag.Duration("stream-idle-timeout", 0, "Close streams that have delivered nothing for this long while their tunnel was idle too (0 disables)")
+
+// resetTimer restarts a timer whose channel may have fired without being
+// read.
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+var errStreamQueueFull = errors.New("stream queue is full")
+var errStreamQueueTimeout = errors.New("timed out waiting for a stream slot")
+
+// streamSlots limits the open streams of one tunnel. Each open stream holds
+// one value in slots; waiting counts the streams queued for a free slot.
+type streamSlots struct {
+	slots   chan struct{}
+	waiting int
+}
+
+var tunnelStreamSlots = make(map[string]*streamSlots)
+var tunnelStreamSlotsMutex = &sync.Mutex{}
+
+// openConnections counts the streams holding a -max-connections slot.
+// Guarded by tunnelStreamSlotsMutex.
+var openConnections int
+
+// acquireConnection takes one of the server's -max-connections slots, and
+// returns false without waiting if all of them are taken. Each successful
+// call must be paired with releaseConnection.
+func acquireConnection() bool {
+	if *maxConnections <= 0 {
+		return true
+	}
+	tunnelStreamSlotsMutex.Lock()
+	defer tunnelStreamSlotsMutex.Unlock()
+	if openConnections >= *maxConnections {
+		return false
+	}
+	openConnections++
+	return true
+}
+
+func releaseConnection() {
+	if *maxConnections <= 0 {
+		return
+	}
+	tunnelStreamSlotsMutex.Lock()
+	openConnections--
+	tunnelStreamSlotsMutex.Unlock()
+}
+
+// rejectTooManyConnections answers a stream refused by acquireConnection.
+func rejectTooManyConnections(w http.ResponseWriter, r *http.Request) {
+	slog.WarnContext(r.Context(), "Too many open streams", "status", http.StatusServiceUnavailable)
+	writeJSONError(w, http.StatusServiceUnavailable, "Too many open streams on this server. Please try again later.")
+}
+
+// acquireStreamSlot takes one of the tunnel's -max-streams-per-tunnel slots,
+// queueing for up to -stream-queue-timeout when all of them are taken. The
+// returned slots must be handed to releaseStreamSlot once the stream closes.
+func acquireStreamSlot(ctx context.Context, tunnelId string) (*streamSlots, error) {
+	if *maxStreamsPerTunnel <= 0 {
+		return nil, nil
+	}
+
+	tunnelStreamSlotsMutex.Lock()
+	slots, exists := tunnelStreamSlots[tunnelId]
+	if !exists {
+		slots = &streamSlots{slots: make(chan struct{}, *maxStreamsPerTunnel)}
+		tunnelStreamSlots[tunnelId] = slots
+	}
+	select {
+	case slots.slots <- struct{}{}:
+		tunnelStreamSlotsMutex.Unlock()
+		return slots, nil
+	default:
+	}
+	if slots.waiting >= *streamQueueSize {
+		tunnelStreamSlotsMutex.Unlock()
+		return nil, errStreamQueueFull
+	}
+	slots.waiting++
+	tunnelStreamSlotsMutex.Unlock()
+
+	timer := time.NewTimer(*streamQueueTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case slots.slots <- struct{}{}:
+	case <-timer.C:
+		err = errStreamQueueTimeout
+	case <-shuttingDown:
+		err = errStreamQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	tunnelStreamSlotsMutex.Lock()
+	slots.waiting--
+	if err != nil {
+		slots.forget(tunnelId)
+	}
+	tunnelStreamSlotsMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return slots, nil
+}
+
+// releaseStreamSlot frees a slot taken with acquireStreamSlot, letting a
+// queued stream in.
+func releaseStreamSlot(tunnelId string, slots *streamSlots) {
+	if slots == nil {
+		return
+	}
+	tunnelStreamSlotsMutex.Lock()
+	<-slots.slots
+	slots.forget(tunnelId)
+	tunnelStreamSlotsMutex.Unlock()
+}
+
+// forget drops the tunnel's entry once no stream holds or waits for a slot.
+// Must be called with tunnelStreamSlotsMutex held.
+func (s *streamSlots) forget(tunnelId string) {
+	if len(s.slots) == 0 && s.waiting == 0 && tunnelStreamSlots[tunnelId] == s {
+		delete(tunnelStreamSlots, tunnelId)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// listSubChannels lists the subchannels of a tunnel that currently hold
+// content, with the size of each, so clients don't need to know the names
+// in advance. Queue subchannels also report how many messages are pending.
+func listSubChannels(w http.ResponseWriter, r *http.Request) {
+	params, ok := parseTunnelParams(w, r)
+	if !ok {
+		return
+	}
+	tunnelId := params.ID
+
+	if !params.checkID(w, r) {
+		return
+	}
+
+	tunnelsMutex.Lock()
+	tunnel, exists := liveTunnel(tunnelId)
+	if !exists {
+		tunnelsMutex.Unlock()
+		slog.WarnContext(r.Context(), "No tunnel with this id exists", "tunnel_id", tunnelId, "status", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, "No tunnel with this id exists.")
+		return
+	}
+	if status := tunnel.secretStatus(r, params); status != http.StatusOK {
+		tunnelsMutex.Unlock()
+		rejectSecret(w, r, status, tunnelId)
+		return
+	}
+	tunnel.pruneQueues(time.Now())
+	names := make([]string, 0, len(tunnel.SubChannels)+len(tunnel.Spilled)+len(tunnel.Queues))
+	for subChannel := range tunnel.SubChannels {
+		names = append(names, subChannel)
+	}
+	for subChannel := range tunnel.Spilled {
+		names = append(names, subChannel)
+	}
+	for subChannel := range tunnel.Queues {
+		names = append(names, subChannel)
+	}
+	sort.Strings(names)
+	list := make([]map[string]interface{}, 0, len(names))
+	// Sizes are worked out once tunnelsMutex is released, as compressed
+	// content is decompressed to measure it.
+	refs := make(map[int]contentRef)
+	for _, subChannel := range names {
+		if queue, queued := tunnel.Queues[subChannel]; queued {
+			size := 0
+			for _, msg := range queue {
+				size += len(msg.Content)
+			}
+			list = append(list, map[string]interface{}{"name": subChannel, "size": size, "pending": len(queue)})
+			continue
+		}
+		refs[len(list)] = tunnel.contentRef(subChannel)
+		list = append(list, map[string]interface{}{"name": subChannel})
+	}
+	tunnelsMutex.Unlock()
+
+	// Every ref is sized, even after an error, so none of their spill files
+	// is left retained.
+	var sizeErr error
+	for i, ref := range refs {
+		size, err := ref.size()
+		if err != nil && sizeErr == nil {
+			sizeErr = err
+		}
+		list[i]["size"] = size
+	}
+	if sizeErr != nil {
+		slog.ErrorContext(r.Context(), "Failed to read content size", "error", sizeErr, "status", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read content")
+		return
+	}
+
+	writeJSON(w, r, list)
+	slog.InfoContext(r.Context(), "Listed subchannels", "tunnel_id", tunnelId)
+}
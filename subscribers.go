@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var deliveryDeadline = flag.Duration("delivery-deadline", 5*time.Second, "How long a send waits on a slow subscriber before dropping the message for it (0 waits indefinitely)")
+var maxConsecutiveDrops = flag.Int("max-consecutive-drops", 3, "Disconnect a subscriber after this many consecutive dropped messages")
+var maxWildcardPerTunnel = flag.Int("max-wildcard-per-tunnel", 0, "Maximum subscribers to all subchannels of one tunnel (0 means unlimited)")
+var subscriberBuffer = flag.Int("subscriber-buffer", 16, "Messages buffered for each stream subscriber before it counts as slow")
+var slowSubscriberPolicy = flag.String("slow-subscriber", slowSubscriberWait, "What to do when a subscriber's buffer is full: wait (up to -delivery-deadline), drop-oldest or disconnect")
+var maxWildcardTotal = flag.Int("max-wildcard-total", 0, "Maximum subscribers to all subchannels across all tunnels (0 means unlimited)")
+
+var errTooManyWildcardSubscribers = errors.New("too many wildcard subscribers")
+
+// The -slow-subscriber policies.
+const (
+	slowSubscriberWait       = "wait"
+	slowSubscriberDropOldest = "drop-oldest"
+	slowSubscriberDisconnect = "disconnect"
+)
+
+func validSlowSubscriberPolicy(policy string) error {
+	switch policy {
+	case slowSubscriberWait, slowSubscriberDropOldest, slowSubscriberDisconnect:
+		return nil
+	}
+	return fmt.Errorf("unknown policy %q, expected wait, drop-oldest or disconnect", policy)
+}
+
+// droppedMessages counts messages dropped for slow subscribers.
+var droppedMessages atomic.Uint64
+
+// Subscriber is a stream registered in clients. Messages buffers up to
+// -subscriber-buffer messages and is closed when the tunnel is removed,
+// Evicted when the subscriber is disconnected for being too slow. Streams
+// receive through next, which takes messages sent with priority first.
+type Subscriber struct {
+	Messages chan StreamMessage
+	Evicted  chan struct{}
+	// priority buffers messages sent with priority while others wait in
+	// Messages, so they overtake them. It is never closed. laneMutex keeps
+	// next from waiting on Messages while a message is put in priority, see
+	// lane.
+	priority  chan StreamMessage
+	laneMutex sync.Mutex
+	// gone is closed as soon as the subscriber is being closed, so a delivery
+	// waiting on it gives up right away.
+	gone     chan struct{}
+	goneOnce sync.Once
+	// mutex serializes deliveries with closing Messages. Broadcasts run
+	// outside clientsMutex, so this is what keeps them from sending on a
+	// closed channel. It guards the fields below.
+	mutex   sync.Mutex
+	closed  bool
+	evicted bool
+	// drops counts consecutive messages that could not be delivered in time.
+	drops int
+	// pushed counts the messages put in Messages, lastPriority is the count
+	// at the last one sent with priority, to tell whether it is still there.
+	pushed       uint64
+	lastPriority uint64
+	// closeReason says why the tunnel was removed. It is set before Messages
+	// is closed, so it is safe to read once Messages is drained.
+	closeReason string
+}
+
+func newSubscriber() *Subscriber {
+	return &Subscriber{
+		Messages: make(chan StreamMessage, *subscriberBuffer),
+		priority: make(chan StreamMessage, *subscriberBuffer),
+		Evicted:  make(chan struct{}),
+		gone:     make(chan struct{}),
+	}
+}
+
+// next returns the channel to take the subscriber's next message from:
+// priority while it holds messages, Messages otherwise.
+func (s *Subscriber) next() <-chan StreamMessage {
+	s.laneMutex.Lock()
+	defer s.laneMutex.Unlock()
+	if len(s.priority) > 0 {
+		return s.priority
+	}
+	return s.Messages
+}
+
+// lane returns the channel a message goes to. A message sent with priority
+// goes to priority when there is something to overtake in Messages, or when
+// priority already holds messages it has to follow. Otherwise it goes to
+// Messages, which wakes a stream waiting there, and later ones follow it
+// there until it is taken. Only the stream takes messages out of Messages
+// and priority only gets its first message while Messages is not empty, so
+// a stream waiting on Messages always comes back for it. It must be called
+// with laneMutex and the subscriber's mutex held.
+func (s *Subscriber) lane(msg StreamMessage) chan StreamMessage {
+	if !msg.Priority {
+		return s.Messages
+	}
+	// Messages holds the last len(Messages) messages put there.
+	priorityWaiting := s.lastPriority > 0 && uint64(len(s.Messages)) > s.pushed-s.lastPriority
+	if !priorityWaiting && (len(s.Messages) > 0 || len(s.priority) > 0) {
+		return s.priority
+	}
+	return s.Messages
+}
+
+// sent records a message put in a lane. It must be called with the
+// subscriber's mutex held.
+func (s *Subscriber) sent(lane chan StreamMessage, msg StreamMessage) {
+	s.drops = 0
+	if lane != s.Messages {
+		return
+	}
+	s.pushed++
+	if msg.Priority {
+		s.lastPriority = s.pushed
+	}
+}
+
+// push puts a message in its lane without waiting and reports whether there
+// was room. It must be called with the subscriber's mutex held.
+func (s *Subscriber) push(msg StreamMessage) (chan StreamMessage, bool) {
+	s.laneMutex.Lock()
+	defer s.laneMutex.Unlock()
+	lane := s.lane(msg)
+	select {
+	case lane <- msg:
+		s.sent(lane, msg)
+		return lane, true
+	default:
+		return lane, false
+	}
+}
+
+// close ends the subscription because the tunnel or subchannel was removed.
+func (s *Subscriber) close(reason string) {
+	s.goneOnce.Do(func() { close(s.gone) })
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.closeReason = reason
+	close(s.Messages)
+}
+
+// addSubscriber registers a subscriber in clients. Subscriptions to all
+// subchannels receive every message of the tunnel, so they are capped by
+// -max-wildcard-per-tunnel and -max-wildcard-total. A pending auto-deletion
+// of the tunnel is called off.
+func addSubscriber(tunnelId string, subChannel string, subscriber *Subscriber) error {
+	clientsMutex.Lock()
+	if subChannel == wildcardSubChannel {
+		if (*maxWildcardPerTunnel > 0 && len(clients[tunnelId][wildcardSubChannel]) >= *maxWildcardPerTunnel) ||
+			(*maxWildcardTotal > 0 && wildcardSubscribers() >= *maxWildcardTotal) {
+			clientsMutex.Unlock()
+			return errTooManyWildcardSubscribers
+		}
+	}
+
+	if clients[tunnelId] == nil {
+		clients[tunnelId] = make(map[string][]*Subscriber)
+	}
+	clients[tunnelId][subChannel] = append(clients[tunnelId][subChannel], subscriber)
+	clientsMutex.Unlock()
+
+	cancelAutoDelete(tunnelId)
+	return nil
+}
+
+// wildcardSubscribers counts the subscribers to all subchannels across all
+// tunnels. It must be called with clientsMutex held.
+func wildcardSubscribers() int {
+	subscribers := 0
+	for _, subChannels := range clients {
+		subscribers += len(subChannels[wildcardSubChannel])
+	}
+	return subscribers
+}
+
+func removeSubscriber(tunnelId string, subChannel string, subscriber *Subscriber) {
+	clientsMutex.Lock()
+	unlinkSubscriber(tunnelId, subChannel, subscriber)
+	clientsMutex.Unlock()
+
+	if tunnelSubscribers(tunnelId) == 0 {
+		scheduleAutoDelete(tunnelId)
+	}
+}
+
+// unlinkSubscriber must be called with clientsMutex held.
+func unlinkSubscriber(tunnelId string, subChannel string, subscriber *Subscriber) {
+	for i, client := range clients[tunnelId][subChannel] {
+		if client == subscriber {
+			clients[tunnelId][subChannel] = append(clients[tunnelId][subChannel][:i], clients[tunnelId][subChannel][i+1:]...)
+			break
+		}
+	}
+}
+
+type delivery struct {
+	subChannel string
+	subscriber *Subscriber
+}
+
+// broadcast delivers a message to every stream subscribed to the subchannel.
+// Subscribers to all subchannels receive it as well. Subscribers are
+// collected under clientsMutex but delivered to without it, so a slow
+// subscriber only holds up this send, never the rest of the server.
+func broadcast(tunnelId string, subChannel string, msg StreamMessage) {
+	msg.SubChannel = subChannel
+	var deliveries []delivery
+	clientsMutex.Lock()
+	for _, listenChannel := range []string{subChannel, wildcardSubChannel} {
+		for _, subscriber := range clients[tunnelId][listenChannel] {
+			deliveries = append(deliveries, delivery{subChannel: listenChannel, subscriber: subscriber})
+		}
+	}
+	clientsMutex.Unlock()
+
+	// Subscribers that are not ready right away are waited for in parallel,
+	// so the send takes at most one -delivery-deadline.
+	var wg sync.WaitGroup
+	for _, d := range deliveries {
+		if d.subscriber.offer(msg) {
+			continue
+		}
+		wg.Add(1)
+		go func(d delivery) {
+			defer wg.Done()
+			deliver(tunnelId, d.subChannel, d.subscriber, msg)
+		}(d)
+	}
+	wg.Wait()
+}
+
+// offer hands a message to a subscriber that is ready for it without
+// waiting. It returns false if the subscriber is busy.
+func (s *Subscriber) offer(msg StreamMessage) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed || s.evicted {
+		return true
+	}
+	_, ok := s.push(msg)
+	return ok
+}
+
+// deliver hands a message to a subscriber whose buffer is full, as
+// -slow-subscriber says: by waiting at most -delivery-deadline, by making
+// room with the oldest buffered message, or by disconnecting it. A waited
+// for subscriber that misses -max-consecutive-drops messages in a row is
+// evicted. A message sent with priority only waits for the other messages
+// sent with priority.
+func deliver(tunnelId string, subChannel string, subscriber *Subscriber, msg StreamMessage) {
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+	if subscriber.closed || subscriber.evicted {
+		return
+	}
+	// Others may have made room since the offer. A lane that is still full
+	// stays non-empty while it is waited on, so the stream keeps reading it.
+	lane, ok := subscriber.push(msg)
+	if ok {
+		return
+	}
+
+	switch *slowSubscriberPolicy {
+	case slowSubscriberDropOldest:
+		// Only deliveries, which hold the mutex, add to the lanes, so once
+		// the oldest message is taken out there is room for this one.
+		select {
+		case <-lane:
+			droppedMessages.Add(1)
+			slog.Warn("Dropped oldest message for slow subscriber", "tunnel_id", tunnelId, "subchannel", subChannel)
+		default:
+		}
+		lane <- msg
+		subscriber.sent(lane, msg)
+		return
+	case slowSubscriberDisconnect:
+		droppedMessages.Add(1)
+		subscriber.evict(tunnelId, subChannel)
+		return
+	}
+
+	var deadline <-chan time.Time
+	if *deliveryDeadline > 0 {
+		timer := time.NewTimer(*deliveryDeadline)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	select {
+	case lane <- msg:
+		subscriber.sent(lane, msg)
+		return
+	case <-subscriber.gone:
+		return
+	case <-deadline:
+	}
+
+	subscriber.drops++
+	droppedMessages.Add(1)
+	slog.Warn("Dropped message for slow subscriber", "tunnel_id", tunnelId, "subchannel", subChannel)
+
+	if *maxConsecutiveDrops > 0 && subscriber.drops >= *maxConsecutiveDrops {
+		subscriber.evict(tunnelId, subChannel)
+	}
+}
+
+// evict disconnects a subscriber for being too slow. It must be called with
+// the subscriber's mutex held.
+func (s *Subscriber) evict(tunnelId string, subChannel string) {
+	s.evicted = true
+	clientsMutex.Lock()
+	unlinkSubscriber(tunnelId, subChannel, s)
+	clientsMutex.Unlock()
+	close(s.Evicted)
+	slog.Warn("Evicted slow subscriber", "tunnel_id", tunnelId, "subchannel", subChannel)
+}
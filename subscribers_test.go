@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// receiveAll takes the messages buffered for a subscriber, in the order a
+// stream gets them.
+func receiveAll(subscriber *Subscriber) []string {
+	var received []string
+	for {
+		select {
+		case msg := <-subscriber.next():
+			received = append(received, msg.Content)
+		default:
+			return received
+		}
+	}
+}
+
+func TestPriorityMessagesOvertakeBufferedOnes(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, subscriberBuffer, 4)
+	subscriber := newSubscriber()
+	if err := addSubscriber("prio", "main", subscriber); err != nil {
+		t.Fatal(err)
+	}
+
+	broadcast("prio", "main", StreamMessage{Content: "normal 1"})
+	broadcast("prio", "main", StreamMessage{Content: "normal 2"})
+	broadcast("prio", "main", StreamMessage{Content: "urgent 1", Priority: true})
+	broadcast("prio", "main", StreamMessage{Content: "urgent 2", Priority: true})
+	broadcast("prio", "main", StreamMessage{Content: "normal 3"})
+
+	want := []string{"urgent 1", "urgent 2", "normal 1", "normal 2", "normal 3"}
+	if got := receiveAll(subscriber); !slices.Equal(got, want) {
+		t.Fatalf("received %q, want %q", got, want)
+	}
+}
+
+func TestPriorityMessagesKeepTheirOrder(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, subscriberBuffer, 4)
+	subscriber := newSubscriber()
+	if err := addSubscriber("prio", "main", subscriber); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first urgent message has nothing to overtake, so the second one
+	// has to wait behind it.
+	broadcast("prio", "main", StreamMessage{Content: "urgent 1", Priority: true})
+	broadcast("prio", "main", StreamMessage{Content: "normal 1"})
+	broadcast("prio", "main", StreamMessage{Content: "urgent 2", Priority: true})
+
+	want := []string{"urgent 1", "normal 1", "urgent 2"}
+	if got := receiveAll(subscriber); !slices.Equal(got, want) {
+		t.Fatalf("received %q, want %q", got, want)
+	}
+}
+
+func TestPriorityMessageWakesAWaitingStream(t *testing.T) {
+	resetTunnels(t)
+	subscriber := newSubscriber()
+	if err := addSubscriber("prio", "main", subscriber); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string)
+	go func() {
+		msg := <-subscriber.next()
+		received <- msg.Content
+	}()
+
+	broadcast("prio", "main", StreamMessage{Content: "urgent", Priority: true})
+
+	select {
+	case content := <-received:
+		if content != "urgent" {
+			t.Fatalf("received %q, want %q", content, "urgent")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting stream did not get the priority message")
+	}
+}
+
+func TestPriorityDropsTheOldestPriorityMessage(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, subscriberBuffer, 1)
+	setFlag(t, slowSubscriberPolicy, slowSubscriberDropOldest)
+	subscriber := newSubscriber()
+	if err := addSubscriber("prio", "main", subscriber); err != nil {
+		t.Fatal(err)
+	}
+
+	broadcast("prio", "main", StreamMessage{Content: "normal"})
+	broadcast("prio", "main", StreamMessage{Content: "urgent 1", Priority: true})
+	broadcast("prio", "main", StreamMessage{Content: "urgent 2", Priority: true})
+
+	want := []string{"urgent 2", "normal"}
+	if got := receiveAll(subscriber); !slices.Equal(got, want) {
+		t.Fatalf("received %q, want %q", got, want)
+	}
+}
+
+func TestSendRejectsUnknownPriority(t *testing.T) {
+	resetTunnels(t)
+	addTestTunnel("prio")
+
+	for priority, status := range map[string]int{"high": http.StatusOK, "normal": http.StatusOK, "urgent": http.StatusBadRequest} {
+		w := httptest.NewRecorder()
+		sendToTunnel(w, httptest.NewRequest(http.MethodGet, "/api/v3/tunnel/send?id=prio&content=hi&priority="+priority, nil))
+		if w.Code != status {
+			t.Errorf("priority %q answered %d, want %d: %s", priority, w.Code, status, w.Body)
+		}
+	}
+}
+
+// slowSubscriber registers a subscriber whose buffer of one message is
+// already full, and that never reads.
+func slowSubscriber(t *testing.T) *Subscriber {
+	t.Helper()
+	resetTunnels(t)
+	setFlag(t, subscriberBuffer, 1)
+	setFlag(t, slowSubscriberPolicy, slowSubscriberWait)
+	setFlag(t, deliveryDeadline, 10*time.Millisecond)
+	setFlag(t, maxConsecutiveDrops, 3)
+	subscriber := newSubscriber()
+	if err := addSubscriber("slow", "main", subscriber); err != nil {
+		t.Fatal(err)
+	}
+	broadcast("slow", "main", StreamMessage{Content: "fills the buffer"})
+	return subscriber
+}
+
+func evicted(subscriber *Subscriber) bool {
+	select {
+	case <-subscriber.Evicted:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSlowSubscriberIsEvictedAfterConsecutiveDrops(t *testing.T) {
+	subscriber := slowSubscriber(t)
+	dropped := droppedMessages.Load()
+
+	for i := 1; i <= 3; i++ {
+		started := time.Now()
+		broadcast("slow", "main", StreamMessage{Content: "dropped"})
+		if waited := time.Since(started); waited < *deliveryDeadline {
+			t.Errorf("send %d returned after %v, before the delivery deadline", i, waited)
+		}
+		if evicted(subscriber) != (i == 3) {
+			t.Fatalf("after %d drops evicted = %t", i, evicted(subscriber))
+		}
+	}
+	if got := droppedMessages.Load() - dropped; got != 3 {
+		t.Errorf("counted %d dropped messages, want 3", got)
+	}
+	if subscribers := tunnelSubscribers("slow"); subscribers != 0 {
+		t.Errorf("evicted subscriber is still one of %d subscribers", subscribers)
+	}
+
+	// Sends to an evicted subscriber no longer wait for it.
+	started := time.Now()
+	broadcast("slow", "main", StreamMessage{Content: "after eviction"})
+	if waited := time.Since(started); waited >= *deliveryDeadline {
+		t.Errorf("send after eviction waited %v", waited)
+	}
+}
+
+func TestDeliveryResetsTheDropCount(t *testing.T) {
+	subscriber := slowSubscriber(t)
+
+	broadcast("slow", "main", StreamMessage{Content: "dropped 1"})
+	broadcast("slow", "main", StreamMessage{Content: "dropped 2"})
+	<-subscriber.next()
+	broadcast("slow", "main", StreamMessage{Content: "delivered"})
+	broadcast("slow", "main", StreamMessage{Content: "dropped 3"})
+	broadcast("slow", "main", StreamMessage{Content: "dropped 4"})
+
+	if evicted(subscriber) {
+		t.Fatal("subscriber was evicted although a delivery came between its drops")
+	}
+	broadcast("slow", "main", StreamMessage{Content: "dropped 5"})
+	if !evicted(subscriber) {
+		t.Fatal("subscriber was not evicted after 3 consecutive drops")
+	}
+}
+
+func TestDisconnectPolicyEvictsRightAway(t *testing.T) {
+	subscriber := slowSubscriber(t)
+	setFlag(t, slowSubscriberPolicy, slowSubscriberDisconnect)
+
+	broadcast("slow", "main", StreamMessage{Content: "no room"})
+	if !evicted(subscriber) {
+		t.Fatal("subscriber was not evicted on its first full buffer")
+	}
+}
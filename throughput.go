@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// throughputWindow is how far back throughput rates look. It is divided into
+// one-second buckets.
+const throughputWindow = 60
+
+type throughputBucket struct {
+	second   int64
+	messages uint64
+	bytes    uint64
+}
+
+// throughput counts the messages sent to a tunnel in a ring of one-second
+// buckets covering the last throughputWindow seconds. It is guarded by
+// tunnelsMutex like the rest of the tunnel.
+type throughput struct {
+	buckets [throughputWindow]throughputBucket
+}
+
+func (t *throughput) record(now time.Time, bytes int) {
+	second := now.Unix()
+	bucket := &t.buckets[second%throughputWindow]
+	if bucket.second != second {
+		*bucket = throughputBucket{second: second}
+	}
+	bucket.messages++
+	bucket.bytes += uint64(bytes)
+}
+
+// rates returns the average messages and bytes per second over the window.
+func (t *throughput) rates(now time.Time) (messagesPerSecond float64, bytesPerSecond float64) {
+	second := now.Unix()
+	var messages, bytes uint64
+	for _, bucket := range t.buckets {
+		if second-bucket.second < throughputWindow {
+			messages += bucket.messages
+			bytes += bucket.bytes
+		}
+	}
+	return float64(messages) / throughputWindow, float64(bytes) / throughputWindow
+}
+
+// tunnelThroughput is how busy a tunnel is, as reported by the admin
+// endpoint and the per-tunnel metrics.
+type tunnelThroughput struct {
+	ID string `json:"id"`
+	// MetricsLabel is what the tunnel is labelled with in the metrics.
+	MetricsLabel      string  `json:"metricsLabel"`
+	MessagesPerSecond float64 `json:"messagesPerSecond"`
+	BytesPerSecond    float64 `json:"bytesPerSecond"`
+	messagesSent      uint64
+	bytesSent         uint64
+}
+
+// tunnelThroughputs returns the throughput of every tunnel, or of the one
+// with tunnelId if it is set, busiest first by messages per second.
+func tunnelThroughputs(tunnelId string, now time.Time) []tunnelThroughput {
+	rates := []tunnelThroughput{}
+	tunnelsMutex.Lock()
+	for id, tunnel := range tunnels {
+		if tunnelId != "" && id != tunnelId {
+			continue
+		}
+		messagesPerSecond, bytesPerSecond := tunnel.Throughput.rates(now)
+		rates = append(rates, tunnelThroughput{ID: id, MessagesPerSecond: messagesPerSecond, BytesPerSecond: bytesPerSecond, messagesSent: tunnel.MessagesSent, bytesSent: tunnel.BytesSent})
+	}
+	tunnelsMutex.Unlock()
+	for i := range rates {
+		rates[i].MetricsLabel = tunnelMetricsLabel(rates[i].ID)
+	}
+
+	sort.Slice(rates, func(i, j int) bool {
+		if rates[i].MessagesPerSecond != rates[j].MessagesPerSecond {
+			return rates[i].MessagesPerSecond > rates[j].MessagesPerSecond
+		}
+		if rates[i].BytesPerSecond != rates[j].BytesPerSecond {
+			return rates[i].BytesPerSecond > rates[j].BytesPerSecond
+		}
+		return rates[i].ID < rates[j].ID
+	})
+	return rates
+}
+
+// adminThroughput reports the busiest tunnels by messages per second, or a
+// single tunnel when an `id` is given.
+func adminThroughput(w http.ResponseWriter, r *http.Request) {
+	tunnelId := r.URL.Query().Get("id")
+	top := 10
+	if value := r.URL.Query().Get("top"); value != "" {
+		var err error
+		top, err = strconv.Atoi(value)
+		if err != nil || top < 1 {
+			slog.WarnContext(r.Context(), "Invalid 'top' value", "value", value, "status", http.StatusBadRequest)
+			writeJSONError(w, http.StatusBadRequest, "The 'top' value must be a positive integer")
+			return
+		}
+	}
+
+	rates := tunnelThroughputs(tunnelId, time.Now())
+	if tunnelId != "" && len(rates) == 0 {
+		slog.WarnContext(r.Context(), "No tunnel with this id exists", "tunnel_id", tunnelId, "status", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, "No tunnel with this id exists.")
+		return
+	}
+
+	if len(rates) > top {
+		rates = rates[:top]
+	}
+
+	writeJSON(w, r, map[string]interface{}{"windowSeconds": throughputWindow, "tunnels": rates})
+	slog.InfoContext(r.Context(), "Served throughput stats")
+}
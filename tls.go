@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var tlsCertFile = flag.String("tls-cert", os.Getenv("TLS_CERT"), "Serve HTTPS with this certificate file, together with -tls-key (env TLS_CERT)")
+var tlsKeyFile = flag.String("tls-key", os.Getenv("TLS_KEY"), "Private key file of the -tls-cert certificate (env TLS_KEY)")
+var autocertDomainList = flag.String("autocert-domain", os.Getenv("AUTOCERT_DOMAIN"), "Serve HTTPS with certificates from Let's Encrypt for these comma separated domains (env AUTOCERT_DOMAIN)")
+var autocertCacheDir = flag.String("autocert-cache", envOr("AUTOCERT_CACHE", "autocert-cache"), "Directory where certificates from Let's Encrypt are kept across restarts (env AUTOCERT_CACHE)")
+var httpRedirectPort = flag.String("http-redirect-port", os.Getenv("HTTP_REDIRECT_PORT"), "With HTTPS, also listen for plain HTTP on this port and redirect it to HTTPS, e.g. 80 (env HTTP_REDIRECT_PORT)")
+
+// tlsEnabled reports whether the server is served over HTTPS.
+func tlsEnabled() bool {
+	return *tlsCertFile != "" || *autocertDomainList != ""
+}
+
+// configureTLS prepares server for HTTPS as configured by the flags, and
+// returns the plain HTTP server redirecting to it, if one was asked for.
+// Certificates from Let's Encrypt are requested on the first connection for
+// each domain, and renewed before they expire.
+func configureTLS(server *http.Server) (*http.Server, error) {
+	if (*tlsCertFile == "") != (*tlsKeyFile == "") {
+		return nil, errors.New("-tls-cert and -tls-key must be set together")
+	}
+	if *tlsCertFile != "" && *autocertDomainList != "" {
+		return nil, errors.New("-tls-cert and -autocert-domain cannot be combined")
+	}
+	if !tlsEnabled() {
+		if *httpRedirectPort != "" {
+			return nil, errors.New("-http-redirect-port requires -tls-cert or -autocert-domain")
+		}
+		return nil, nil
+	}
+
+	var redirect http.Handler = http.HandlerFunc(redirectToHTTPS)
+	if *autocertDomainList != "" {
+		var domains []string
+		for _, domain := range strings.Split(*autocertDomainList, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				domains = append(domains, domain)
+			}
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(*autocertCacheDir),
+		}
+		server.TLSConfig = manager.TLSConfig()
+		// The redirecting listener also answers the HTTP challenges Let's
+		// Encrypt uses to check the domains.
+		redirect = manager.HTTPHandler(redirect)
+	}
+
+	if *httpRedirectPort == "" {
+		return nil, nil
+	}
+	return &http.Server{Addr: net.JoinHostPort(*listenAddr, *httpRedirectPort), Handler: redirect}, nil
+}
+
+// listenAndServe serves server over HTTPS when it is enabled, or plain HTTP.
+func listenAndServe(server *http.Server) error {
+	if !tlsEnabled() {
+		return server.ListenAndServe()
+	}
+	// With autocert the certificates come from server.TLSConfig instead.
+	return server.ListenAndServeTLS(*tlsCertFile, *tlsKeyFile)
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL on the HTTPS
+// port.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if *listenPort != "443" {
+		host = net.JoinHostPort(host, *listenPort)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
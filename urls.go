@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var baseURL = flag.String("base-url", os.Getenv("BASE_URL"), "Public URL of the server used in the URLs of create responses, e.g. https://tunnel.example.com, defaults to the scheme and host of each request (env BASE_URL)")
+
+// validBaseURL checks -base-url, which must be an http or https URL without
+// a query, and drops any trailing slash.
+func validBaseURL(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", errors.New("the base URL must be an http or https URL, such as https://tunnel.example.com")
+	}
+	if parsed.RawQuery != "" || parsed.Fragment != "" {
+		return "", errors.New("the base URL must not have a query or fragment")
+	}
+	return strings.TrimSuffix(value, "/"), nil
+}
+
+// requestBaseURL returns -base-url, or else the scheme and host the request
+// was sent to. Requests from a trusted proxy may give them in
+// X-Forwarded-Proto and X-Forwarded-Host.
+func requestBaseURL(r *http.Request) string {
+	if *baseURL != "" {
+		return *baseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	if isTrustedProxy(remoteIP) {
+		if proto := firstForwarded(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if forwardedHost := firstForwarded(r.Header.Get("X-Forwarded-Host")); forwardedHost != "" {
+			host = forwardedHost
+		}
+	}
+	return scheme + "://" + host
+}
+
+// firstForwarded returns the first entry of a comma separated X-Forwarded-*
+// header, the one set by the proxy closest to the client.
+func firstForwarded(value string) string {
+	first, _, _ := strings.Cut(value, ",")
+	return strings.TrimSpace(first)
+}
+
+// tunnelURLs returns the ready to use stream, get and send URLs of a tunnel.
+func tunnelURLs(r *http.Request, tunnelId string) map[string]string {
+	base := requestBaseURL(r)
+	query := "?id=" + url.QueryEscape(tunnelId)
+	return map[string]string{
+		"stream": base + "/api/v3/tunnel/stream" + query,
+		"get":    base + "/api/v3/tunnel/get" + query,
+		"send":   base + "/api/v3/tunnel/send" + query,
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"flag"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+//go:embed web
+var embeddedWeb embed.FS
+
+var webRoot = flag.String("webroot", "web", "Directory the web pages are served from; pages missing there are served from the copies built into the binary (empty serves only those)")
+
+// openWebFile opens a file from -webroot if one is set, and otherwise, or if
+// the file is missing there, from the web/ directory embedded at build time,
+// so the binary works from any working directory.
+func openWebFile(name string) (fs.File, error) {
+	if *webRoot != "" {
+		file, err := os.DirFS(*webRoot).Open(name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return file, err
+		}
+		slog.Debug("Web file missing", "dir", *webRoot, "name", name)
+	}
+	return embeddedWeb.Open("web/" + name)
+}
+
+func serveWebFile(w http.ResponseWriter, r *http.Request, name string) {
+	file, err := openWebFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.WarnContext(r.Context(), "Web file not found", "name", name, "status", http.StatusNotFound)
+		http.Error(w, "Web file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to open web file", "error", err, "status", http.StatusInternalServerError)
+		http.Error(w, "Failed to open web file", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to read web file", "error", err, "status", http.StatusInternalServerError)
+		http.Error(w, "Failed to read web file", http.StatusInternalServerError)
+		return
+	}
+
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		slog.ErrorContext(r.Context(), "Web file does not support seeking", "name", name, "status", http.StatusInternalServerError)
+		http.Error(w, "Failed to read web file", http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
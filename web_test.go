@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWebRootOverridesBuiltInPages(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("custom home page"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, webRoot, dir)
+
+	w := httptest.NewRecorder()
+	homePage(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != "custom home page" {
+		t.Errorf("home page = %d %q, want the page from -webroot", w.Code, w.Body.String())
+	}
+}
+
+func TestMissingWebFileAnswers404(t *testing.T) {
+	setFlag(t, webRoot, t.TempDir())
+
+	w := httptest.NewRecorder()
+	serveWebFile(w, httptest.NewRequest(http.MethodGet, "/missing.txt", nil), "missing.txt")
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if strings.Contains(w.Body.String(), "missing.txt") {
+		t.Errorf("body %q exposes the file name", w.Body.String())
+	}
+}
+
+func TestHomePageIsServedFromTheEmbeddedFiles(t *testing.T) {
+	embedded, err := embeddedWeb.ReadFile("web/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Run from elsewhere, with or without a -webroot that has the page.
+	for _, root := range []string{"", t.TempDir(), filepath.Join(t.TempDir(), "missing")} {
+		setFlag(t, webRoot, root)
+		w := httptest.NewRecorder()
+		homePage(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if w.Code != http.StatusOK || w.Body.String() != string(embedded) {
+			t.Errorf("home page with -webroot %q = %d, want the embedded page", root, w.Code)
+		}
+		if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") {
+			t.Errorf("home page with -webroot %q has Content-Type %q, want text/html", root, contentType)
+		}
+	}
+}
+
+func TestLicenseIsServedFromTheEmbeddedFiles(t *testing.T) {
+	setFlag(t, webRoot, "")
+	embedded, err := embeddedWeb.ReadFile("web/LICENSE.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	giveLicense(w, httptest.NewRequest(http.MethodGet, "/LICENSE", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != string(embedded) {
+		t.Errorf("license = %d, want the embedded file", w.Code)
+	}
+}
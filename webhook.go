@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+var webhookTimeout = flag.Duration("webhook-timeout", 5*time.Second, "How long a webhook request may take before it counts as failed")
+var webhookRetries = flag.Int("webhook-retries", 3, "How many times a failed webhook delivery is retried, with exponential backoff")
+var webhookRetryDelay = flag.Duration("webhook-retry-delay", time.Second, "Wait before the first retry of a failed webhook delivery, doubled for each retry after it")
+var maxWebhooks = flag.Int("max-webhooks", 10, "Maximum webhooks registered per subchannel")
+var webhookAllowPrivate = flag.Bool("webhook-allow-private", false, "Let webhooks call loopback, private and link-local addresses")
+
+var errPrivateAddress = errors.New("webhooks may not call private addresses")
+
+// webhookClient delivers webhooks. Unless -webhook-allow-private is set, its
+// dialer refuses private addresses, which covers host names resolving to
+// them and redirects too.
+var webhookClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				if *webhookAllowPrivate {
+					return nil
+				}
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+					return errPrivateAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// validWebhookRetryDelay checks -webhook-retry-delay, which must be positive
+// for the backoff to grow.
+func validWebhookRetryDelay(delay time.Duration) error {
+	if delay <= 0 {
+		return fmt.Errorf("invalid delay %s, it must be positive", delay)
+	}
+	return nil
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast()
+}
+
+// webhookPayload is the JSON body POSTed to webhooks for each message.
+type webhookPayload struct {
+	TunnelID    string    `json:"tunnelId"`
+	SubChannel  string    `json:"subChannel"`
+	Content     string    `json:"content"`
+	Encoding    string    `json:"encoding,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	Sequence    uint64    `json:"sequence"`
+	SentAt      time.Time `json:"sentAt"`
+}
+
+// tunnelWebhook registers, unregisters and lists the webhook URLs of a
+// subchannel. Every message sent to the subchannel is POSTed to them, and
+// webhooks registered on `*` get the messages of all subchannels.
+func tunnelWebhook(w http.ResponseWriter, r *http.Request) {
+	params, ok := parseTunnelParams(w, r)
+	if !ok {
+		return
+	}
+	tunnelId := params.ID
+	subChannel := params.SubChannel
+	action := firstNonEmpty(params.Get("action"), "register")
+	webhookURL := params.Get("url")
+
+	if !params.checkID(w, r) {
+		return
+	}
+
+	if !params.checkSubChannel(w, r) {
+		return
+	}
+
+	if action != "register" && action != "unregister" && action != "list" {
+		slog.WarnContext(r.Context(), "Invalid 'action' value", "value", action, "status", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "The 'action' must be 'register', 'unregister' or 'list'")
+		return
+	}
+
+	if action != "list" {
+		if err := validWebhookURL(webhookURL); err != nil {
+			slog.WarnContext(r.Context(), "Invalid 'url' value", "value", webhookURL, "error", err, "status", http.StatusBadRequest)
+			writeJSONError(w, http.StatusBadRequest, "The request must contain a valid http or https 'url' parameter or field")
+			return
+		}
+		if rejectIfReadOnly(w) {
+			return
+		}
+	}
+
+	tunnelsMutex.Lock()
+	tunnel, exists := liveTunnel(tunnelId)
+	if !exists {
+		tunnelsMutex.Unlock()
+		slog.WarnContext(r.Context(), "No tunnel with this id exists", "tunnel_id", tunnelId, "status", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, "No tunnel with this id exists.")
+		return
+	}
+	if status := tunnel.secretStatus(r, params); status != http.StatusOK {
+		tunnelsMutex.Unlock()
+		rejectSecret(w, r, status, tunnelId)
+		return
+	}
+	switch action {
+	case "register":
+		if !tunnel.addWebhook(subChannel, webhookURL) {
+			tunnelsMutex.Unlock()
+			slog.WarnContext(r.Context(), "Too many webhooks", "tunnel_id", tunnelId, "subchannel", subChannel, "status", http.StatusConflict)
+			writeJSONError(w, http.StatusConflict, fmt.Sprintf("A subchannel can have at most %d webhooks", *maxWebhooks))
+			return
+		}
+	case "unregister":
+		tunnel.removeWebhook(subChannel, webhookURL)
+	}
+	urls := append([]string{}, tunnel.Webhooks[subChannel]...)
+	tunnelsMutex.Unlock()
+
+	writeJSON(w, r, urls)
+	switch action {
+	case "register":
+		slog.InfoContext(r.Context(), "Registered webhook", "tunnel_id", tunnelId, "subchannel", subChannel)
+	case "unregister":
+		slog.InfoContext(r.Context(), "Unregistered webhook", "tunnel_id", tunnelId, "subchannel", subChannel)
+	}
+}
+
+func validWebhookURL(value string) error {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", parsed.Scheme)
+	}
+	if parsed.Host == "" {
+		return errors.New("missing host")
+	}
+	return nil
+}
+
+// addWebhook registers a webhook on a subchannel, and returns false if the
+// subchannel already has -max-webhooks. Registering a URL twice has no
+// effect. Must be called with tunnelsMutex held.
+func (t *Tunnel) addWebhook(subChannel string, webhookURL string) bool {
+	for _, registered := range t.Webhooks[subChannel] {
+		if registered == webhookURL {
+			return true
+		}
+	}
+	if len(t.Webhooks[subChannel]) >= *maxWebhooks {
+		return false
+	}
+	t.Webhooks[subChannel] = append(t.Webhooks[subChannel], webhookURL)
+	return true
+}
+
+// removeWebhook unregisters a webhook. Must be called with tunnelsMutex held.
+func (t *Tunnel) removeWebhook(subChannel string, webhookURL string) {
+	registered := t.Webhooks[subChannel]
+	for i, candidate := range registered {
+		if candidate == webhookURL {
+			t.Webhooks[subChannel] = append(registered[:i:i], registered[i+1:]...)
+			break
+		}
+	}
+	if len(t.Webhooks[subChannel]) == 0 {
+		delete(t.Webhooks, subChannel)
+	}
+}
+
+// webhooksFor returns the webhooks a message sent to subChannel goes to,
+// those of the subchannel and those of `*`. Must be called with
+// tunnelsMutex held.
+func (t *Tunnel) webhooksFor(subChannel string) []string {
+	var urls []string
+	urls = append(urls, t.Webhooks[subChannel]...)
+	return append(urls, t.Webhooks[wildcardSubChannel]...)
+}
+
+// deliverWebhooks POSTs a message to each of the webhooks in the background,
+// so slow or failing endpoints never hold up the sender. With a signing key,
+// the body is signed in the X-Signature header.
+func deliverWebhooks(tunnelId string, urls []string, signingKey []byte, msg StreamMessage) {
+	if len(urls) == 0 {
+		return
+	}
+	payload := webhookPayload{
+		TunnelID:    tunnelId,
+		SubChannel:  msg.SubChannel,
+		Content:     msg.Content,
+		ContentType: msg.ContentType,
+		Sequence:    msg.Sequence,
+		SentAt:      msg.SentAt,
+	}
+	if msg.Binary {
+		payload.Content = base64.StdEncoding.EncodeToString([]byte(msg.Content))
+		payload.Encoding = base64Encoding
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Failed to encode webhook payload", "tunnel_id", tunnelId, "error", err)
+		return
+	}
+	var signature string
+	if signingKey != nil {
+		signature = signContent(signingKey, body)
+	}
+	for _, webhookURL := range urls {
+		go deliverWebhook(tunnelId, webhookURL, body, signature)
+	}
+}
+
+// deliverWebhook POSTs body to a webhook, retrying up to -webhook-retries
+// times until it answers with a 2xx status. Retries stop when the server
+// shuts down.
+func deliverWebhook(tunnelId string, webhookURL string, body []byte, signature string) {
+	delay := *webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := postWebhook(webhookURL, body, signature)
+		if err == nil {
+			webhookDeliveries.WithLabelValues("delivered").Inc()
+			slog.Debug("Delivered webhook", "tunnel_id", tunnelId, "url", webhookURL)
+			return
+		}
+		// Private addresses stay refused, so there is no point in retrying.
+		if attempt >= *webhookRetries || errors.Is(err, errPrivateAddress) {
+			webhookDeliveries.WithLabelValues("failed").Inc()
+			slog.Warn("Failed to deliver webhook", "tunnel_id", tunnelId, "url", webhookURL, "attempts", attempt+1, "error", err)
+			return
+		}
+		slog.Debug("Retrying webhook", "tunnel_id", tunnelId, "url", webhookURL, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-shuttingDown:
+			webhookDeliveries.WithLabelValues("failed").Inc()
+			return
+		}
+		delay *= 2
+	}
+}
+
+func postWebhook(webhookURL string, body []byte, signature string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *webhookTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", *serverHeader)
+	if signature != "" {
+		request.Header.Set(signatureHeader, signature)
+	}
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", response.Status)
+	}
+	return nil
+}
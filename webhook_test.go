@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeliverWebhookRetriesAfterRetryDelay(t *testing.T) {
+	setFlag(t, webhookAllowPrivate, true)
+	setFlag(t, webhookRetries, 3)
+	setFlag(t, webhookRetryDelay, 50*time.Millisecond)
+
+	var attempts atomic.Int32
+	var lastAttempt atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastAttempt.Store(time.Now().UnixNano())
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	deliverWebhook("tunnel", server.URL, []byte(`{}`), "")
+
+	if got := attempts.Load(); got != 3 {
+		t.Fatalf("webhook called %d times, want 3", got)
+	}
+	// The retries wait 50ms and then 100ms.
+	if waited := time.Duration(lastAttempt.Load() - start.UnixNano()); waited < 150*time.Millisecond {
+		t.Errorf("delivered after %s, want at least 150ms of backoff", waited)
+	}
+}
+
+func TestValidWebhookRetryDelay(t *testing.T) {
+	for _, delay := range []time.Duration{0, -time.Second} {
+		if err := validWebhookRetryDelay(delay); err == nil {
+			t.Errorf("validWebhookRetryDelay(%s) = nil, want an error", delay)
+		}
+	}
+	if err := validWebhookRetryDelay(time.Millisecond); err != nil {
+		t.Errorf("validWebhookRetryDelay(1ms) = %v, want nil", err)
+	}
+}
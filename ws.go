@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsWriteTimeout bounds how long a write to a WebSocket may block.
+const wsWriteTimeout = 10 * time.Second
+
+var wsUpgrader = websocket.Upgrader{
+	// Browsers may connect from the origins the CORS settings allow, other
+	// clients send no Origin at all.
+	CheckOrigin: func(r *http.Request) bool {
+		return r.Header.Get("Origin") == "" || tunnelAllowedOrigin(r) != ""
+	},
+}
+
+// wsEvent is a JSON text frame sent to a WebSocket client.
+type wsEvent struct {
+	Type        string `json:"type"`
+	SubChannel  string `json:"subChannel,omitempty"`
+	Content     string `json:"content,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Sequence    uint64 `json:"sequence,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// tunnelWebSocket is a full duplex alternative to streamTunnelContent. The
+// connection is subscribed to a subchannel like a stream and receives every
+// message as a JSON `message` event, while content the client writes to the
+// socket is sent to the tunnel like with sendToTunnel.
+func tunnelWebSocket(w http.ResponseWriter, r *http.Request) {
+	params, ok := parseTunnelParams(w, r)
+	if !ok {
+		return
+	}
+	tunnelId := params.ID
+	subChannel := params.SubChannel
+	wildcard := subChannel == wildcardSubChannel
+
+	if !params.checkID(w, r) {
+		return
+	}
+
+	if !params.checkSubChannel(w, r) {
+		return
+	}
+
+	tunnelsMutex.Lock()
+	tunnel, exists := liveTunnel(tunnelId)
+	if !exists {
+		tunnelsMutex.Unlock()
+		slog.WarnContext(r.Context(), "No tunnel with this id exists", "tunnel_id", tunnelId, "status", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, "No tunnel with this id exists.")
+		return
+	}
+	if status := tunnel.secretStatus(r, params); status != http.StatusOK {
+		tunnelsMutex.Unlock()
+		rejectSecret(w, r, status, tunnelId)
+		return
+	}
+	tunnel.touch()
+	tunnelsMutex.Unlock()
+
+	if !acquireConnection() {
+		rejectTooManyConnections(w, r)
+		return
+	}
+	defer releaseConnection()
+
+	slots, err := acquireStreamSlot(r.Context(), tunnelId)
+	switch {
+	case errors.Is(err, errStreamQueueFull):
+		slog.WarnContext(r.Context(), "Too many streams", "tunnel_id", tunnelId, "status", http.StatusTooManyRequests)
+		writeJSONError(w, http.StatusTooManyRequests, "Too many streams for this tunnel. Please try again later.")
+		return
+	case errors.Is(err, errStreamQueueTimeout):
+		slog.WarnContext(r.Context(), "Timed out waiting for a stream slot", "tunnel_id", tunnelId, "status", http.StatusServiceUnavailable)
+		writeJSONError(w, http.StatusServiceUnavailable, "Timed out waiting for a free stream on this tunnel.")
+		return
+	case err != nil:
+		slog.InfoContext(r.Context(), "Client left while waiting for a stream slot", "tunnel_id", tunnelId)
+		return
+	}
+	defer releaseStreamSlot(tunnelId, slots)
+
+	subscriber := newSubscriber()
+	if err := addSubscriber(tunnelId, subChannel, subscriber); err != nil {
+		slog.WarnContext(r.Context(), "Too many wildcard subscribers", "tunnel_id", tunnelId, "status", http.StatusTooManyRequests)
+		writeJSONError(w, http.StatusTooManyRequests, "Too many subscribers to all subchannels. Please try again later.")
+		return
+	}
+
+	// The upgrade writes its own error response on failure.
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		removeSubscriber(tunnelId, subChannel, subscriber)
+		slog.ErrorContext(r.Context(), "Failed to upgrade to WebSocket", "tunnel_id", tunnelId, "error", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(*maxBodySize)
+
+	slog.InfoContext(r.Context(), "Client connected to WebSocket", "tunnel_id", tunnelId, "subchannel", subChannel)
+	activeStreams.Inc()
+	defer activeStreams.Dec()
+
+	// Only this goroutine writes to the connection. The reader hands its
+	// replies over through replies and closes done when the client is gone.
+	// quit tells the reader this goroutine stopped taking replies.
+	replies := make(chan wsEvent, 16)
+	done := make(chan struct{})
+	quit := make(chan struct{})
+	defer close(quit)
+	go readWebSocket(conn, r, tunnel, subChannel, replies, done, quit)
+
+	write := func(event wsEvent) error {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return conn.WriteJSON(event)
+	}
+	closeWith := func(code int, event wsEvent) {
+		write(event)
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, event.Reason), time.Now().Add(wsWriteTimeout))
+	}
+
+	// Replay what a resuming client missed from the history, as streams do
+	// for Last-Event-ID.
+	var minSequence uint64
+	if lastSequence, ok := lastEventID(r, params); ok && !wildcard {
+		minSequence = lastSequence + 1
+		tunnelsMutex.Lock()
+		missed := tunnel.historySince(subChannel, lastSequence)
+		tunnelsMutex.Unlock()
+		missed = loadHistory(missed)
+		for _, msg := range missed {
+			if err := write(wsMessageEvent(msg, false)); err != nil {
+				removeSubscriber(tunnelId, subChannel, subscriber)
+				slog.InfoContext(r.Context(), "Failed to write to WebSocket", "tunnel_id", tunnelId, "subchannel", subChannel, "error", err)
+				return
+			}
+			minSequence = msg.Sequence + 1
+		}
+	}
+
+	var keepalive <-chan time.Time
+	if *heartbeatInterval > 0 {
+		heartbeatTicker := time.NewTicker(*heartbeatInterval)
+		defer heartbeatTicker.Stop()
+		keepalive = heartbeatTicker.C
+	}
+
+	for {
+		select {
+		case msg, ok := <-subscriber.next():
+			if !ok {
+				closeWith(websocket.CloseNormalClosure, wsEvent{Type: "closed", Reason: subscriber.closeReason})
+				slog.InfoContext(r.Context(), "Tunnel removed, closing WebSocket", "tunnel_id", tunnelId, "subchannel", subChannel)
+				return
+			}
+			if !wildcard && !msg.Comment && msg.Sequence < minSequence {
+				continue
+			}
+			if err := write(wsMessageEvent(msg, wildcard)); err != nil {
+				removeSubscriber(tunnelId, subChannel, subscriber)
+				slog.InfoContext(r.Context(), "Failed to write to WebSocket", "tunnel_id", tunnelId, "subchannel", subChannel, "error", err)
+				return
+			}
+		case reply := <-replies:
+			// Returning closes the connection, which stops the reader too.
+			if err := write(reply); err != nil {
+				removeSubscriber(tunnelId, subChannel, subscriber)
+				slog.DebugContext(r.Context(), "Failed to write a reply to WebSocket", "tunnel_id", tunnelId, "subchannel", subChannel, "error", err)
+				return
+			}
+		case <-keepalive:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				removeSubscriber(tunnelId, subChannel, subscriber)
+				slog.InfoContext(r.Context(), "Keepalive failed, closing WebSocket", "tunnel_id", tunnelId, "subchannel", subChannel, "error", err)
+				return
+			}
+		case <-subscriber.Evicted:
+			removeSubscriber(tunnelId, subChannel, subscriber)
+			closeWith(websocket.ClosePolicyViolation, wsEvent{Type: "closed", Reason: "slow"})
+			slog.InfoContext(r.Context(), "Closing WebSocket of slow client", "tunnel_id", tunnelId, "subchannel", subChannel)
+			return
+		case <-shuttingDown:
+			removeSubscriber(tunnelId, subChannel, subscriber)
+			closeWith(websocket.CloseGoingAway, wsEvent{Type: "reconnect", Reason: "shutdown"})
+			slog.InfoContext(r.Context(), "Closed WebSocket for shutdown", "tunnel_id", tunnelId, "subchannel", subChannel)
+			return
+		case <-done:
+			removeSubscriber(tunnelId, subChannel, subscriber)
+			slog.InfoContext(r.Context(), "Client disconnected from WebSocket", "tunnel_id", tunnelId, "subchannel", subChannel)
+			return
+		}
+	}
+}
+
+// wsMessageEvent turns a delivered message into the event sent to the
+// client. Binary content is base64-encoded as on SSE streams.
+func wsMessageEvent(msg StreamMessage, wildcard bool) wsEvent {
+	if msg.Comment {
+		return wsEvent{Type: "comment", Content: msg.Content}
+	}
+	event := wsEvent{Type: "message", Content: streamContent(msg.Content, msg.Binary), Sequence: msg.Sequence}
+	if wildcard {
+		event.SubChannel = msg.SubChannel
+	}
+	if msg.Binary {
+		event.Encoding = base64Encoding
+	}
+	event.ContentType = msg.ContentType
+	return event
+}
+
+// readWebSocket sends the content the client writes to the socket until the
+// connection closes or quit is closed. Text frames are JSON objects with the
+// fields of the send endpoint, binary frames are sent as binary content to
+// the connection's subchannel. Every send is answered with a `sent` or an
+// `error` event.
+func readWebSocket(conn *websocket.Conn, r *http.Request, tunnel *Tunnel, subChannel string, replies chan<- wsEvent, done chan<- struct{}, quit <-chan struct{}) {
+	defer close(done)
+	ip := clientIP(r)
+	reply := func(event wsEvent) bool {
+		select {
+		case replies <- event:
+			return true
+		case <-quit:
+			return false
+		}
+	}
+	for {
+		frameType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		fields := make(map[string]string)
+		rawContent := false
+		if frameType == websocket.BinaryMessage {
+			fields["content"] = string(data)
+			rawContent = true
+		} else if err := addBodyFields(fields, data); err != nil {
+			if !reply(wsEvent{Type: "error", Error: "Messages must be JSON objects with a 'content' field"}) {
+				return
+			}
+			continue
+		}
+		resolveFieldAliases(fields)
+		// The socket only sends to its own tunnel, and to its own
+		// subchannel unless the message names another.
+		fields["id"] = tunnel.ID
+		fields["subChannel"] = firstNonEmpty(fields["subChannel"], subChannel)
+		params := newTunnelParams(r, fields, rawContent)
+
+		sequence, err := wsSendContent(ip, tunnel, params)
+		if err != nil {
+			if !reply(wsEvent{Type: "error", SubChannel: params.SubChannel, Error: err.Error()}) {
+				return
+			}
+			continue
+		}
+		if !reply(wsEvent{Type: "sent", SubChannel: params.SubChannel, Sequence: sequence}) {
+			return
+		}
+		slog.InfoContext(r.Context(), "Sent content over WebSocket", "tunnel_id", tunnel.ID, "subchannel", params.SubChannel)
+	}
+}
+
+// wsSendContent applies the checks of sendToTunnel to content sent over a
+// WebSocket. Each send counts against the rate limits like a request would.
+func wsSendContent(ip string, tunnel *Tunnel, params TunnelParams) (uint64, error) {
+	if readOnly.Load() {
+		return 0, errors.New("The server is in read-only mode")
+	}
+	msg, rejection := newSendMessage(params)
+	if rejection != nil {
+		return 0, errors.New(rejection.message)
+	}
+	if allowed, _, _ := ipLimiters.allow(ip); !allowed {
+		rateLimitRejections.WithLabelValues("ip").Inc()
+		return 0, errors.New("Too many requests. Please slow down.")
+	}
+	if allowed, _, _ := tunnelLimiters.allow(tunnel.ID); !allowed {
+		rateLimitRejections.WithLabelValues("tunnel").Inc()
+		return 0, errors.New("Too many requests for this tunnel. Please slow down.")
+	}
+
+	sequence, err := sendContent(tunnel, msg)
+	if errors.Is(err, errTunnelGone) {
+		return 0, errors.New("No tunnel with this id exists.")
+	}
+	if _, message, ok := queueSendError(err); ok {
+		return 0, errors.New(message)
+	}
+	if err != nil {
+		slog.Error("Failed to store content", "error", err)
+		return 0, errors.New("Failed to store content")
+	}
+	return sequence, nil
+}
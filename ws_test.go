@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// serveReadWebSocket runs readWebSocket for each connection to a test
+// server, and returns a client connection to it.
+func serveReadWebSocket(t *testing.T, tunnel *Tunnel, replies chan wsEvent, done chan struct{}, quit chan struct{}) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		readWebSocket(conn, r, tunnel, "main", replies, done, quit)
+	}))
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestReadWebSocketStopsOnceRepliesAreNotTaken(t *testing.T) {
+	resetTunnels(t)
+	tunnel := addTestTunnel("ws")
+	done := make(chan struct{})
+	quit := make(chan struct{})
+	// Nobody takes replies, as after the writer returned.
+	close(quit)
+	conn := serveReadWebSocket(t, tunnel, make(chan wsEvent), done, quit)
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reader is still blocked on its reply")
+	}
+}
+
+func TestReadWebSocketChecksSendsLikeTheSendEndpoint(t *testing.T) {
+	resetTunnels(t)
+	setFlag(t, &ipLimiters, NewRateLimiterStore(0, 0))
+	setFlag(t, &tunnelLimiters, NewRateLimiterStore(0, 0))
+	tunnel := addTestTunnel("ws")
+	replies := make(chan wsEvent, 1)
+	quit := make(chan struct{})
+	defer close(quit)
+	conn := serveReadWebSocket(t, tunnel, replies, make(chan struct{}), quit)
+
+	tests := []struct {
+		frame string
+		want  wsEvent
+	}{
+		{`{"content": "hello"}`, wsEvent{Type: "sent", SubChannel: "main", Sequence: 1}},
+		{`{"content": "hi", "subchannel": "other"}`, wsEvent{Type: "sent", SubChannel: "other", Sequence: 1}},
+		{`{"content": "aGk=", "encoding": "hex"}`, wsEvent{Type: "error", SubChannel: "main", Error: "The 'content' must be valid base64 when 'encoding' is 'base64', the only supported encoding"}},
+		{`{"content": "hi", "asComment": true, "append": true}`, wsEvent{Type: "error", SubChannel: "main", Error: "Binary content and comments cannot be sent with 'append'"}},
+		{`{"content": "hi", "subChannel": "*"}`, wsEvent{Type: "error", SubChannel: "*", Error: "Content cannot be sent to the '*' subChannel"}},
+	}
+	for _, test := range tests {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(test.frame)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case reply := <-replies:
+			if reply != test.want {
+				t.Errorf("reply to %s = %+v, want %+v", test.frame, reply, test.want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no reply to %s", test.frame)
+		}
+	}
+
+	tunnelsMutex.Lock()
+	ref := tunnel.contentRef("main")
+	tunnelsMutex.Unlock()
+	content, err := ref.read()
+	if err != nil || content != "hello" {
+		t.Errorf("content = %q, %v, want hello", content, err)
+	}
+}